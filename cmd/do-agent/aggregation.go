@@ -1,5 +1,10 @@
 package main
 
+import (
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/relabel"
+)
+
 var dropletAggregationSpec = map[string][]string{
 	"sonar_cpu": {"cpu"},
 }
@@ -226,6 +231,33 @@ var gpuAggregationSpec = map[string][]string{
 	"amd_gpu_prof_sm_active":                                 amdAggregatedLabels,
 }
 
+// gpuAggregationOps averages utilization, temperature and clock gauges of
+// partitions and processes aggregated into one GPU. Everything else is summed
+var gpuAggregationOps = map[string]aggregate.Op{
+	"dcgm_fi_dev_gpu_util":            aggregate.Avg,
+	"dcgm_fi_prof_sm_occupancy":       aggregate.Avg,
+	"dcgm_fi_prof_pipe_tensor_active": aggregate.Avg,
+	"dcgm_fi_dev_gpu_temp":            aggregate.Avg,
+	"dcgm_fi_dev_memory_temp":         aggregate.Avg,
+	"dcgm_fi_prof_sm_active":          aggregate.Avg,
+	"dcgm_fi_prof_pipe_fp16_active":   aggregate.Avg,
+	"dcgm_fi_prof_pipe_fp32_active":   aggregate.Avg,
+	"dcgm_fi_prof_pipe_fp64_active":   aggregate.Avg,
+	"dcgm_fi_dev_sm_clock":            aggregate.Avg,
+
+	"amd_gpu_prof_gui_util_percent":      aggregate.Avg,
+	"amd_gpu_prof_valu_pipe_issue_util":  aggregate.Avg,
+	"amd_gpu_prof_tensor_active_percent": aggregate.Avg,
+	"amd_gpu_prof_occupancy_percent":     aggregate.Avg,
+	"amd_gpu_prof_sm_active":             aggregate.Avg,
+	"amd_gpu_gfx_activity":               aggregate.Avg,
+	"amd_gpu_clock":                      aggregate.Avg,
+	"amd_gpu_junction_temperature":       aggregate.Max,
+	"amd_gpu_memory_temperature":         aggregate.Max,
+	"amd_pcie_speed":                     aggregate.Min,
+	"amd_pcie_max_speed":                 aggregate.Max,
+}
+
 // DI metrics: drop high-cardinality labels we don't want to keep.
 // NOTE: do NOT include "le" because bucket-style series need it.
 var diLabelsToDrop = []string{
@@ -264,3 +296,37 @@ var diAggregationSpec = map[string][]string{
 	"gradient_infra_di_vllm:request_time_per_output_token_seconds_bucket": diLabelsToDrop,
 	"gradient_infra_di_vllm:time_to_first_token_seconds_bucket":           diLabelsToDrop,
 }
+
+// diAggregationOps averages the DI gauges which are not additive
+var diAggregationOps = map[string]aggregate.Op{
+	"gradient_infra_di_gpu_junction_temperature":       aggregate.Max,
+	"gradient_infra_di_gpu_memory_temperature":         aggregate.Max,
+	"gradient_infra_di_gpu_occupancy_percent":          aggregate.Avg,
+	"gradient_infra_di_gpu_tensor_utilization_percent": aggregate.Avg,
+	"gradient_infra_di_vllm:kv_cache_usage_perc":       aggregate.Avg,
+}
+
+// kubeletAggregationSpec aggregates cAdvisor series per container, dropping
+// the cgroup, container runtime ID, image and interface labels. Only series of
+// containers are kept, see cadvisorRelabelConfigs
+var kubeletAggregationSpec = map[string][]string{
+	"container_network_receive_bytes_total":            {"id", "name", "image", "interface"},
+	"container_network_transmit_bytes_total":           {"id", "name", "image", "interface"},
+	"container_network_receive_packets_dropped_total":  {"id", "name", "image", "interface"},
+	"container_network_transmit_packets_dropped_total": {"id", "name", "image", "interface"},
+	"container_memory_rss":                             {"id", "name", "image"},
+	"container_cpu_cfs_throttled_periods_total":        {"id", "name", "image"},
+	"container_fs_reads_bytes_total":                   {"id", "name", "image", "device"},
+	"container_fs_writes_bytes_total":                  {"id", "name", "image", "device"},
+}
+
+// cadvisorRelabelConfigs keep only the cAdvisor series of containers, which
+// have both a pod and an image. The root, system slice, QoS class and pod
+// cgroups contain the containers below them, so once kubeletAggregationSpec
+// drops their id they would be summed into, and double count, the containers
+var cadvisorRelabelConfigs = []*relabel.Config{{
+	SourceLabels: []string{"pod", "image"},
+	Separator:    ";",
+	Regex:        relabel.MustNewRegex(".+;.+"),
+	Action:       relabel.Keep,
+}}
@@ -4,12 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/alecthomas/units"
 	"github.com/digitalocean/do-agent/internal/flags"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -17,10 +20,16 @@ import (
 
 	"github.com/digitalocean/do-agent/internal/log"
 	"github.com/digitalocean/do-agent/internal/process"
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/cardinality"
+	"github.com/digitalocean/do-agent/pkg/clients"
 	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
 	"github.com/digitalocean/do-agent/pkg/collector"
 	"github.com/digitalocean/do-agent/pkg/decorate"
 	"github.com/digitalocean/do-agent/pkg/decorate/compat"
+	"github.com/digitalocean/do-agent/pkg/gather"
+	"github.com/digitalocean/do-agent/pkg/history"
+	"github.com/digitalocean/do-agent/pkg/relabel"
 	"github.com/digitalocean/do-agent/pkg/writer"
 )
 
@@ -43,6 +52,7 @@ var (
 		webListenAddress       string
 		webListen              bool
 		additionalLabels       []string
+		additionalLabelPolicy  string
 		defaultMaxBatchSize    int
 		defaultMaxMetricLength int
 		promAddr               string
@@ -50,6 +60,70 @@ var (
 		gpuMetricsPath         string
 		topK                   int
 		scrapeTimeout          time.Duration
+		collectorTimeout       time.Duration
+		collectorTimeoutFlags  map[string]string
+		collectorTimeouts      map[string]time.Duration
+		collectorIntervalFlags map[string]string
+		collectorIntervals     map[string]time.Duration
+		sampleInterval         time.Duration
+		seriesLimit            int
+		familySeriesLimitFlags map[string]string
+		familySeriesLimits     map[string]int
+		collectorLimitFlags    map[string]string
+		collectorSeriesLimits  map[string]int
+		rollupFlags            map[string]string
+		rollups                map[string][]aggregate.RollupOp
+		counterRateFlags       map[string]string
+		counterRates           map[string]aggregate.RateOp
+		histogramQuantileFlags map[string]string
+		histogramQuantiles     map[string][]float64
+		aggregationSpecFile    string
+		aggregationRules       map[string]aggregate.Rule
+		relabelConfigFile      string
+		relabel                relabel.File
+		staleMarkers           bool
+		staleMarkerSonarFlag   string
+		staleMarkerSonar       *float64
+		scrapeProtocols        []string
+		scrapeSampleLimit      int
+		scrapeBodySizeLimit    units.Base2Bytes
+		scrapeServeStale       time.Duration
+		scrapeLabelPolicy      string
+		scrapeTLS              clients.TLSConfig
+		scrapeBasicAuthUser    string
+		scrapeBasicAuthFile    string
+		scrapeHeaders          map[string]string
+		scrapeProxyURL         *url.URL
+		fileSDPatterns         []string
+		fileSDInterval         time.Duration
+		k8sSD                  bool
+		k8sSDAPIServer         string
+		k8sSDNodeName          string
+		k8sSDCAFile            string
+		k8sSDTokenFile         string
+		k8sSDInterval          time.Duration
+		kubeletAddress         string
+		kubeletCadvisor        bool
+		kubeletTLS             clients.TLSConfig
+		kubeletTokenFile       string
+		fileWriter             bool
+		fileWriterPath         string
+		fileWriterFormat       string
+		fileWriterMaxSize      units.Base2Bytes
+		fileWriterRotate       time.Duration
+		fileWriterMaxBackups   int
+		fileWriterRetention    time.Duration
+		graphiteAddress        string
+		graphiteNetwork        string
+		graphiteProtocol       string
+		graphitePrefix         string
+		graphiteLabelOrder     []string
+		graphiteReplacement    string
+		writerMinInterval      time.Duration
+		writerMaxBackoff       time.Duration
+		historyRetention       time.Duration
+		historyMaxSeries       int
+		historyMaxSamples      int
 	}
 
 	// additionalParams is a list of extra command line flags to append
@@ -93,6 +167,61 @@ func init() {
 	kingpin.Flag("stdout-only", "write all metrics to stdout only").
 		BoolVar(&config.stdoutOnly)
 
+	kingpin.Flag("writer.file", "additionally write all metrics to stdout or --writer.file.path without affecting delivery to sonar").
+		BoolVar(&config.fileWriter)
+
+	kingpin.Flag("writer.file.path", "write metrics to this file instead of stdout when --writer.file is set").
+		StringVar(&config.fileWriterPath)
+
+	kingpin.Flag("writer.file.format", "output format for --stdout-only and --writer.file").
+		Default(string(writer.FormatText)).
+		EnumVar(&config.fileWriterFormat, fileFormats()...)
+
+	kingpin.Flag("writer.file.max-size", "rotate --writer.file.path once it would grow beyond this size (ex. 100MB), 0 disables size based rotation").
+		Default("0").
+		BytesVar(&config.fileWriterMaxSize)
+
+	kingpin.Flag("writer.file.rotate-interval", "rotate --writer.file.path once it has been written to for this long, 0 disables time based rotation").
+		Default("0s").
+		DurationVar(&config.fileWriterRotate)
+
+	kingpin.Flag("writer.file.max-backups", "number of rotated files to keep, 0 keeps all of them").
+		Default("0").
+		IntVar(&config.fileWriterMaxBackups)
+
+	kingpin.Flag("writer.file.retention", "remove rotated files older than this, 0 keeps all of them").
+		Default("0s").
+		DurationVar(&config.fileWriterRetention)
+
+	kingpin.Flag("writer.graphite.address", "additionally write all metrics to a Graphite or StatsD server at this address (ex. graphite.internal:2003)").
+		StringVar(&config.graphiteAddress)
+
+	kingpin.Flag("writer.graphite.network", "network used to reach --writer.graphite.address").
+		Default("tcp").
+		EnumVar(&config.graphiteNetwork, "tcp", "udp")
+
+	kingpin.Flag("writer.graphite.protocol", "plaintext protocol written to --writer.graphite.address").
+		Default(string(writer.ProtocolGraphite)).
+		EnumVar(&config.graphiteProtocol, string(writer.ProtocolGraphite), string(writer.ProtocolDogStatsD))
+
+	kingpin.Flag("writer.graphite.prefix", "prefix prepended to every Graphite path or StatsD metric name").
+		StringVar(&config.graphitePrefix)
+
+	kingpin.Flag("writer.graphite.label-order", "label whose value comes next in Graphite paths, may be repeated. Remaining labels are sorted by name").
+		StringsVar(&config.graphiteLabelOrder)
+
+	kingpin.Flag("writer.graphite.replacement", "replacement for characters in Graphite path components and StatsD metric names, including the prefix, other than letters, digits, '_' and '-'. It must not contain dots or whitespace").
+		Default("_").
+		StringVar(&config.graphiteReplacement)
+
+	kingpin.Flag("writer.min-interval", "minimum time between writes to each additional writer").
+		Default("0s").
+		DurationVar(&config.writerMinInterval)
+
+	kingpin.Flag("writer.max-backoff", "maximum backoff applied to an additional writer after consecutive failures").
+		Default("5m").
+		DurationVar(&config.writerMaxBackoff)
+
 	kingpin.Flag("debug", "display debug information to stdout").
 		BoolVar(&config.debug)
 
@@ -122,7 +251,7 @@ func init() {
 	kingpin.Flag("mongodb-metrics-path", "enable DO DBAAS MongoDB metrics collection (this must be a DO DBAAS metrics endpoint)").
 		StringVar(&config.mongodb)
 
-	kingpin.Flag("metrics-path", "enable metrics collection from a prometheus endpoint").
+	kingpin.Flag("metrics-path", "enable metrics collection from a prometheus endpoint, either a URL or a Unix socket as unix:///path/to.sock:/metrics").
 		StringVar(&config.promAddr)
 
 	kingpin.Flag("gpu-metrics-path", "enable GPU metrics collection from a prometheus endpoint (e.g., AMD device-metrics-exporter)").
@@ -139,8 +268,24 @@ func init() {
 		Default(defaultWebListenAddress).
 		StringVar(&config.webListenAddress)
 
+	kingpin.Flag("history.retention", "keep the metrics sent over this period in memory and serve them on the web listener at "+history.QueryRangePath+", 0 disables the history").
+		Default("0s").
+		DurationVar(&config.historyRetention)
+
+	kingpin.Flag("history.max-series", "maximum number of series kept in the local history").
+		Default("10000").
+		IntVar(&config.historyMaxSeries)
+
+	kingpin.Flag("history.max-samples", "maximum number of samples kept per series in the local history").
+		Default("720").
+		IntVar(&config.historyMaxSamples)
+
 	kingpin.Flag("additional-label", "key value pairs for labels to add to all metrics (ex: user_id:1234)").StringsVar(&config.additionalLabels)
 
+	kingpin.Flag("additional-label.conflict", "how an --additional-label is merged with a metric label of the same name: honor keeps the metric label, overwrite replaces it, rename moves it to exported_<name>").
+		Default(string(decorate.OverwriteLabels)).
+		EnumVar(&config.additionalLabelPolicy, decorate.LabelConflictPolicies()...)
+
 	kingpin.Flag("max-batch-size", "default max batch size for sending metrics. This will be overridden after first write").
 		IntVar(&config.defaultMaxBatchSize)
 	kingpin.Flag("max-metric-length", "default max metric length for metrics. This will be overridden after first write").
@@ -152,9 +297,148 @@ func init() {
 		Default("30s").
 		DurationVar(&config.scrapeTimeout)
 
+	kingpin.Flag("collector-timeout", "time budget of each collector per interval. Collectors exceeding it are skipped until they complete, 0 means no limit").
+		Default("45s").
+		DurationVar(&config.collectorTimeout)
+
+	kingpin.Flag("collector-timeout.per-collector", "time budget overriding --collector-timeout for a collector by name (ex. node=10s)").
+		StringMapVar(&config.collectorTimeoutFlags)
+
+	kingpin.Flag("collector-interval.per-collector", "gather a collector by name only this often, reusing its last result in between (ex. process=5m). Collectors are gathered on every send by default").
+		StringMapVar(&config.collectorIntervalFlags)
+
+	kingpin.Flag("series-limit", "fold the series of a metric family beyond this many into one series summing them, with the labels telling them apart set to "+cardinality.OverflowValue+". 0 disables the limit").
+		Default("0").
+		IntVar(&config.seriesLimit)
+
+	kingpin.Flag("series-limit.per-family", "series limit overriding --series-limit for a metric family by name (ex. kafka_consumergroup_lag=500)").
+		StringMapVar(&config.familySeriesLimitFlags)
+
+	kingpin.Flag("series-limit.per-collector", "limit the series of a collector by name across all of its families. The family reaching the limit is folded like --series-limit and the remaining families are dropped (ex. prometheus=5000)").
+		StringMapVar(&config.collectorLimitFlags)
+
+	kingpin.Flag("sample-interval", "gather the collectors of the --rollup series this often between sends to compute them, 0 disables sampling").
+		Default("0s").
+		DurationVar(&config.sampleInterval)
+
+	kingpin.Flag("rollup", "send the avg, max and/or min of a gauge's samples since the previous send as <name>_<op> (ex. sonar_memory_available=min,max). Requires --sample-interval").
+		StringMapVar(&config.rollupFlags)
+
+	kingpin.Flag("relabel-config-file", "YAML or JSON file of Prometheus relabel_configs applied to all metrics before aggregation (global) and to the samples of scrapers by name (scrapers)").
+		ExistingFileVar(&config.relabelConfigFile)
+
+	kingpin.Flag("counter-rate", "send a counter to the secondary writers as its per-second rate or its delta since the previous send instead of its raw value (ex. sonar_network_receive_bytes=rate). Sonar still receives the raw value. Nothing is sent for a series until its second send").
+		StringMapVar(&config.counterRateFlags)
+
+	kingpin.Flag("stale-markers", "send a staleness marker for every series sent in the previous interval which has disappeared, like those of an exited process or a detached disk. The file writer's text and prometheus formats print it as a plain NaN, its json format writes null, influx and graphite skip the marker and sonar only receives it with --stale-markers.sonar-value").
+		BoolVar(&config.staleMarkers)
+
+	kingpin.Flag("stale-markers.sonar-value", "value sent to sonar for stale series with --stale-markers (ex. -1). Stale markers are not sent to sonar if it is empty").
+		StringVar(&config.staleMarkerSonarFlag)
+
+	kingpin.Flag("aggregation-spec-file", "YAML or JSON file of additional aggregation rules by metric name, each with the labels to aggregate away and the operation combining the series (sum, avg, min, max, count or last)").
+		ExistingFileVar(&config.aggregationSpecFile)
+
+	kingpin.Flag("histogram-quantiles", "send estimated quantiles of a histogram instead of its buckets (ex. http_request_duration_seconds=0.5,0.95,0.99)").
+		StringMapVar(&config.histogramQuantileFlags)
+
+	kingpin.Flag("scrape-protocol", "exposition format to negotiate when scraping, in order of preference. Repeat to allow several").
+		Default(collector.ScrapeProtocols()...).
+		EnumsVar(&config.scrapeProtocols, collector.ScrapeProtocols()...)
+
+	kingpin.Flag("scrape-sample-limit", "reject scrapes returning more than this many whitelisted samples, 0 means no limit").
+		Default("0").
+		IntVar(&config.scrapeSampleLimit)
+
+	kingpin.Flag("scrape-body-size-limit", "reject scrapes whose uncompressed response is larger than this (ex. 10MB), 0 means no limit").
+		Default("0").
+		BytesVar(&config.scrapeBodySizeLimit)
+
+	kingpin.Flag("scrape-serve-stale", "report the last successful result of a failed scrape if it is no older than this, 0 disables it").
+		Default("0s").
+		DurationVar(&config.scrapeServeStale)
+
+	kingpin.Flag("scrape-label-conflict", "how labels added to scraped metrics are merged with scraped labels of the same name: honor keeps the scraped label, overwrite replaces it, rename moves it to exported_<name>").
+		Default(string(decorate.RenameLabels)).
+		EnumVar(&config.scrapeLabelPolicy, decorate.LabelConflictPolicies()...)
+
+	kingpin.Flag("metrics-path.tls.ca-file", "CA bundle used to verify the --metrics-path endpoint").
+		ExistingFileVar(&config.scrapeTLS.CAFile)
+
+	kingpin.Flag("metrics-path.tls.cert-file", "client certificate presented to the --metrics-path endpoint").
+		ExistingFileVar(&config.scrapeTLS.CertFile)
+
+	kingpin.Flag("metrics-path.tls.key-file", "key of the client certificate presented to the --metrics-path endpoint").
+		ExistingFileVar(&config.scrapeTLS.KeyFile)
+
+	kingpin.Flag("metrics-path.tls.server-name", "server name used to verify the --metrics-path endpoint certificate").
+		StringVar(&config.scrapeTLS.ServerName)
+
+	kingpin.Flag("metrics-path.tls.insecure-skip-verify", "do not verify the --metrics-path endpoint certificate").
+		BoolVar(&config.scrapeTLS.InsecureSkipVerify)
+
+	kingpin.Flag("metrics-path.basic-auth.username", "basic auth username used when scraping --metrics-path").
+		StringVar(&config.scrapeBasicAuthUser)
+
+	kingpin.Flag("metrics-path.basic-auth.password-file", "file containing the basic auth password used when scraping --metrics-path").
+		ExistingFileVar(&config.scrapeBasicAuthFile)
+
+	kingpin.Flag("metrics-path.header", "additional header sent when scraping --metrics-path (ex. --metrics-path.header=X-Tenant=droplet). Repeat for multiple headers").
+		StringMapVar(&config.scrapeHeaders)
+
+	kingpin.Flag("metrics-path.proxy-url", "proxy used when scraping --metrics-path").
+		URLVar(&config.scrapeProxyURL)
+
+	kingpin.Flag("discovery.file", "scrape the targets listed in files matching this glob, in the Prometheus file_sd JSON or YAML format. Each target is gathered as a collector named file/<address>, which the .per-collector flags take. Repeat for multiple patterns").
+		StringsVar(&config.fileSDPatterns)
+
+	kingpin.Flag("discovery.file.refresh-interval", "how often to re-read --discovery.file for target changes").
+		Default("30s").
+		DurationVar(&config.fileSDInterval)
+
+	kingpin.Flag("kubelet-address", "enable container resource metrics collection from the local kubelet at this address (ex. https://127.0.0.1:10250)").
+		StringVar(&config.kubeletAddress)
+
+	kingpin.Flag("kubelet.cadvisor", "additionally collect container network, filesystem and throttling metrics from the kubelet's cAdvisor endpoint").
+		BoolVar(&config.kubeletCadvisor)
+
+	kingpin.Flag("kubelet.bearer-token-file", "file containing the token used to authenticate with the kubelet").
+		Default(serviceAccountDir + "/token").
+		StringVar(&config.kubeletTokenFile)
+
+	kingpin.Flag("kubelet.tls.ca-file", "CA bundle used to verify the kubelet").
+		StringVar(&config.kubeletTLS.CAFile)
+
+	kingpin.Flag("kubelet.tls.insecure-skip-verify", "do not verify the kubelet certificate, which is often self-signed").
+		BoolVar(&config.kubeletTLS.InsecureSkipVerify)
+
+	kingpin.Flag("discovery.kubernetes", "scrape pods on this node annotated with prometheus.io/scrape=true. Each pod port is gathered as a collector named kubernetes/<ip>:<port>").
+		BoolVar(&config.k8sSD)
+
+	kingpin.Flag("discovery.kubernetes.api-server", "Kubernetes API server URL used for pod discovery").
+		Default(defaultKubernetesAPIServer()).
+		StringVar(&config.k8sSDAPIServer)
+
+	kingpin.Flag("discovery.kubernetes.node-name", "name of the node to discover pods on").
+		Envar("NODE_NAME").
+		StringVar(&config.k8sSDNodeName)
+
+	kingpin.Flag("discovery.kubernetes.ca-file", "CA bundle used to verify the Kubernetes API server").
+		Default(serviceAccountDir + "/ca.crt").
+		StringVar(&config.k8sSDCAFile)
+
+	kingpin.Flag("discovery.kubernetes.bearer-token-file", "file containing the token used to authenticate with the Kubernetes API server").
+		Default(serviceAccountDir + "/token").
+		StringVar(&config.k8sSDTokenFile)
+
+	kingpin.Flag("discovery.kubernetes.refresh-interval", "how often to list pods for target changes").
+		Default("30s").
+		DurationVar(&config.k8sSDInterval)
+
 }
 
-func initConfig() {
+// initConfig parses the command line and returns the selected command
+func initConfig() string {
 	os.Args = append(os.Args, additionalParams...)
 
 	// read flags from cli directly first so we have access to them
@@ -162,8 +446,7 @@ func initConfig() {
 
 	// parse all command line flags which are defined across the app
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
-
+	return kingpin.Parse()
 }
 
 func checkConfig() error {
@@ -178,9 +461,121 @@ func checkConfig() error {
 		return errors.New("both mutually exclusive flags --bearer-token and --bearer-token-file set")
 	}
 
+	if len(config.fileSDPatterns) > 0 && config.fileSDInterval <= 0 {
+		return errors.New("--discovery.file.refresh-interval must be positive")
+	}
+
+	if config.k8sSD && config.k8sSDInterval <= 0 {
+		return errors.New("--discovery.kubernetes.refresh-interval must be positive")
+	}
+
+	if config.collectorTimeouts, err = parseDurations("collector-timeout.per-collector", config.collectorTimeoutFlags); err != nil {
+		return err
+	}
+
+	if config.collectorIntervals, err = parseDurations("collector-interval.per-collector", config.collectorIntervalFlags); err != nil {
+		return err
+	}
+
+	if config.seriesLimit < 0 {
+		return errors.New("--series-limit must not be negative")
+	}
+	if config.familySeriesLimits, err = parseLimits("series-limit.per-family", config.familySeriesLimitFlags); err != nil {
+		return err
+	}
+	if config.collectorSeriesLimits, err = parseLimits("series-limit.per-collector", config.collectorLimitFlags); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(config.graphiteReplacement, ". \t\n\r") {
+		return fmt.Errorf("--writer.graphite.replacement %q must not contain dots or whitespace", config.graphiteReplacement)
+	}
+
+	if config.historyRetention > 0 && (config.historyMaxSeries < 1 || config.historyMaxSamples < 1) {
+		return errors.New("--history.max-series and --history.max-samples must be at least 1")
+	}
+
+	if len(config.rollupFlags) > 0 && config.sampleInterval <= 0 {
+		return errors.New("--rollup requires a positive --sample-interval")
+	}
+	if config.relabelConfigFile != "" {
+		f, err := relabel.ReadFile(config.relabelConfigFile)
+		if err != nil {
+			return err
+		}
+		config.relabel = *f
+	}
+	if config.aggregationSpecFile != "" {
+		if config.aggregationRules, err = aggregate.ReadSpecFile(config.aggregationSpecFile); err != nil {
+			return err
+		}
+	}
+
+	if config.staleMarkerSonarFlag != "" {
+		if !config.staleMarkers {
+			return errors.New("--stale-markers.sonar-value requires --stale-markers")
+		}
+		v, err := strconv.ParseFloat(config.staleMarkerSonarFlag, 64)
+		if err != nil {
+			return fmt.Errorf("invalid --stale-markers.sonar-value %q: %w", config.staleMarkerSonarFlag, err)
+		}
+		config.staleMarkerSonar = &v
+	}
+
+	config.histogramQuantiles = make(map[string][]float64, len(config.histogramQuantileFlags))
+	for name, v := range config.histogramQuantileFlags {
+		for _, q := range strings.Split(v, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+			if err != nil || f < 0 || f > 1 {
+				return fmt.Errorf("invalid --histogram-quantiles for %q: %q is not a quantile between 0 and 1", name, q)
+			}
+			config.histogramQuantiles[name] = append(config.histogramQuantiles[name], f)
+		}
+	}
+
+	config.rollups = make(map[string][]aggregate.RollupOp, len(config.rollupFlags))
+	for name, v := range config.rollupFlags {
+		if config.rollups[name], err = aggregate.ParseRollupOps(v); err != nil {
+			return fmt.Errorf("invalid --rollup for %q: %w", name, err)
+		}
+	}
+
+	config.counterRates = make(map[string]aggregate.RateOp, len(config.counterRateFlags))
+	for name, v := range config.counterRateFlags {
+		if config.counterRates[name], err = aggregate.ParseRateOp(v); err != nil {
+			return fmt.Errorf("invalid --counter-rate for %q: %w", name, err)
+		}
+	}
+
 	return nil
 }
 
+// parseDurations parses the values of a map flag as non-negative durations
+func parseDurations(flag string, vals map[string]string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(vals))
+	for name, v := range vals {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid --%s for %q: %q", flag, name, v)
+		}
+		durations[name] = d
+	}
+	return durations, nil
+}
+
+// parseLimits parses the values of a map flag as non-negative integers
+func parseLimits(flag string, vals map[string]string) (map[string]int, error) {
+	limits := make(map[string]int, len(vals))
+	for name, v := range vals {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid --%s for %q: %q", flag, name, v)
+		}
+		limits[name] = n
+	}
+	return limits, nil
+}
+
 func toggleGradualRollouts() {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -201,14 +596,86 @@ func toggleGradualRollouts() {
 
 func initWriter(wc *prometheus.CounterVec) (metricWriter, limiter) {
 	if config.stdoutOnly {
-		return writer.NewFile(os.Stdout, wc), &constThrottler{wait: 10 * time.Second}
+		return newFileWriter(os.Stdout, wc), &constThrottler{wait: 10 * time.Second}
 	}
 
 	tsc := newTimeseriesClient()
-	return writer.NewSonar(tsc, wc), tsc
+	var sonarOpts []writer.SonarOption
+	if config.staleMarkerSonar != nil {
+		sonarOpts = append(sonarOpts, writer.WithStaleMarker(*config.staleMarkerSonar))
+	}
+	primary := writer.NewSonar(tsc, wc, sonarOpts...)
+
+	secondaries := initSecondaryWriters(wc)
+	if len(secondaries) == 0 {
+		return primary, tsc
+	}
+	return newMultiWriter(primary, secondaries...), tsc
+}
+
+// initSecondaryWriters initializes the additional writers which receive a copy
+// of every batch sent to sonar. Each one writes in the background with its own
+// limiter so failures never delay delivery to sonar
+func initSecondaryWriters(wc *prometheus.CounterVec) []*asyncWriter {
+	var ws []*asyncWriter
+
+	if config.fileWriter {
+		var out io.Writer = os.Stdout
+		if config.fileWriterPath != "" {
+			f, err := writer.NewRotatingFile(config.fileWriterPath,
+				writer.WithMaxSize(int64(config.fileWriterMaxSize)),
+				writer.WithRotateInterval(config.fileWriterRotate),
+				writer.WithMaxBackups(config.fileWriterMaxBackups),
+				writer.WithRetention(config.fileWriterRetention),
+			)
+			if err != nil {
+				log.Fatal("failed to initialize file writer: %+v", err)
+			}
+			out = f
+		}
+		ws = append(ws, newAsyncWriter(newFileWriter(out, wc), newSecondaryThrottler(), config.writerMaxBackoff, wc))
+	}
+
+	if config.graphiteAddress != "" {
+		g, err := writer.NewGraphite(config.graphiteNetwork, config.graphiteAddress, wc,
+			writer.WithProtocol(writer.GraphiteProtocol(config.graphiteProtocol)),
+			writer.WithPrefix(config.graphitePrefix),
+			writer.WithLabelOrder(config.graphiteLabelOrder...),
+			writer.WithReplacement(config.graphiteReplacement),
+		)
+		if err != nil {
+			log.Fatal("failed to initialize graphite writer: %+v", err)
+		}
+		ws = append(ws, newAsyncWriter(g, newSecondaryThrottler(), config.writerMaxBackoff, wc))
+	}
+
+	return ws
+}
+
+func newFileWriter(w io.Writer, wc *prometheus.CounterVec) *writer.File {
+	f, err := writer.NewFile(w, wc, writer.WithFormat(writer.Format(config.fileWriterFormat)))
+	if err != nil {
+		log.Fatal("failed to initialize file writer: %+v", err)
+	}
+	return f
+}
+
+// fileFormats returns the names of all supported file writer formats
+func fileFormats() []string {
+	names := make([]string, len(writer.Formats))
+	for i, f := range writer.Formats {
+		names[i] = string(f)
+	}
+	return names
+}
+
+func newSecondaryThrottler() limiter {
+	return &constThrottler{wait: config.writerMinInterval}
 }
 
-func initDecorator() decorate.Chain {
+// initDecorator creates the decorators of gathered metrics. processes adds
+// the decorator keeping the top processes
+func initDecorator(processes bool) decorate.Chain {
 	chain := decorate.Chain{
 		compat.Names{},
 		compat.Disk{},
@@ -216,13 +683,14 @@ func initDecorator() decorate.Chain {
 		decorate.LowercaseNames{},
 	}
 
-	if !config.noProcesses {
+	if processes {
 		chain = append(chain, decorate.TopK{K: uint(config.topK), N: "sonar_process_"}) // TopK sonar processes
 	}
 
 	// If additionalLabels provided convert into decorator
 	if len(config.additionalLabels) != 0 {
-		chain = append(chain, decorate.LabelAppender(convertToLabelPairs(config.additionalLabels)))
+		chain = append(chain, decorate.LabelAppender(convertToLabelPairs(config.additionalLabels)).
+			WithConflictPolicy(decorate.LabelConflictPolicy(config.additionalLabelPolicy)))
 	}
 
 	return chain
@@ -257,6 +725,12 @@ func initAggregatorSpecs() map[string][]string {
 		}
 	}
 
+	if config.kubeletAddress != "" {
+		for k, v := range kubeletAggregationSpec {
+			aggregateSpecs[k] = append(aggregateSpecs[k], v...)
+		}
+	}
+
 	if config.gpuMetricsPath != "" {
 		for k, v := range gpuAggregationSpec {
 			aggregateSpecs[k] = append(aggregateSpecs[k], v...)
@@ -267,9 +741,35 @@ func initAggregatorSpecs() map[string][]string {
 			aggregateSpecs[k] = append(aggregateSpecs[k], v...)
 		}
 	}
+	for k, rule := range config.aggregationRules {
+		aggregateSpecs[k] = append(aggregateSpecs[k], rule.Labels...)
+	}
 	return aggregateSpecs
 }
 
+// initAggregatorOps initializes the operations combining aggregated series by
+// prometheus metric name. Metrics without an operation are summed
+func initAggregatorOps() map[string]aggregate.Op {
+	ops := make(map[string]aggregate.Op)
+
+	if config.gpuMetricsPath != "" {
+		for k, v := range gpuAggregationOps {
+			ops[k] = v
+		}
+	}
+	if config.diMetricsPath != "" {
+		for k, v := range diAggregationOps {
+			ops[k] = v
+		}
+	}
+	for k, rule := range config.aggregationRules {
+		if rule.Op != "" {
+			ops[k] = rule.Op
+		}
+	}
+	return ops
+}
+
 // WrappedTSClient wraps the tsClient and adds a Name method to it
 type WrappedTSClient struct {
 	tsclient.Client
@@ -309,13 +809,17 @@ func initCollectors() []prometheus.Collector {
 		cols = appendKubernetesCollectors(cols)
 	}
 
+	if config.kubeletAddress != "" {
+		cols = appendKubeletCollectors(cols)
+	}
+
 	// Top process collection
 	if !config.noProcesses {
 		cols = append(cols, process.NewProcessCollector())
 	}
 
 	if config.dbaas != "" {
-		k, err := collector.NewScraper("dodbaas", config.dbaas, nil, dbaasWhitelist, collector.WithTimeout(config.scrapeTimeout))
+		k, err := collector.NewScraper("dodbaas", config.dbaas, nil, dbaasWhitelist, scraperOptions()...)
 		if err != nil {
 			log.Error("Failed to initialize DO DBaaS metrics collector: %+v", err)
 		} else {
@@ -324,7 +828,7 @@ func initCollectors() []prometheus.Collector {
 	}
 
 	if config.mongodb != "" {
-		k, err := collector.NewScraper("mongodb", config.mongodb, nil, dbaasWhitelist, collector.WithTimeout(config.scrapeTimeout))
+		k, err := collector.NewScraper("mongodb", config.mongodb, nil, dbaasWhitelist, scraperOptions()...)
 		if err != nil {
 			log.Error("Failed to initialize DO DBaaS MongoDB metrics collector: %+v", err)
 		} else {
@@ -333,7 +837,7 @@ func initCollectors() []prometheus.Collector {
 	}
 
 	if config.promAddr != "" {
-		k, err := collector.NewScraper("prometheus", config.promAddr, nil, nil, collector.WithTimeout(config.scrapeTimeout))
+		k, err := collector.NewScraper("prometheus", config.promAddr, nil, nil, scraperOptions(metricsPathOptions()...)...)
 		if err != nil {
 			log.Error("Failed to initialize generic metrics collector: %+v", err)
 		} else {
@@ -342,7 +846,7 @@ func initCollectors() []prometheus.Collector {
 	}
 
 	if config.diMetricsPath != "" {
-		di, err := collector.NewScraper("di", config.diMetricsPath, nil, diWhitelist, collector.WithTimeout(config.scrapeTimeout))
+		di, err := collector.NewScraper("di", config.diMetricsPath, nil, diWhitelist, scraperOptions()...)
 		if err != nil {
 			log.Error("Failed to initialize DI metrics collector: %+v", err)
 		} else {
@@ -351,7 +855,7 @@ func initCollectors() []prometheus.Collector {
 	}
 
 	if config.gpuMetricsPath != "" {
-		gpu, err := collector.NewScraper("gpu", config.gpuMetricsPath, nil, gpuWhitelist, collector.WithTimeout(config.scrapeTimeout))
+		gpu, err := collector.NewScraper("gpu", config.gpuMetricsPath, nil, gpuWhitelist, scraperOptions()...)
 		if err != nil {
 			log.Error("Failed to initialize GPU metrics collector: %+v", err)
 		} else {
@@ -377,12 +881,135 @@ func initCollectors() []prometheus.Collector {
 	return cols
 }
 
-// appendKubernetesCollectors appends a kubernetes metrics collector if it can be initialized successfully
-func appendKubernetesCollectors(cols []prometheus.Collector) []prometheus.Collector {
-	opts := []collector.Option{
+// initGatherer registers every collector with a gatherer which isolates their
+// failures from each other
+func initGatherer(cols []prometheus.Collector) *gather.Gatherer {
+	g := gather.NewGatherer(gather.WithTimeout(config.collectorTimeout))
+	for _, c := range cols {
+		name := "agent"
+		if n, ok := c.(interface{ Name() string }); ok {
+			name = n.Name()
+		}
+		if err := g.Register(name, c, collectorOptions(name)...); err != nil {
+			log.Error("skipping collector: %v", err)
+		}
+	}
+	return g
+}
+
+// collectorOptions returns the options configured for a collector by name
+func collectorOptions(name string) []gather.Option {
+	var opts []gather.Option
+	if d, ok := config.collectorTimeouts[name]; ok {
+		opts = append(opts, gather.WithTimeout(d))
+	}
+	if d, ok := config.collectorIntervals[name]; ok {
+		opts = append(opts, gather.WithInterval(d))
+	}
+	if n, ok := config.collectorSeriesLimits[name]; ok {
+		opts = append(opts, gather.WithSeriesLimit(n))
+	}
+	return opts
+}
+
+// initLimiter creates the limiter capping the series of metric families
+func initLimiter() *cardinality.Limiter {
+	return cardinality.NewLimiter(
+		cardinality.WithFamilyLimit(config.seriesLimit),
+		cardinality.WithFamilyLimits(config.familySeriesLimits),
+	)
+}
+
+// initStaleTracker creates the tracker marking disappeared series stale, or
+// returns nil if staleness markers are disabled
+func initStaleTracker() *aggregate.StaleTracker {
+	if !config.staleMarkers {
+		return nil
+	}
+	return aggregate.NewStaleTracker()
+}
+
+// initPipeline creates the pipeline of stages between gathering and writing
+func initPipeline(dec decorate.Decorator, s *sampler, lim *cardinality.Limiter, stats *scrapeStats, aggregateSpecs map[string][]string, aggregateOps map[string]aggregate.Op) *pipeline {
+	return &pipeline{
+		stages: []stage{
+			decorateStage(dec),
+			relabelStage(config.relabel.Global),
+			// the rolled up families are limited like all others
+			s.rollup,
+			lim.Limit,
+		},
+		specs: aggregateSpecs,
+		aggOpts: []aggregate.Option{
+			aggregate.WithOps(aggregateOps),
+			aggregate.WithHistogramQuantiles(config.histogramQuantiles),
+		},
+		stale: initStaleTracker(),
+		stats: stats,
+		rates: aggregate.NewRates(config.counterRates),
+	}
+}
+
+// initSampler creates the sampler computing the configured rollups, if any
+func initSampler(g *gather.Gatherer, dec decorate.Decorator, aggregateSpecs map[string][]string, aggregateOps map[string]aggregate.Op) *sampler {
+	if len(config.rollups) == 0 {
+		return nil
+	}
+	// only the collectors of families with a rollup are gathered for samples
+	rolledUp := func(name string) bool {
+		_, ok := config.rollups[name]
+		return ok
+	}
+	return &sampler{
+		g: prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return g.GatherFamilies(rolledUp)
+		}),
+		dec:      dec,
+		relabel:  config.relabel.Global,
+		r:        aggregate.NewRollup(config.rollups, aggregateSpecs, aggregate.WithOps(aggregateOps)),
+		interval: config.sampleInterval,
+	}
+}
+
+// scraperOptions returns the options shared by all scrapers followed by opts
+func scraperOptions(opts ...collector.Option) []collector.Option {
+	protos := make([]collector.ScrapeProtocol, len(config.scrapeProtocols))
+	for i, p := range config.scrapeProtocols {
+		protos[i] = collector.ScrapeProtocol(p)
+	}
+
+	return append([]collector.Option{
 		collector.WithTimeout(config.scrapeTimeout),
-		collector.WithLogLevel(log.LevelDebug),
+		collector.WithScrapeProtocols(protos...),
+		collector.WithSampleLimit(config.scrapeSampleLimit),
+		collector.WithBodySizeLimit(int64(config.scrapeBodySizeLimit)),
+		collector.WithServeStale(config.scrapeServeStale),
+		collector.WithLabelConflictPolicy(decorate.LabelConflictPolicy(config.scrapeLabelPolicy)),
+		collector.WithRelabelConfigs(config.relabel.Scrapers),
+	}, opts...)
+}
+
+// metricsPathOptions returns the security options configured for --metrics-path
+func metricsPathOptions() []collector.Option {
+	var opts []collector.Option
+	if config.scrapeTLS != (clients.TLSConfig{}) {
+		opts = append(opts, collector.WithTLSConfig(config.scrapeTLS))
+	}
+	if config.scrapeBasicAuthUser != "" {
+		opts = append(opts, collector.WithBasicAuthPasswordFile(config.scrapeBasicAuthUser, config.scrapeBasicAuthFile))
+	}
+	if len(config.scrapeHeaders) > 0 {
+		opts = append(opts, collector.WithHeaders(config.scrapeHeaders))
 	}
+	if config.scrapeProxyURL != nil {
+		opts = append(opts, collector.WithProxyURL(config.scrapeProxyURL))
+	}
+	return opts
+}
+
+// appendKubernetesCollectors appends a kubernetes metrics collector if it can be initialized successfully
+func appendKubernetesCollectors(cols []prometheus.Collector) []prometheus.Collector {
+	opts := scraperOptions(collector.WithLogLevel(log.LevelDebug))
 
 	if config.bearerToken != "" {
 		opts = append(opts, collector.WithBearerToken(config.bearerToken))
@@ -401,6 +1028,42 @@ func appendKubernetesCollectors(cols []prometheus.Collector) []prometheus.Collec
 	return cols
 }
 
+// appendKubeletCollectors appends collectors for the local kubelet's resource
+// and optionally cAdvisor metrics
+func appendKubeletCollectors(cols []prometheus.Collector) []prometheus.Collector {
+	opts := scraperOptions(
+		collector.WithBearerTokenFile(config.kubeletTokenFile),
+		collector.WithTLSConfig(config.kubeletTLS),
+	)
+	address := strings.TrimRight(config.kubeletAddress, "/")
+
+	k, err := collector.NewScraper("kubelet", address+"/metrics/resource", nil, kubeletResourceWhitelist, opts...)
+	if err != nil {
+		log.Error("Failed to initialize kubelet resource metrics: %+v", err)
+		return cols
+	}
+	cols = append(cols, k)
+
+	if !config.kubeletCadvisor {
+		return cols
+	}
+
+	// containers are kept before any configured relabeling
+	byScraper := make(map[string][]*relabel.Config, len(config.relabel.Scrapers)+1)
+	for name, cfgs := range config.relabel.Scrapers {
+		byScraper[name] = cfgs
+	}
+	byScraper["cadvisor"] = append(cadvisorRelabelConfigs[:len(cadvisorRelabelConfigs):len(cadvisorRelabelConfigs)], config.relabel.Scrapers["cadvisor"]...)
+	opts = append(opts, collector.WithRelabelConfigs(byScraper))
+
+	c, err := collector.NewScraper("cadvisor", address+"/metrics/cadvisor", nil, kubeletCadvisorWhitelist, opts...)
+	if err != nil {
+		log.Error("Failed to initialize kubelet cAdvisor metrics: %+v", err)
+		return cols
+	}
+	return append(cols, c)
+}
+
 // disableCollectors disables collectors by names by adding a list of
 // --no-collector.<name> flags to additionalParams
 func disableCollectors(names ...string) {
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
 )
 
 func TestDisableCollectorsAddsCorrectFlags(t *testing.T) {
@@ -62,3 +71,244 @@ func TestInitAggregatorSpecs(t *testing.T) {
 	require.Contains(t, aggregateSpecs, "sonar_cpu")
 	require.Equal(t, []string{"cpu"}, aggregateSpecs["sonar_cpu"])
 }
+
+func TestKubeletCollectors(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer kubelet-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/metrics/resource":
+			fmt.Fprint(w, `# TYPE container_memory_working_set_bytes gauge
+container_memory_working_set_bytes{container="app",namespace="shop",pod="web-1"} 1024
+# TYPE resource_scrape_error gauge
+resource_scrape_error 0
+`)
+		case "/metrics/cadvisor":
+			fmt.Fprint(w, `# TYPE container_network_receive_bytes_total counter
+container_network_receive_bytes_total{id="/kubepods/pod1/abc",image="pause:3.9",interface="eth0",name="abc",namespace="shop",pod="web-1"} 100
+container_network_receive_bytes_total{id="/kubepods/pod1/abc",image="pause:3.9",interface="eth1",name="abc",namespace="shop",pod="web-1"} 50
+container_network_receive_bytes_total{id="/kubepods/pod1",image="",interface="eth0",namespace="shop",pod="web-1"} 100
+container_network_receive_bytes_total{id="/",image="",interface="eth0"} 1000
+`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("kubelet-token"), 0600))
+
+	saved := config
+	defer func() { config = saved }()
+	config.scrapeTimeout = 5 * time.Second
+	config.kubeletAddress = ts.URL
+	config.kubeletCadvisor = true
+	config.kubeletTokenFile = tokenFile
+	config.kubeletTLS.InsecureSkipVerify = true
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(appendKubeletCollectors(nil)...)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	mets, err := aggregate.Aggregate(mfs, initAggregatorSpecs())
+	require.NoError(t, err)
+
+	// the root and pod cgroups are dropped rather than summed with containers
+	values := map[string]float64{}
+	for _, m := range mets {
+		if m.Labels.Get("__name__") == "container_network_receive_bytes_total" {
+			require.Equal(t, "web-1", m.Labels.Get("pod"))
+		}
+		if m.Labels.Get("__name__") == "kubelet_scrape_collector_success" || m.Labels.Get("__name__") == "cadvisor_scrape_collector_success" {
+			require.Equal(t, float64(1), m.Value, m.Labels.Get("__name__"))
+		}
+		if m.Labels.Get("namespace") == "shop" {
+			values[m.Labels.Get("__name__")] = m.Value
+			require.NotContains(t, m.Labels.Map(), "interface")
+		}
+	}
+	require.Equal(t, map[string]float64{
+		"container_memory_working_set_bytes":    1024,
+		"container_network_receive_bytes_total": 150,
+	}, values)
+}
+
+func TestCheckConfigCollectorTimeouts(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.collectorTimeoutFlags = map[string]string{"node": "10s", "prometheus": "0s"}
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string]time.Duration{"node": 10 * time.Second, "prometheus": 0}, config.collectorTimeouts)
+
+	config.collectorTimeoutFlags = map[string]string{"node": "soon"}
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigCollectorIntervals(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.collectorIntervalFlags = map[string]string{"process": "5m"}
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string]time.Duration{"process": 5 * time.Minute}, config.collectorIntervals)
+
+	config.collectorIntervalFlags = map[string]string{"process": "-5m"}
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigRollups(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.rollupFlags = map[string]string{"sonar_memory_available": "min,max"}
+	require.Error(t, checkConfig())
+
+	config.sampleInterval = 10 * time.Second
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string][]aggregate.RollupOp{
+		"sonar_memory_available": {aggregate.RollupMin, aggregate.RollupMax},
+	}, config.rollups)
+
+	config.rollupFlags = map[string]string{"sonar_memory_available": "median"}
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigHistogramQuantiles(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.histogramQuantileFlags = map[string]string{"request_seconds": "0.5, 0.99"}
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string][]float64{"request_seconds": {0.5, 0.99}}, config.histogramQuantiles)
+
+	config.histogramQuantileFlags = map[string]string{"request_seconds": "95"}
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigAggregationSpecFile(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	path := filepath.Join(t.TempDir(), "spec.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("dcgm_fi_dev_gpu_util:\n  labels: [pod]\n  op: max\nrequests:\n  labels: [instance]\n"), 0o600))
+
+	config.aggregationSpecFile = path
+	config.gpuMetricsPath = "/metrics"
+	config.diMetricsPath = ""
+	require.NoError(t, checkConfig())
+
+	specs := initAggregatorSpecs()
+	require.Contains(t, specs["dcgm_fi_dev_gpu_util"], "pod")
+	require.Equal(t, []string{"instance"}, specs["requests"])
+
+	ops := initAggregatorOps()
+	require.Equal(t, aggregate.Max, ops["dcgm_fi_dev_gpu_util"])
+	require.Equal(t, aggregate.Avg, ops["dcgm_fi_prof_sm_occupancy"])
+	require.NotContains(t, ops, "requests")
+
+	require.NoError(t, os.WriteFile(path, []byte("requests:\n  op: median\n"), 0o600))
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigCounterRates(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.counterRateFlags = map[string]string{"sonar_network_receive_bytes": "rate", "sonar_network_transmit_bytes": "delta"}
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string]aggregate.RateOp{
+		"sonar_network_receive_bytes":  aggregate.RateOpRate,
+		"sonar_network_transmit_bytes": aggregate.RateOpDelta,
+	}, config.counterRates)
+
+	config.counterRateFlags = map[string]string{"sonar_network_receive_bytes": "irate"}
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigStaleMarkers(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.staleMarkerSonarFlag = "-1"
+	require.Error(t, checkConfig())
+
+	config.staleMarkers = true
+	require.NoError(t, checkConfig())
+	require.Equal(t, -1.0, *config.staleMarkerSonar)
+
+	config.staleMarkerSonarFlag = "stale"
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigRelabelConfigFile(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	path := filepath.Join(t.TempDir(), "relabel.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("global:\n  - {regex: uuid, action: labeldrop}\nscrapers:\n  gpu:\n    - {source_labels: [__name__], regex: dcgm_.*, action: keep}\n"), 0o600))
+
+	config.relabelConfigFile = path
+	require.NoError(t, checkConfig())
+	require.Len(t, config.relabel.Global, 1)
+	require.Len(t, config.relabel.Scrapers["gpu"], 1)
+
+	require.NoError(t, os.WriteFile(path, []byte("global:\n  - {action: keepequal}\n"), 0o600))
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigSeriesLimits(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.familySeriesLimitFlags = map[string]string{"kafka_consumergroup_lag": "500"}
+	config.collectorLimitFlags = map[string]string{"prometheus": "5000"}
+	require.NoError(t, checkConfig())
+	require.Equal(t, map[string]int{"kafka_consumergroup_lag": 500}, config.familySeriesLimits)
+	require.Equal(t, map[string]int{"prometheus": 5000}, config.collectorSeriesLimits)
+
+	config.collectorLimitFlags = map[string]string{"prometheus": "-1"}
+	require.Error(t, checkConfig())
+
+	config.collectorLimitFlags = nil
+	config.seriesLimit = -1
+	require.Error(t, checkConfig())
+}
+
+func TestCheckConfigHistoryLimits(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.historyRetention = time.Hour
+	config.historyMaxSeries = 100
+	config.historyMaxSamples = 10
+	require.NoError(t, checkConfig())
+
+	config.historyMaxSamples = 0
+	require.Error(t, checkConfig())
+
+	config.historyMaxSamples = 10
+	config.historyMaxSeries = -1
+	require.Error(t, checkConfig())
+
+	// the limits do not matter without a history
+	config.historyRetention = 0
+	require.NoError(t, checkConfig())
+}
+
+func TestCheckConfigGraphiteReplacement(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	config.graphiteReplacement = "-"
+	require.NoError(t, checkConfig())
+
+	for _, r := range []string{".", " ", "_\t"} {
+		config.graphiteReplacement = r
+		require.Error(t, checkConfig())
+	}
+}
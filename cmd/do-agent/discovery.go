@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/clients"
+	"github.com/digitalocean/do-agent/pkg/clients/roundtrippers"
+	"github.com/digitalocean/do-agent/pkg/collector"
+	"github.com/digitalocean/do-agent/pkg/discovery"
+	"github.com/digitalocean/do-agent/pkg/gather"
+)
+
+// discoveredScraperName is the name of scrapers created for discovered targets
+const discoveredScraperName = "discovered"
+
+// serviceAccountDir is where Kubernetes mounts the credentials of a pod's
+// service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// initDiscovery starts discovering scrape targets and registers the scraper
+// of every target with g, adding its stat names to stats. It returns a collector of all targets for the local
+// endpoint, or nil if discovery is disabled
+func initDiscovery(g *gather.Gatherer, stats *scrapeStats) prometheus.Collector {
+	if len(config.fileSDPatterns) == 0 && !config.k8sSD {
+		return nil
+	}
+
+	r := &discoveryRegistry{g: g, stats: stats}
+	m := discovery.NewManager(newDiscoveredScraper, r)
+
+	if len(config.fileSDPatterns) > 0 {
+		d, err := discovery.NewFileDiscoverer(config.fileSDPatterns, config.fileSDInterval)
+		if err != nil {
+			log.Fatal("failed to initialize file discovery: %+v", err)
+		}
+		go d.Run(context.Background(), m)
+	}
+
+	if config.k8sSD {
+		d, err := newKubernetesDiscoverer()
+		if err != nil {
+			log.Fatal("failed to initialize kubernetes discovery: %+v", err)
+		}
+		go d.Run(context.Background(), m)
+	}
+
+	return r
+}
+
+// discoveryRegistry registers the scrapers of discovered targets with the
+// gatherer, with the options configured for their name. It also collects
+// all current targets for the local endpoint, where they are registered as a
+// single unchecked collector since a registry can not unregister those
+type discoveryRegistry struct {
+	g     *gather.Gatherer
+	stats *scrapeStats
+
+	m    sync.Mutex
+	cols []prometheus.Collector
+}
+
+// Register registers c with the gatherer under name
+func (r *discoveryRegistry) Register(name string, c prometheus.Collector) error {
+	if err := r.g.Register(name, c, collectorOptions(name)...); err != nil {
+		return err
+	}
+	r.stats.add(c)
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.cols = append(r.cols, c)
+	return nil
+}
+
+// Unregister unregisters c from the gatherer
+func (r *discoveryRegistry) Unregister(c prometheus.Collector) bool {
+	r.m.Lock()
+	for i, col := range r.cols {
+		if col == c {
+			r.cols = append(r.cols[:i], r.cols[i+1:]...)
+			break
+		}
+	}
+	r.m.Unlock()
+	return r.g.Unregister(c)
+}
+
+// Describe sends nothing so the targets are registered as an unchecked
+// collector. Scrapers of different targets describe the same metrics
+func (r *discoveryRegistry) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect collects all current targets concurrently
+func (r *discoveryRegistry) Collect(ch chan<- prometheus.Metric) {
+	r.m.Lock()
+	cols := append([]prometheus.Collector(nil), r.cols...)
+	r.m.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range cols {
+		wg.Add(1)
+		go func(c prometheus.Collector) {
+			defer wg.Done()
+			// a panicking target must not take the other targets down with it
+			defer func() {
+				if p := recover(); p != nil {
+					log.Error("collecting discovered target panicked: %v", p)
+				}
+			}()
+			c.Collect(ch)
+		}(c)
+	}
+	wg.Wait()
+}
+
+// newKubernetesDiscoverer creates a discoverer authenticating with the API
+// server using the pod's service account
+func newKubernetesDiscoverer() (*discovery.KubernetesDiscoverer, error) {
+	tlsConfig, err := clients.NewTLSConfig(clients.TLSConfig{CAFile: config.k8sSDCAFile})
+	if err != nil {
+		return nil, err
+	}
+	client := clients.NewHTTP(config.scrapeTimeout, clients.WithTLSConfig(tlsConfig))
+	client.Transport = roundtrippers.NewBearerTokenFile(config.k8sSDTokenFile, client.Transport)
+
+	return discovery.NewKubernetesDiscoverer(config.k8sSDAPIServer, config.k8sSDNodeName, client, config.k8sSDInterval)
+}
+
+// defaultKubernetesAPIServer returns the in-cluster API server address when
+// running in a pod
+func defaultKubernetesAPIServer() string {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return ""
+	}
+	return "https://" + net.JoinHostPort(host, port)
+}
+
+// newDiscoveredScraper creates a scraper for a discovered target
+func newDiscoveredScraper(t discovery.Target) (prometheus.Collector, error) {
+	return collector.NewScraper(discoveredScraperName, t.Endpoint, t.LabelPairs(), nil, scraperOptions()...)
+}
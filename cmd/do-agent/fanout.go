@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+)
+
+// multiWriter writes every batch to a primary writer and hands the same batch
+// off to any number of secondary sinks. Secondary sinks write in the
+// background so a slow or failing sink never delays delivery to the primary.
+type multiWriter struct {
+	primary     metricWriter
+	secondaries []*asyncWriter
+}
+
+// newMultiWriter creates a multiWriter which fans out to the primary and all
+// secondaries
+func newMultiWriter(primary metricWriter, secondaries ...*asyncWriter) *multiWriter {
+	return &multiWriter{
+		primary:     primary,
+		secondaries: secondaries,
+	}
+}
+
+// Write queues the metrics on every secondary sink and then writes them to the
+// primary. Only errors from the primary are returned
+func (m *multiWriter) Write(mets []aggregate.MetricWithValue) error {
+	return m.WriteSplit(mets, mets)
+}
+
+// WriteSplit queues secondary on every secondary sink and then writes primary
+// to the primary. Only errors from the primary are returned
+func (m *multiWriter) WriteSplit(primary, secondary []aggregate.MetricWithValue) error {
+	for _, s := range m.secondaries {
+		s.enqueue(secondary)
+	}
+	return m.primary.Write(primary)
+}
+
+// Name is the name of this writer
+func (m *multiWriter) Name() string {
+	return m.primary.Name()
+}
+
+// asyncWriter writes batches to a metricWriter from its own goroutine. Only the
+// most recent batch is kept while the writer is busy or backing off; older
+// pending batches are dropped and counted.
+type asyncWriter struct {
+	w       metricWriter
+	l       *backoffThrottler
+	c       *prometheus.CounterVec
+	pending chan []aggregate.MetricWithValue
+}
+
+// newAsyncWriter creates an asyncWriter and starts writing in the background.
+// l controls the minimum wait between writes, which is extended exponentially
+// up to maxBackoff while the writer keeps failing
+func newAsyncWriter(w metricWriter, l limiter, maxBackoff time.Duration, wc *prometheus.CounterVec) *asyncWriter {
+	a := &asyncWriter{
+		w:       w,
+		l:       newBackoffThrottler(l, maxBackoff),
+		c:       wc.MustCurryWith(prometheus.Labels{"writer": w.Name()}),
+		pending: make(chan []aggregate.MetricWithValue, 1),
+	}
+	go a.run()
+	return a
+}
+
+// enqueue hands a batch to the writer without blocking. If the previous batch
+// has not been picked up yet it is replaced by this one
+func (a *asyncWriter) enqueue(mets []aggregate.MetricWithValue) {
+	select {
+	case a.pending <- mets:
+		return
+	default:
+	}
+
+	select {
+	case <-a.pending:
+		a.c.WithLabelValues("failure", "dropped batch").Inc()
+	default:
+	}
+
+	select {
+	case a.pending <- mets:
+	default:
+		// the consumer is the only other party on this channel so this
+		// should never happen, but never block the caller
+		a.c.WithLabelValues("failure", "dropped batch").Inc()
+	}
+}
+
+func (a *asyncWriter) run() {
+	for mets := range a.pending {
+		start := time.Now()
+		err := a.w.Write(mets)
+		a.l.record(err)
+		if err != nil {
+			log.Error("failed to send metrics to %s: %v", a.w.Name(), err)
+		} else {
+			log.Debug("stats written to %s in %s", a.w.Name(), time.Since(start))
+		}
+		time.Sleep(a.l.WaitDuration())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+)
+
+type fakeWriter struct {
+	name    string
+	writeFn func(mets []aggregate.MetricWithValue) error
+}
+
+func (f *fakeWriter) Write(mets []aggregate.MetricWithValue) error { return f.writeFn(mets) }
+func (f *fakeWriter) Name() string                                 { return f.name }
+
+func newTestWriterCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_writes"}, []string{"writer", "result", "reason"})
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestMultiWriterDoesNotWaitForBlockedSecondary(t *testing.T) {
+	wc := newTestWriterCounter()
+	unblock := make(chan struct{})
+	defer close(unblock)
+
+	secondaryCalls := make(chan struct{}, 10)
+	secondary := &fakeWriter{name: "secondary", writeFn: func([]aggregate.MetricWithValue) error {
+		secondaryCalls <- struct{}{}
+		<-unblock
+		return nil
+	}}
+	var primaryWrites int
+	primary := &fakeWriter{name: "primary", writeFn: func([]aggregate.MetricWithValue) error {
+		primaryWrites++
+		return nil
+	}}
+
+	w := newMultiWriter(primary, newAsyncWriter(secondary, &constThrottler{}, time.Minute, wc))
+	require.NoError(t, w.Write(nil))
+	// wait until the secondary is stuck in its first write
+	<-secondaryCalls
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Write(nil))
+	}
+	assert.Equal(t, 6, primaryWrites)
+	// one batch stays pending, every older one is replaced
+	assert.Equal(t, 4.0, counterValue(t, wc.WithLabelValues("secondary", "failure", "dropped batch")))
+}
+
+func TestMultiWriterReturnsPrimaryErrorOnly(t *testing.T) {
+	wc := newTestWriterCounter()
+	errPrimary := errors.New("primary failed")
+
+	secondary := &fakeWriter{name: "secondary", writeFn: func([]aggregate.MetricWithValue) error {
+		return errors.New("secondary failed")
+	}}
+	primary := &fakeWriter{name: "primary", writeFn: func([]aggregate.MetricWithValue) error {
+		return errPrimary
+	}}
+
+	w := newMultiWriter(primary, newAsyncWriter(secondary, &constThrottler{}, time.Minute, wc))
+	assert.Equal(t, errPrimary, w.Write(nil))
+	assert.Equal(t, "primary", w.Name())
+}
+
+func TestBackoffThrottlerExtendsWaitOnFailures(t *testing.T) {
+	b := newBackoffThrottler(&constThrottler{wait: time.Second}, 5*time.Second)
+	assert.Equal(t, time.Second, b.WaitDuration())
+
+	fail := errors.New("fail")
+	b.record(fail)
+	assert.Equal(t, 2*time.Second, b.WaitDuration())
+	b.record(fail)
+	assert.Equal(t, 3*time.Second, b.WaitDuration())
+	b.record(fail)
+	assert.Equal(t, 5*time.Second, b.WaitDuration())
+	for i := 0; i < 10; i++ {
+		b.record(fail)
+	}
+	assert.Equal(t, 6*time.Second, b.WaitDuration())
+
+	b.record(nil)
+	assert.Equal(t, time.Second, b.WaitDuration())
+}
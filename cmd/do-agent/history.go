@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/history"
+)
+
+// recordingWriter records every batch in the local history before handing it
+// to the wrapped writer, so the history is kept even when writes fail
+type recordingWriter struct {
+	metricWriter
+	h *history.Store
+}
+
+// Write records the metrics and then writes them with the wrapped writer
+func (r *recordingWriter) Write(mets []aggregate.MetricWithValue) error {
+	r.h.Append(time.Now(), mets)
+	return r.metricWriter.Write(mets)
+}
+
+// WriteSplit records the primary metrics and then writes both batches with the
+// wrapped writer
+func (r *recordingWriter) WriteSplit(primary, secondary []aggregate.MetricWithValue) error {
+	r.h.Append(time.Now(), primary)
+	return writeBatch(r.metricWriter, batch{primary: primary, secondary: secondary})
+}
+
+// initHistory initializes the local history or returns nil if it is disabled
+func initHistory() *history.Store {
+	if config.historyRetention <= 0 {
+		return nil
+	}
+
+	return history.NewStore(config.historyRetention,
+		history.WithMaxSeries(config.historyMaxSeries),
+		history.WithMaxSamples(config.historyMaxSamples),
+	)
+}
@@ -7,10 +7,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/history"
 )
 
 func main() {
-	initConfig()
+	cmd := initConfig()
 
 	if config.debug {
 		log.SetLevel(log.LevelDebug)
@@ -26,15 +27,35 @@ func main() {
 		log.Fatal("configuration failure: %+v", err)
 	}
 
+	if cmd == topCommand.FullCommand() {
+		runTop()
+		return
+	}
+
 	toggleGradualRollouts()
 	cols := initCollectors()
-	reg := prometheus.NewRegistry()
-	reg.MustRegister(cols...)
+	g := initGatherer(cols)
+	stats := &scrapeStats{}
+	for _, c := range cols {
+		stats.add(c)
+	}
+	// discovered targets are registered with the gatherer as they come and go
+	if d := initDiscovery(g, stats); d != nil {
+		cols = append(cols, d)
+	}
+
+	hist := initHistory()
+	lim := initLimiter()
 
 	if config.webListen {
 		//Create a secondary registry for local only metrics
 		localReg := prometheus.NewRegistry()
-		localCols := append(cols, metricWriterDiagnostics)
+		// the cardinality of every family is only reported locally
+		localCols := append(cols, metricWriterDiagnostics, lim, g)
+		if hist != nil {
+			localCols = append(localCols, hist)
+			http.Handle(history.QueryRangePath, history.Handler(hist))
+		}
 		localReg.MustRegister(localCols...)
 		go func() {
 			http.Handle("/", promhttp.HandlerFor(localReg, promhttp.HandlerOpts{}))
@@ -46,8 +67,14 @@ func main() {
 	}
 
 	w, th := initWriter(metricWriterDiagnostics)
-	d := initDecorator()
+	if hist != nil {
+		w = &recordingWriter{metricWriter: w, h: hist}
+	}
+	d := initDecorator(!config.noProcesses)
 	aggregateSpecs := initAggregatorSpecs()
 
-	run(w, th, d, reg, aggregateSpecs)
+	aggregateOps := initAggregatorOps()
+	s := initSampler(g, d, aggregateSpecs, aggregateOps)
+
+	run(w, th, g, s, initPipeline(d, s, lim, stats, aggregateSpecs, aggregateOps))
 }
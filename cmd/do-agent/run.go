@@ -2,14 +2,19 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/digitalocean/do-agent/internal/log"
 	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/collector"
 	"github.com/digitalocean/do-agent/pkg/decorate"
+	"github.com/digitalocean/do-agent/pkg/gather"
+	"github.com/digitalocean/do-agent/pkg/relabel"
 )
 
 const (
@@ -51,32 +56,177 @@ type gatherer interface {
 	Gather() ([]*dto.MetricFamily, error)
 }
 
-func run(w metricWriter, l limiter, dec decorate.Decorator, g gatherer, aggregateSpec map[string][]string) {
+// stage transforms gathered metric families before they are aggregated
+type stage func(mfs []*dto.MetricFamily) []*dto.MetricFamily
+
+// pipeline turns gathered metric families into the metrics written
+type pipeline struct {
+	stages  []stage
+	specs   map[string][]string
+	aggOpts []aggregate.Option
+	stale   *aggregate.StaleTracker
+	stats   *scrapeStats
+	rates   *aggregate.Rates
+}
+
+// batch is the metrics of a single send. Secondary writers receive secondary,
+// which only differs from primary in the counters converted to rates
+type batch struct {
+	primary   []aggregate.MetricWithValue
+	secondary []aggregate.MetricWithValue
+}
+
+// splitWriter is a metricWriter which writes a different batch to its
+// secondary writers
+type splitWriter interface {
+	metricWriter
+	WriteSplit(primary, secondary []aggregate.MetricWithValue) error
+}
+
+// writeBatch writes b with w, handing the secondary metrics to the secondary
+// writers of w if it has any
+func writeBatch(w metricWriter, b batch) error {
+	if sw, ok := w.(splitWriter); ok {
+		return sw.WriteSplit(b.primary, b.secondary)
+	}
+	return w.Write(b.primary)
+}
+
+// scrapeStats holds the names of the metrics scrapers report about their
+// scrapes. They are served on the local endpoint and sent as diagnostics but
+// are not sent with the other metrics
+type scrapeStats struct {
+	m     sync.RWMutex
+	names map[string]bool
+}
+
+// add adds the stat names of c if it is a scraper
+func (s *scrapeStats) add(c prometheus.Collector) {
+	sc, ok := c.(*collector.Scraper)
+	if !ok {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.names == nil {
+		s.names = map[string]bool{}
+	}
+	for _, name := range sc.StatNames() {
+		s.names[name] = true
+	}
+}
+
+// has returns true if name is the name of a scrape stat
+func (s *scrapeStats) has(name string) bool {
+	if s == nil {
+		return false
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.names[name]
+}
+
+// drop returns mfs without the scrape stats
+func (s *scrapeStats) drop(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	kept := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		if !s.has(mf.GetName()) {
+			kept = append(kept, mf)
+		}
+	}
+	return kept
+}
+
+// decorateStage decorates the families with dec
+func decorateStage(dec decorate.Decorator) stage {
+	return func(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+		dec.Decorate(mfs)
+		return mfs
+	}
+}
+
+// relabelStage applies the relabel configs to the families
+func relabelStage(cfgs []*relabel.Config) stage {
+	return func(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+		return relabel.Families(mfs, cfgs)
+	}
+}
+
+// process runs mfs through the stages and aggregates all but the scrape stats.
+// It returns the families, scrape stats included, along with the batch to
+// write
+func (p *pipeline) process(mfs []*dto.MetricFamily) ([]*dto.MetricFamily, batch, error) {
+	start := time.Now()
+	for _, st := range p.stages {
+		mfs = st(mfs)
+	}
+	log.Debug("stats decorated in %s", time.Since(start))
+
+	start = time.Now()
+	aggregated, err := aggregate.Aggregate(p.stats.drop(mfs), p.specs, p.aggOpts...)
+	if err != nil {
+		return mfs, batch{}, err
+	}
+	b := batch{primary: p.stale.Mark(aggregated)}
+	if b.secondary, err = p.convertRates(mfs, b.primary); err != nil {
+		return mfs, batch{}, err
+	}
+	log.Debug("stats aggregated in %s", time.Since(start))
+	return mfs, b, nil
+}
+
+// convertRates returns primary with the counters which have a rate rule
+// replaced by their rates. Stale markers of these counters are kept
+func (p *pipeline) convertRates(mfs []*dto.MetricFamily, primary []aggregate.MetricWithValue) ([]aggregate.MetricWithValue, error) {
+	if p.rates == nil {
+		return primary, nil
+	}
+
+	var counters []*dto.MetricFamily
+	for _, mf := range mfs {
+		if p.rates.Converts(mf.GetName()) {
+			// the families are converted in place but sonar gets the raw values
+			counters = append(counters, proto.Clone(mf).(*dto.MetricFamily))
+		}
+	}
+	rates, err := aggregate.Aggregate(p.rates.Convert(counters, time.Now()), p.specs, p.aggOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	secondary := make([]aggregate.MetricWithValue, 0, len(primary))
+	for _, m := range primary {
+		if !p.rates.Converts(m.Labels.Get("__name__")) || aggregate.IsStaleNaN(m.Value) {
+			secondary = append(secondary, m)
+		}
+	}
+	return append(secondary, rates...), nil
+}
+
+func run(w metricWriter, l limiter, g gatherer, s *sampler, p *pipeline) {
 	exec := func() {
 		start := time.Now()
 		mfs, err := g.Gather()
 		if err != nil {
+			// the metrics of collectors which did not fail are still sent
 			log.Error("failed to gather metrics: %v", err)
+		}
+		if len(mfs) == 0 {
 			return
 		}
 		log.Debug("stats collected in %s", time.Since(start))
 
-		start = time.Now()
-		dec.Decorate(mfs)
-		log.Debug("stats decorated in %s", time.Since(start))
-
-		start = time.Now()
-		aggregated, err := aggregate.Aggregate(mfs, aggregateSpec)
+		mfs, b, err := p.process(mfs)
 		if err != nil {
 			log.Error("failed to aggregate metrics: %v", err)
-			writeDiagnostics(w, mfs, ErrAggregationFailed)
+			writeDiagnostics(w, mfs, p.stats, ErrAggregationFailed)
 			return
 		}
-		log.Debug("stats aggregated in %s", time.Since(start))
 
 		start = time.Now()
-		err = w.Write(aggregated)
+		err = writeBatch(w, b)
 		if err == nil {
+			p.stale.Sent(b.primary)
 			log.Debug("stats written in %s", time.Since(start))
 			return
 		}
@@ -85,25 +235,25 @@ func run(w metricWriter, l limiter, dec decorate.Decorator, g gatherer, aggregat
 		// don't send again immediately or it will fail for sending too frequently
 		// first sleep for the wait duration and then send diagnostic information
 		time.Sleep(l.WaitDuration())
-		writeDiagnostics(w, mfs, err)
+		writeDiagnostics(w, mfs, p.stats, err)
 	}
 
 	exec()
 	for {
-		time.Sleep(l.WaitDuration())
+		s.sleep(l.WaitDuration())
 		exec()
 	}
 }
 
 // writeDiagnostics filters all metrics and gathers only the diagnostic information and sends the metrics
-// in the event of a write failure
-func writeDiagnostics(w metricWriter, mfs []*dto.MetricFamily, err error) {
+// in the event of a write failure. Scrape stats are included so failing scrape targets can be identified
+func writeDiagnostics(w metricWriter, mfs []*dto.MetricFamily, stats *scrapeStats, err error) {
 	diagnosticMetric.WithLabelValues(err.Error()).Inc()
 	var diags []*dto.MetricFamily
 
 	for _, mf := range mfs {
-		switch mf.GetName() {
-		case buildInfoMetricName, diagnosticMetricName:
+		switch name := mf.GetName(); {
+		case name == buildInfoMetricName, name == diagnosticMetricName, name == gather.ErrorsMetricName, stats.has(name):
 			diags = append(diags, mf)
 		}
 	}
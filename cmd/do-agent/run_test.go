@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/collector"
+)
+
+func TestWriteDiagnosticsIncludesScrapeStats(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	s, err := collector.NewScraper("diagtarget", ts.URL, nil, nil)
+	require.NoError(t, err)
+
+	unrelated := prometheus.NewGauge(prometheus.GaugeOpts{Name: "unrelated"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s, buildInfo, unrelated)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	written := map[string]map[string]string{}
+	w := &fakeWriter{name: "test", writeFn: func(mets []aggregate.MetricWithValue) error {
+		for _, m := range mets {
+			written[m.Labels.Get("__name__")] = m.Labels.Map()
+		}
+		return nil
+	}}
+	stats := &scrapeStats{}
+	stats.add(s)
+	writeDiagnostics(w, mfs, stats, errors.New("write failed"))
+
+	assert.Contains(t, written, buildInfoMetricName)
+	assert.Contains(t, written, "diagtarget_up")
+	assert.Contains(t, written, "diagtarget_scrape_http_status_code")
+	assert.Equal(t, "http_status", written["diagtarget_scrape_last_error"]["reason"])
+	assert.NotContains(t, written, "unrelated")
+}
+
+func TestPipelineKeepsScrapeStatsLocal(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	s, err := collector.NewScraper("localtarget", ts.URL, nil, nil)
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	stats := &scrapeStats{}
+	stats.add(s)
+	p := &pipeline{stats: stats}
+	mfs, b, err := p.process(mfs)
+	require.NoError(t, err)
+
+	var sent []string
+	for _, m := range b.primary {
+		sent = append(sent, m.Labels.Get("__name__"))
+	}
+	assert.Contains(t, sent, "localtarget_scrape_collector_success")
+	assert.NotContains(t, sent, "localtarget_up")
+
+	var names []string
+	for _, mf := range mfs {
+		names = append(names, mf.GetName())
+	}
+	assert.Contains(t, names, "localtarget_up", "scrape stats must still be available for diagnostics")
+}
+
+func TestPipelineConvertsRatesForSecondaryWriters(t *testing.T) {
+	rx := prometheus.NewCounter(prometheus.CounterOpts{Name: "sonar_network_receive_bytes"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(rx)
+	p := &pipeline{rates: aggregate.NewRates(map[string]aggregate.RateOp{"sonar_network_receive_bytes": aggregate.RateOpDelta})}
+
+	values := func(mets []aggregate.MetricWithValue) []float64 {
+		var out []float64
+		for _, m := range mets {
+			out = append(out, m.Value)
+		}
+		return out
+	}
+
+	var b batch
+	for _, v := range []float64{10, 15} {
+		rx.Add(v)
+		mfs, err := reg.Gather()
+		require.NoError(t, err)
+		_, b, err = p.process(mfs)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []float64{25}, values(b.primary))
+	assert.Equal(t, []float64{15}, values(b.secondary))
+}
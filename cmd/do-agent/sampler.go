@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/decorate"
+	"github.com/digitalocean/do-agent/pkg/relabel"
+)
+
+// sampler gathers metrics between sends and rolls them up so short spikes
+// are sent along with the next batch. A nil sampler only waits
+type sampler struct {
+	g        gatherer
+	dec      decorate.Decorator
+	relabel  []*relabel.Config
+	r        *aggregate.Rollup
+	interval time.Duration
+}
+
+// sleep waits for d, sampling every interval in the meantime
+func (s *sampler) sleep(d time.Duration) {
+	if s == nil {
+		time.Sleep(d)
+		return
+	}
+
+	deadline := time.Now().Add(d)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= s.interval {
+			time.Sleep(remaining)
+			return
+		}
+		time.Sleep(s.interval)
+		s.sample()
+	}
+}
+
+// sample gathers and records a sample
+func (s *sampler) sample() {
+	mfs, err := s.g.Gather()
+	if err != nil {
+		log.Debug("failed to gather sample: %v", err)
+	}
+	s.dec.Decorate(mfs)
+	s.r.Observe(relabel.Families(mfs, s.relabel))
+}
+
+// rollup adds the families rolled up since the previous send to mfs
+func (s *sampler) rollup(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	if s == nil {
+		return mfs
+	}
+	return s.r.Flush(mfs)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/decorate"
+)
+
+func TestSamplerRollsUpSamplesBetweenSends(t *testing.T) {
+	memory := prometheus.NewGauge(prometheus.GaugeOpts{Name: "sonar_memory_available"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(memory)
+
+	var samples int
+	g := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		samples++
+		// spike on the first sample only
+		if samples == 1 {
+			memory.Set(1)
+		} else {
+			memory.Set(100)
+		}
+		return reg.Gather()
+	})
+
+	s := &sampler{
+		g:        g,
+		dec:      decorate.Chain{},
+		r:        aggregate.NewRollup(map[string][]aggregate.RollupOp{"sonar_memory_available": {aggregate.RollupMin}}, nil),
+		interval: 5 * time.Millisecond,
+	}
+	s.sleep(30 * time.Millisecond)
+	require.GreaterOrEqual(t, samples, 2)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	mets, err := aggregate.Aggregate(s.rollup(mfs), nil)
+	require.NoError(t, err)
+
+	values := map[string]float64{}
+	for _, m := range mets {
+		values[m.Labels.Get("__name__")] = m.Value
+	}
+	require.Equal(t, map[string]float64{"sonar_memory_available": 100, "sonar_memory_available_min": 1}, values)
+}
+
+func TestNilSamplerOnlyWaits(t *testing.T) {
+	var s *sampler
+	s.sleep(time.Millisecond)
+	mfs := []*dto.MetricFamily{{}}
+	require.Equal(t, mfs, s.rollup(mfs))
+}
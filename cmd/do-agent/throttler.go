@@ -14,3 +14,50 @@ func (c *constThrottler) WaitDuration() time.Duration {
 func (c *constThrottler) Name() string {
 	return "constant"
 }
+
+// backoffThrottler wraps a limiter and exponentially extends its wait
+// duration while consecutive writes fail
+type backoffThrottler struct {
+	limiter
+	max      time.Duration
+	failures uint
+}
+
+// minBackoff is the first backoff step when the wrapped limiter has no wait
+const minBackoff = time.Second
+
+func newBackoffThrottler(l limiter, max time.Duration) *backoffThrottler {
+	return &backoffThrottler{limiter: l, max: max}
+}
+
+// WaitDuration returns the wrapped limiter's wait duration plus the current
+// backoff
+func (b *backoffThrottler) WaitDuration() time.Duration {
+	wait := b.limiter.WaitDuration()
+	if b.failures == 0 {
+		return wait
+	}
+
+	backoff := minBackoff
+	for i := uint(1); i < b.failures && backoff < b.max; i++ {
+		backoff *= 2
+	}
+	if backoff > b.max {
+		backoff = b.max
+	}
+	return wait + backoff
+}
+
+// Name is the name of this limiter
+func (b *backoffThrottler) Name() string {
+	return "backoff"
+}
+
+// record resets the backoff on success and extends it on failure
+func (b *backoffThrottler) record(err error) {
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+}
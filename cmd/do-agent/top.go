@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/internal/process"
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+	"github.com/digitalocean/do-agent/pkg/collector"
+	"github.com/digitalocean/do-agent/pkg/decorate"
+	"github.com/digitalocean/do-agent/pkg/history"
+)
+
+const clearScreen = "\033[H\033[2J"
+
+var (
+	topCommand = kingpin.Command("top", "show a live view of the metrics collected on this host")
+
+	topConfig struct {
+		interval   time.Duration
+		processes  int
+		historyURL string
+		once       bool
+	}
+)
+
+func init() {
+	kingpin.Command("run", "collect and send metrics (default)").Default()
+
+	topCommand.Flag("top.interval", "time between refreshes").
+		Default("3s").
+		DurationVar(&topConfig.interval)
+
+	topCommand.Flag("top.processes", "number of processes to display").
+		Default("10").
+		IntVar(&topConfig.processes)
+
+	topCommand.Flag("top.history-url", "read metrics from the local history of a running agent (ex. http://127.0.0.1:9100) instead of gathering them").
+		StringVar(&topConfig.historyURL)
+
+	topCommand.Flag("top.once", "print a single view and exit").
+		BoolVar(&topConfig.once)
+}
+
+// snapshot is the set of metrics observed at a point in time
+type snapshot struct {
+	ts   time.Time
+	mets map[string]aggregate.MetricWithValue
+}
+
+func newSnapshot(ts time.Time, mets []aggregate.MetricWithValue) *snapshot {
+	s := &snapshot{ts: ts, mets: make(map[string]aggregate.MetricWithValue, len(mets))}
+	for _, m := range mets {
+		s.mets[m.Labels.String()] = m
+	}
+	return s
+}
+
+// named returns all metrics with the given name
+func (s *snapshot) named(name string) []aggregate.MetricWithValue {
+	var out []aggregate.MetricWithValue
+	for _, m := range s.mets {
+		if m.Labels.Get("__name__") == name {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// value returns the value of the single metric with the given name
+func (s *snapshot) value(name string) (float64, bool) {
+	for _, m := range s.mets {
+		if m.Labels.Get("__name__") == name {
+			return m.Value, true
+		}
+	}
+	return 0, false
+}
+
+// topSource provides the snapshots shown by the top command
+type topSource interface {
+	// Snapshots returns the current snapshot and the previous one, if any,
+	// to compute rates with
+	Snapshots() (prev, cur *snapshot, err error)
+	Name() string
+}
+
+// gatherSource gathers metrics in process with the same decorators and
+// aggregation as the agent so the numbers match what is sent
+type gatherSource struct {
+	g     gatherer
+	dec   decorate.Decorator
+	specs map[string][]string
+	last  *snapshot
+}
+
+func newGatherSource() (*gatherSource, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(process.NewProcessCollector())
+
+	node, err := collector.NewNodeCollector()
+	if err != nil {
+		return nil, err
+	}
+	reg.MustRegister(node)
+
+	// always show processes, even where process collection is not rolled out
+	return &gatherSource{
+		g:     reg,
+		dec:   initDecorator(true),
+		specs: initAggregatorSpecs(),
+	}, nil
+}
+
+// Snapshots gathers a new snapshot
+func (s *gatherSource) Snapshots() (*snapshot, *snapshot, error) {
+	mfs, err := s.g.Gather()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	s.dec.Decorate(mfs)
+	mets, err := aggregate.Aggregate(mfs, s.specs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to aggregate metrics: %w", err)
+	}
+
+	prev := s.last
+	s.last = newSnapshot(time.Now(), mets)
+	return prev, s.last, nil
+}
+
+// Name is the name of this source
+func (s *gatherSource) Name() string {
+	return "gather"
+}
+
+// historySource reads the two most recent samples of every sonar series from
+// the history API of a running agent
+type historySource struct {
+	endpoint string
+	client   clients.HTTPClient
+}
+
+func newHistorySource(base string) (*historySource, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, fmt.Errorf("invalid history url: %w", err)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + history.QueryRangePath
+	return &historySource{
+		endpoint: u.String(),
+		client:   clients.NewHTTP(10 * time.Second),
+	}, nil
+}
+
+// Snapshots queries the history for recent samples
+func (s *historySource) Snapshots() (*snapshot, *snapshot, error) {
+	q := url.Values{
+		"query": {`{__name__=~"sonar_.*"}`},
+		"start": {strconv.FormatInt(time.Now().Add(-15*time.Minute).Unix(), 10)},
+	}
+	req, err := http.NewRequest(http.MethodGet, s.endpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query history: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string
+		Error  string
+		Data   struct {
+			Result []struct {
+				Metric map[string]string
+				Values [][2]interface{}
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode history response: %w", err)
+	}
+	if body.Status != "success" {
+		return nil, nil, fmt.Errorf("history query failed: %s", body.Error)
+	}
+
+	var prev, cur []aggregate.MetricWithValue
+	var prevTS, curTS time.Time
+	for _, r := range body.Data.Result {
+		n := len(r.Values)
+		if n == 0 {
+			continue
+		}
+		ts, v, err := parseHistoryValue(r.Values[n-1])
+		if err != nil {
+			return nil, nil, err
+		}
+		cur = append(cur, aggregate.MetricWithValue{Labels: tsclient.LabelSetFromMap(r.Metric), Value: v})
+		if ts.After(curTS) {
+			curTS = ts
+		}
+
+		if n < 2 {
+			continue
+		}
+		ts, v, err = parseHistoryValue(r.Values[n-2])
+		if err != nil {
+			return nil, nil, err
+		}
+		prev = append(prev, aggregate.MetricWithValue{Labels: tsclient.LabelSetFromMap(r.Metric), Value: v})
+		if ts.After(prevTS) {
+			prevTS = ts
+		}
+	}
+
+	if len(prev) == 0 {
+		return nil, newSnapshot(curTS, cur), nil
+	}
+	return newSnapshot(prevTS, prev), newSnapshot(curTS, cur), nil
+}
+
+// Name is the name of this source
+func (s *historySource) Name() string {
+	return "history"
+}
+
+func parseHistoryValue(v [2]interface{}) (time.Time, float64, error) {
+	sec, ok := v[0].(float64)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unexpected history timestamp %v", v[0])
+	}
+	s, ok := v[1].(string)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unexpected history value %v", v[1])
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("unexpected history value %q: %w", s, err)
+	}
+	return time.UnixMilli(int64(sec * 1000)), f, nil
+}
+
+// runTop runs the top command until interrupted
+func runTop() {
+	var src topSource
+	var err error
+	if topConfig.historyURL != "" {
+		src, err = newHistorySource(topConfig.historyURL)
+	} else {
+		src, err = newGatherSource()
+	}
+	if err != nil {
+		log.Fatal("failed to initialize top: %+v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	for retried := false; ; {
+		prev, cur, err := src.Snapshots()
+		switch {
+		case err != nil:
+			log.Error("%v", err)
+		case prev == nil && topConfig.once && !retried:
+			// rates need two samples, take another one before printing
+			retried = true
+			time.Sleep(topConfig.interval)
+			continue
+		default:
+			if !topConfig.once {
+				fmt.Fprint(os.Stdout, clearScreen)
+			}
+			fmt.Fprintf(os.Stdout, "do-agent top - %s - %s (source: %s, refresh: %s)\n\n",
+				hostname, cur.ts.Format("15:04:05"), src.Name(), topConfig.interval)
+			renderTop(os.Stdout, prev, cur, topConfig.processes)
+		}
+
+		if topConfig.once {
+			return
+		}
+		time.Sleep(topConfig.interval)
+	}
+}
+
+// renderTop writes the view of cur to w. Rates are computed against prev and
+// left out when prev is nil
+func renderTop(w io.Writer, prev, cur *snapshot, processes int) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+
+	renderCPU(tw, prev, cur)
+	renderLoadAndMemory(tw, cur)
+	renderDevices(tw, prev, cur, "Disk", "device", [][2]string{
+		{"read/s", "sonar_disk_sectors_read"},
+		{"write/s", "sonar_disk_sectors_written"},
+		{"reads/s", "sonar_disk_reads_completed_total"},
+		{"writes/s", "sonar_disk_writes_completed_total"},
+	})
+	renderDevices(tw, prev, cur, "Network", "device", [][2]string{
+		{"rx/s", "sonar_network_receive_bytes"},
+		{"tx/s", "sonar_network_transmit_bytes"},
+	})
+	renderProcesses(tw, prev, cur, processes)
+}
+
+func renderCPU(w io.Writer, prev, cur *snapshot) {
+	if prev == nil {
+		fmt.Fprintf(w, "CPU\twaiting for a second sample\n\n")
+		return
+	}
+
+	deltas := map[string]float64{}
+	var total float64
+	for _, m := range cur.named("sonar_cpu") {
+		d, ok := delta(prev, m)
+		if !ok {
+			continue
+		}
+		deltas[m.Labels.Get("mode")] += d
+		total += d
+	}
+	if total <= 0 {
+		fmt.Fprintf(w, "CPU\tno data\n\n")
+		return
+	}
+
+	modes := make([]string, 0, len(deltas))
+	for mode := range deltas {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+
+	fmt.Fprint(w, "CPU")
+	for _, mode := range modes {
+		fmt.Fprintf(w, "\t%s %.1f%%", mode, deltas[mode]/total*100)
+	}
+	fmt.Fprint(w, "\n\n")
+}
+
+func renderLoadAndMemory(w io.Writer, cur *snapshot) {
+	fmt.Fprint(w, "Load")
+	for _, name := range []string{"sonar_load1", "sonar_load5", "sonar_load15"} {
+		v, _ := cur.value(name)
+		fmt.Fprintf(w, "\t%.2f", v)
+	}
+	fmt.Fprint(w, "\n")
+
+	total, _ := cur.value("sonar_memory_total")
+	available, _ := cur.value("sonar_memory_available")
+	free, _ := cur.value("sonar_memory_free")
+	cached, _ := cur.value("sonar_memory_cached")
+	var used float64
+	if total > 0 {
+		used = (total - available) / total * 100
+	}
+	fmt.Fprintf(w, "Memory\ttotal %s\tavailable %s\tfree %s\tcached %s\tused %.1f%%\n",
+		humanBytes(total), humanBytes(available), humanBytes(free), humanBytes(cached), used)
+
+	swapTotal, _ := cur.value("sonar_memory_swap_total")
+	swapFree, _ := cur.value("sonar_memory_swap_free")
+	fmt.Fprintf(w, "Swap\ttotal %s\tfree %s\n\n", humanBytes(swapTotal), humanBytes(swapFree))
+}
+
+// renderDevices renders the per second rate of each column's metric per value
+// of the label
+func renderDevices(w io.Writer, prev, cur *snapshot, title, label string, columns [][2]string) {
+	rates := map[string][]string{}
+	for i, col := range columns {
+		for _, m := range cur.named(col[1]) {
+			dev := m.Labels.Get(label)
+			if _, ok := rates[dev]; !ok {
+				rates[dev] = make([]string, len(columns))
+			}
+			r, ok := rate(prev, cur, m)
+			switch {
+			case !ok:
+				rates[dev][i] = "-"
+			case strings.HasPrefix(col[1], "sonar_disk_sectors_"):
+				rates[dev][i] = humanBytes(r*512) + "/s"
+			case strings.HasSuffix(col[1], "_bytes"):
+				rates[dev][i] = humanBytes(r) + "/s"
+			default:
+				rates[dev][i] = fmt.Sprintf("%.1f", r)
+			}
+		}
+	}
+
+	fmt.Fprint(w, title)
+	for _, col := range columns {
+		fmt.Fprintf(w, "\t%s", col[0])
+	}
+	fmt.Fprint(w, "\n")
+
+	devs := make([]string, 0, len(rates))
+	for dev := range rates {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+	for _, dev := range devs {
+		fmt.Fprintf(w, "%s\t%s\n", dev, strings.Join(rates[dev], "\t"))
+	}
+	fmt.Fprint(w, "\n")
+}
+
+type topProcess struct {
+	pid, name string
+	rss, cpu  float64
+	hasCPU    bool
+}
+
+func renderProcesses(w io.Writer, prev, cur *snapshot, n int) {
+	procs := map[string]*topProcess{}
+	get := func(m aggregate.MetricWithValue) *topProcess {
+		pid := m.Labels.Get("pid")
+		p, ok := procs[pid]
+		if !ok {
+			p = &topProcess{pid: pid, name: m.Labels.Get("process")}
+			procs[pid] = p
+		}
+		return p
+	}
+
+	for _, m := range cur.named("sonar_process_resident_memory_bytes") {
+		get(m).rss = m.Value
+	}
+	for _, m := range cur.named("sonar_process_cpu_time_seconds") {
+		if r, ok := rate(prev, cur, m); ok {
+			p := get(m)
+			p.cpu = r * 100
+			p.hasCPU = true
+		}
+	}
+
+	sorted := make([]*topProcess, 0, len(procs))
+	for _, p := range procs {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].cpu != sorted[j].cpu {
+			return sorted[i].cpu > sorted[j].cpu
+		}
+		return sorted[i].rss > sorted[j].rss
+	})
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	fmt.Fprint(w, "PID\tPROCESS\tRSS\tCPU\n")
+	for _, p := range sorted {
+		cpu := "-"
+		if p.hasCPU {
+			cpu = fmt.Sprintf("%.1f%%", p.cpu)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.pid, p.name, humanBytes(p.rss), cpu)
+	}
+}
+
+// delta returns the increase of the counter m since prev
+func delta(prev *snapshot, m aggregate.MetricWithValue) (float64, bool) {
+	if prev == nil {
+		return 0, false
+	}
+	p, ok := prev.mets[m.Labels.String()]
+	if !ok || m.Value < p.Value {
+		// new series or counter reset
+		return 0, false
+	}
+	return m.Value - p.Value, true
+}
+
+// rate returns the per second increase of the counter m between prev and cur
+func rate(prev, cur *snapshot, m aggregate.MetricWithValue) (float64, bool) {
+	d, ok := delta(prev, m)
+	if !ok {
+		return 0, false
+	}
+	secs := cur.ts.Sub(prev.ts).Seconds()
+	if secs <= 0 {
+		return 0, false
+	}
+	return d / secs, true
+}
+
+// humanBytes formats bytes with binary units
+func humanBytes(b float64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%.0f B", b)
+	}
+	exp := 0
+	for n := b / unit; n >= unit && exp < 5; n /= unit {
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", b/math.Pow(unit, float64(exp+1)), "KMGTPE"[exp])
+}
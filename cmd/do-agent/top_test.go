@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+	"github.com/digitalocean/do-agent/pkg/history"
+)
+
+func met(value float64, labels ...string) aggregate.MetricWithValue {
+	lfm := map[string]string{"__name__": labels[0]}
+	for i := 1; i+1 < len(labels); i += 2 {
+		lfm[labels[i]] = labels[i+1]
+	}
+	return aggregate.MetricWithValue{Labels: tsclient.LabelSetFromMap(lfm), Value: value}
+}
+
+func TestRenderTop(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	prev := newSnapshot(start, []aggregate.MetricWithValue{
+		met(100, "sonar_cpu", "mode", "user"),
+		met(300, "sonar_cpu", "mode", "idle"),
+		met(1000, "sonar_network_receive_bytes", "device", "eth0"),
+		met(10, "sonar_process_cpu_time_seconds", "process", "nginx", "pid", "10"),
+		met(1, "sonar_process_cpu_time_seconds", "process", "sshd", "pid", "20"),
+	})
+	cur := newSnapshot(start.Add(10*time.Second), []aggregate.MetricWithValue{
+		met(125, "sonar_cpu", "mode", "user"),
+		met(375, "sonar_cpu", "mode", "idle"),
+		met(21480, "sonar_network_receive_bytes", "device", "eth0"),
+		met(2048, "sonar_memory_total"),
+		met(1024, "sonar_memory_available"),
+		met(0.5, "sonar_load1"),
+		met(12, "sonar_process_cpu_time_seconds", "process", "nginx", "pid", "10"),
+		met(1<<20, "sonar_process_resident_memory_bytes", "process", "nginx", "pid", "10"),
+		met(6, "sonar_process_cpu_time_seconds", "process", "sshd", "pid", "20"),
+		met(1<<10, "sonar_process_resident_memory_bytes", "process", "sshd", "pid", "20"),
+	})
+
+	buf := new(bytes.Buffer)
+	renderTop(buf, prev, cur, 1)
+	out := buf.String()
+
+	assert.Contains(t, out, "idle 75.0%")
+	assert.Contains(t, out, "user 25.0%")
+	assert.Contains(t, out, "0.50")
+	assert.Contains(t, out, "used 50.0%")
+	assert.Regexp(t, `eth0\s+2.0 KiB/s`, out)
+	// only the busiest process is shown
+	assert.Regexp(t, `20\s+sshd\s+1.0 KiB\s+50.0%`, out)
+	assert.NotContains(t, out, "nginx")
+}
+
+func TestRenderTopWithoutPreviousSnapshot(t *testing.T) {
+	cur := newSnapshot(time.Now(), []aggregate.MetricWithValue{
+		met(125, "sonar_cpu", "mode", "user"),
+		met(1<<20, "sonar_process_resident_memory_bytes", "process", "nginx", "pid", "10"),
+	})
+
+	buf := new(bytes.Buffer)
+	renderTop(buf, nil, cur, 10)
+	assert.Contains(t, buf.String(), "waiting for a second sample")
+	assert.Regexp(t, `10\s+nginx\s+1.0 MiB\s+-`, buf.String())
+}
+
+func TestHistorySourceReturnsLastTwoSamples(t *testing.T) {
+	h := history.NewStore(time.Hour)
+	now := time.Now().Truncate(time.Second)
+	h.Append(now.Add(-2*time.Minute), []aggregate.MetricWithValue{met(1, "sonar_cpu", "mode", "user")})
+	h.Append(now.Add(-time.Minute), []aggregate.MetricWithValue{met(2, "sonar_cpu", "mode", "user")})
+	h.Append(now, []aggregate.MetricWithValue{met(4, "sonar_cpu", "mode", "user"), met(1, "other")})
+
+	srv := httptest.NewServer(history.Handler(h))
+	defer srv.Close()
+
+	src, err := newHistorySource(srv.URL)
+	require.NoError(t, err)
+
+	prev, cur, err := src.Snapshots()
+	require.NoError(t, err)
+	require.NotNil(t, prev)
+	assert.Equal(t, now.Add(-time.Minute), prev.ts)
+	assert.Equal(t, now, cur.ts)
+
+	v, ok := cur.value("sonar_cpu")
+	require.True(t, ok)
+	assert.Equal(t, 4.0, v)
+	v, ok = prev.value("sonar_cpu")
+	require.True(t, ok)
+	assert.Equal(t, 2.0, v)
+	_, ok = cur.value("other")
+	assert.False(t, ok)
+}
+
+func TestHumanBytes(t *testing.T) {
+	assert.Equal(t, "512 B", humanBytes(512))
+	assert.Equal(t, "1.5 KiB", humanBytes(1536))
+	assert.Equal(t, "2.0 GiB", humanBytes(2<<30))
+}
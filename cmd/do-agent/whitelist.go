@@ -429,3 +429,26 @@ var diWhitelist = map[string]bool{
 	"gradient_infra_di_vllm:request_time_per_output_token_seconds_bucket": true,
 	"gradient_infra_di_vllm:time_to_first_token_seconds_bucket":           true,
 }
+
+var kubeletResourceWhitelist = map[string]bool{
+	"container_cpu_usage_seconds_total":  true,
+	"container_memory_working_set_bytes": true,
+	"container_swap_usage_bytes":         true,
+	"container_start_time_seconds":       true,
+	"pod_cpu_usage_seconds_total":        true,
+	"pod_memory_working_set_bytes":       true,
+	"pod_swap_usage_bytes":               true,
+}
+
+// kubeletCadvisorWhitelist only includes series not already provided by the
+// kubelet resource metrics
+var kubeletCadvisorWhitelist = map[string]bool{
+	"container_network_receive_bytes_total":            true,
+	"container_network_transmit_bytes_total":           true,
+	"container_network_receive_packets_dropped_total":  true,
+	"container_network_transmit_packets_dropped_total": true,
+	"container_memory_rss":                             true,
+	"container_cpu_cfs_throttled_periods_total":        true,
+	"container_fs_reads_bytes_total":                   true,
+	"container_fs_writes_bytes_total":                  true,
+}
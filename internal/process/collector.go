@@ -41,6 +41,11 @@ func NewProcessCollector() prometheus.Collector {
 	return c
 }
 
+// Name returns the name of this collector
+func (c *processCollector) Name() string {
+	return "process"
+}
+
 // Describe returns all descriptions of the collector.
 func (c *processCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- c.rss
@@ -1,6 +1,9 @@
 package aggregate
 
 import (
+	"fmt"
+	"strings"
+
 	dto "github.com/prometheus/client_model/go"
 
 	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
@@ -8,16 +11,137 @@ import (
 
 // MetricWithValue is a representation of a label formatted metric with a value
 type MetricWithValue struct {
-	LFM   map[string]string
-	Value float64
+	Labels tsclient.LabelSet
+	Value  float64
+}
+
+// Op is the operation combining the values of series aggregated into one
+type Op string
+
+const (
+	// Sum adds up the values. It is the default operation
+	Sum Op = "sum"
+	// Avg is the average of the values
+	Avg Op = "avg"
+	// Min is the smallest value
+	Min Op = "min"
+	// Max is the largest value
+	Max Op = "max"
+	// Count is the number of series aggregated
+	Count Op = "count"
+	// Last is the value of the last series aggregated
+	Last Op = "last"
+)
+
+// Ops returns the names of all aggregation operations
+func Ops() []string {
+	return []string{string(Sum), string(Avg), string(Min), string(Max), string(Count), string(Last)}
+}
+
+// ParseOp parses the name of an aggregation operation
+func ParseOp(s string) (Op, error) {
+	for _, op := range Ops() {
+		if s == op {
+			return Op(s), nil
+		}
+	}
+	return "", fmt.Errorf("unknown aggregation operation %q, must be one of %s", s, strings.Join(Ops(), ", "))
+}
+
+type aggregateOpts struct {
+	quantiles map[string][]float64
+	ops       map[string]Op
+}
+
+// Option is used to configure optional aggregation options.
+type Option func(o *aggregateOpts)
+
+// WithHistogramQuantiles estimates the given quantiles of histogram families
+// from their buckets. The quantiles are sent as <name>{quantile="q"} instead
+// of the <name>_bucket series, which is much cheaper for histograms with many
+// buckets
+func WithHistogramQuantiles(quantiles map[string][]float64) Option {
+	return func(o *aggregateOpts) {
+		o.quantiles = quantiles
+	}
+}
+
+// WithOps sets the operation aggregating each metric family. Families without
+// an operation are summed. Histograms and summaries are always summed
+func WithOps(ops map[string]Op) Option {
+	return func(o *aggregateOpts) {
+		o.ops = ops
+	}
+}
+
+// accumulator combines the values of series aggregated into one
+type accumulator struct {
+	labels              tsclient.LabelSet
+	sum, min, max, last float64
+	count               int
+}
+
+func (a *accumulator) add(v float64) {
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.last = v
+	a.count++
+}
+
+func (a *accumulator) value(op Op) float64 {
+	switch op {
+	case Avg:
+		return a.sum / float64(a.count)
+	case Min:
+		return a.min
+	case Max:
+		return a.max
+	case Count:
+		return float64(a.count)
+	case Last:
+		return a.last
+	default:
+		return a.sum
+	}
 }
 
 // Aggregate aggregates metric families according to the given aggregate spec.
 // A spec with key: {"metricName": "aggregateLabel"} will remove the "aggregateLabel" from all
 // "metricName" metric families
-func Aggregate(metrics []*dto.MetricFamily, aggregateSpec map[string][]string) ([]MetricWithValue, error) {
-	agg := map[string]MetricWithValue{}
+//
+// Histograms are flattened into <name>_bucket{le}, <name>_sum and <name>_count
+// and summaries into <name>{quantile}, <name>_sum and <name>_count. A spec for
+// <name>_bucket applies to the whole histogram, so its labels are also removed
+// from <name>_sum and <name>_count
+func Aggregate(metrics []*dto.MetricFamily, aggregateSpec map[string][]string, opts ...Option) ([]MetricWithValue, error) {
+	defOpts := aggregateOpts{}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	agg := newSeriesMap()
+	ops := map[string]Op{}
+	var b tsclient.LabelSetBuilder
+
 	for _, mf := range metrics {
+		labelsToRemove := aggregateSpec[mf.GetName()]
+
+		switch mf.GetType() {
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			// specs written for the flattened buckets apply to the whole histogram
+			labelsToRemove = append(labelsToRemove[:len(labelsToRemove):len(labelsToRemove)], aggregateSpec[mf.GetName()+"_bucket"]...)
+			aggregateHistograms(mf, labelsToRemove, defOpts.quantiles[mf.GetName()], agg.add)
+			continue
+		case dto.MetricType_SUMMARY:
+			aggregateSummaries(mf, labelsToRemove, agg.add)
+			continue
+		}
+
 		for _, metric := range mf.Metric {
 			var value float64
 			switch *mf.Type {
@@ -32,42 +156,72 @@ func Aggregate(metrics []*dto.MetricFamily, aggregateSpec map[string][]string) (
 				continue
 			}
 
-			labels := map[string]string{}
-			tslbls := make([]string, len(metric.Label)*2)
-			for i, label := range metric.Label {
-				tslbls[i] = *label.Name
-				tslbls[i*2] = *label.Value
-				labels[*label.Name] = *label.Value
-			}
-
-			def := tsclient.NewDefinition(*mf.Name, tsclient.WithCommonLabels(labels))
-			lfm, err := tsclient.GetLFM(def, tslbls)
-			if err != nil {
-				return nil, err
-			}
-			lfmDelim, err := tsclient.ParseMetricDelimited(lfm)
-			if err != nil {
-				return nil, err
-			}
-			labelsToRemove, ok := aggregateSpec[mf.GetName()]
-			if ok {
-				// if the metric family is to be aggregated, aggregate away the specified labels
-				for _, lbl := range labelsToRemove {
-					delete(lfmDelim, lbl)
-				}
-			}
-			key := tsclient.ConvertLFMMapToPrometheusEncodedName(lfmDelim)
-			aggregated, ok := agg[key]
-			if !ok {
-				aggregated.LFM = lfmDelim
-			}
-			aggregated.Value += value
-			agg[key] = aggregated
+			metricLabels(&b, mf.GetName(), metric.Label, labelsToRemove)
+			agg.addBuilder(&b, value)
+		}
+		if op, ok := defOpts.ops[mf.GetName()]; ok {
+			ops[mf.GetName()] = op
 		}
 	}
-	squashed := make([]MetricWithValue, 0)
-	for _, m := range agg {
-		squashed = append(squashed, m)
+	squashed := make([]MetricWithValue, 0, len(agg.order))
+	for _, m := range agg.order {
+		squashed = append(squashed, MetricWithValue{
+			Labels: m.labels,
+			Value:  m.value(ops[m.labels.Name()]),
+		})
 	}
 	return squashed, nil
 }
+
+// seriesMap maps label sets to the accumulators of their series. Series are
+// looked up by hash, comparing the labels on collisions
+type seriesMap struct {
+	byHash map[uint64][]*accumulator
+	order  []*accumulator
+}
+
+func newSeriesMap() *seriesMap {
+	return &seriesMap{byHash: map[uint64][]*accumulator{}}
+}
+
+// addBuilder adds a value to the series of the labels in b. The label set is
+// only built for new series
+func (s *seriesMap) addBuilder(b *tsclient.LabelSetBuilder, value float64) {
+	h := b.Hash()
+	for _, a := range s.byHash[h] {
+		if b.Equal(a.labels) {
+			a.add(value)
+			return
+		}
+	}
+	a := &accumulator{labels: b.LabelSet()}
+	s.byHash[h] = append(s.byHash[h], a)
+	s.order = append(s.order, a)
+	a.add(value)
+}
+
+// add adds a value to the series of ls
+func (s *seriesMap) add(ls tsclient.LabelSet, value float64) {
+	for _, a := range s.byHash[ls.Hash()] {
+		if ls.Equal(a.labels) {
+			a.add(value)
+			return
+		}
+	}
+	a := &accumulator{labels: ls}
+	s.byHash[ls.Hash()] = append(s.byHash[ls.Hash()], a)
+	s.order = append(s.order, a)
+	a.add(value)
+}
+
+// metricLabels resets b to the labels of a metric, named after its family,
+// without the labels to aggregate away
+func metricLabels(b *tsclient.LabelSetBuilder, name string, metricLabels []*dto.LabelPair, labelsToRemove []string) {
+	b.Reset()
+	for _, label := range metricLabels {
+		b.Set(label.GetName(), label.GetValue())
+	}
+	// if the metric family is to be aggregated, aggregate away the specified labels
+	b.Del(labelsToRemove...)
+	b.Set(nameLabel, name)
+}
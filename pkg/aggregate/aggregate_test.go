@@ -1,10 +1,12 @@
 package aggregate
 
 import (
+	"strconv"
 	"testing"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -74,9 +76,9 @@ func TestAggregateOverTwoMetrics(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, len(aggregated))
 	require.Equal(t, 23.0, aggregated[0].Value)
-	require.NotContains(t, aggregated[0].LFM, table)
-	require.Contains(t, aggregated[0].LFM, lblOneName)
-	require.Contains(t, aggregated[0].LFM, lblTwoName)
+	require.NotContains(t, aggregated[0].Labels.Map(), table)
+	require.Contains(t, aggregated[0].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[0].Labels.Map(), lblTwoName)
 }
 
 func TestAggregateDoesntAggregateMetricsWithDifferentLabels(t *testing.T) {
@@ -140,18 +142,18 @@ func TestAggregateDoesntAggregateMetricsWithDifferentLabels(t *testing.T) {
 	aggregated, err := Aggregate(metrics, aggregateSpec)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(aggregated))
-	require.NotContains(t, aggregated[0].LFM, table)
-	require.Contains(t, aggregated[0].LFM, lblOneName)
-	require.Contains(t, aggregated[0].LFM, lblTwoName)
-	require.NotContains(t, aggregated[1].LFM, table)
-	require.Contains(t, aggregated[1].LFM, lblOneName)
-	require.Contains(t, aggregated[1].LFM, lblTwoName)
+	require.NotContains(t, aggregated[0].Labels.Map(), table)
+	require.Contains(t, aggregated[0].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[0].Labels.Map(), lblTwoName)
+	require.NotContains(t, aggregated[1].Labels.Map(), table)
+	require.Contains(t, aggregated[1].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[1].Labels.Map(), lblTwoName)
 	valueOne := aggregated[0].Value
 	valueTwo := aggregated[1].Value
 	if valueOne == 10.0 {
-		require.Contains(t, aggregated[0].LFM, lblThreeName)
+		require.Contains(t, aggregated[0].Labels.Map(), lblThreeName)
 	} else {
-		require.Contains(t, aggregated[1].LFM, lblThreeName)
+		require.Contains(t, aggregated[1].Labels.Map(), lblThreeName)
 	}
 	require.True(t, valueOne == 10 || valueOne == 13)
 	require.True(t, valueTwo == 10 || valueTwo == 13)
@@ -212,12 +214,12 @@ func TestAggregateNilAggregateSpecHasNoEffect(t *testing.T) {
 	aggregated, err := Aggregate(metrics, nil)
 	require.NoError(t, err)
 	require.Equal(t, 2, len(aggregated))
-	require.Contains(t, aggregated[0].LFM, table)
-	require.Contains(t, aggregated[0].LFM, lblOneName)
-	require.Contains(t, aggregated[0].LFM, lblTwoName)
-	require.Contains(t, aggregated[1].LFM, table)
-	require.Contains(t, aggregated[1].LFM, lblOneName)
-	require.Contains(t, aggregated[1].LFM, lblTwoName)
+	require.Contains(t, aggregated[0].Labels.Map(), table)
+	require.Contains(t, aggregated[0].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[0].Labels.Map(), lblTwoName)
+	require.Contains(t, aggregated[1].Labels.Map(), table)
+	require.Contains(t, aggregated[1].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[1].Labels.Map(), lblTwoName)
 	valueOne := aggregated[0].Value
 	valueTwo := aggregated[1].Value
 	require.True(t, valueOne == 10 || valueOne == 13)
@@ -292,7 +294,82 @@ func TestAggregateOverTwoMetricsAndTwoLabels(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 1, len(aggregated))
 	require.Equal(t, 23.0, aggregated[0].Value)
-	require.NotContains(t, aggregated[0].LFM, table)
-	require.Contains(t, aggregated[0].LFM, lblOneName)
-	require.Contains(t, aggregated[0].LFM, lblTwoName)
+	require.NotContains(t, aggregated[0].Labels.Map(), table)
+	require.Contains(t, aggregated[0].Labels.Map(), lblOneName)
+	require.Contains(t, aggregated[0].Labels.Map(), lblTwoName)
+}
+
+func TestAggregateOps(t *testing.T) {
+	gauge := dto.MetricType_GAUGE
+	family := func() []*dto.MetricFamily {
+		mf := &dto.MetricFamily{Name: proto.String("gpu_util_percent"), Type: &gauge}
+		for i, v := range []float64{20, 60, 40} {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{{Name: proto.String("partition"), Value: proto.String(strconv.Itoa(i))}},
+				Gauge: &dto.Gauge{Value: proto.Float64(v)},
+			})
+		}
+		return []*dto.MetricFamily{mf}
+	}
+	spec := map[string][]string{"gpu_util_percent": {"partition"}}
+
+	for op, want := range map[Op]float64{Sum: 120, Avg: 40, Min: 20, Max: 60, Count: 3} {
+		aggregated, err := Aggregate(family(), spec, WithOps(map[string]Op{"gpu_util_percent": op}))
+		require.NoError(t, err)
+		require.Len(t, aggregated, 1)
+		require.Equal(t, want, aggregated[0].Value, op)
+	}
+
+	aggregated, err := Aggregate(family(), spec, WithOps(map[string]Op{"gpu_util_percent": Last}))
+	require.NoError(t, err)
+	require.Equal(t, 40.0, aggregated[0].Value)
+}
+
+func TestParseOp(t *testing.T) {
+	op, err := ParseOp("avg")
+	require.NoError(t, err)
+	require.Equal(t, Avg, op)
+
+	_, err = ParseOp("median")
+	require.Error(t, err)
+}
+
+// benchmarkFamilies returns families with n series in total, 5 labels each,
+// like a scrape of a large exporter
+func benchmarkFamilies(n int) []*dto.MetricFamily {
+	gauge := dto.MetricType_GAUGE
+	var mfs []*dto.MetricFamily
+	for f := 0; f < 50; f++ {
+		mf := &dto.MetricFamily{Name: proto.String("bench_metric_" + strconv.Itoa(f)), Type: &gauge}
+		for i := 0; i < n/50; i++ {
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{
+					{Name: proto.String("instance"), Value: proto.String("10.0.0." + strconv.Itoa(i%16))},
+					{Name: proto.String("job"), Value: proto.String("exporter")},
+					{Name: proto.String("pod"), Value: proto.String("pod-" + strconv.Itoa(i))},
+					{Name: proto.String(table), Value: proto.String("table_" + strconv.Itoa(i%100))},
+					{Name: proto.String("user_id"), Value: proto.String("123456")},
+				},
+				Gauge: &dto.Gauge{Value: proto.Float64(float64(i))},
+			})
+		}
+		mfs = append(mfs, mf)
+	}
+	return mfs
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	mfs := benchmarkFamilies(50000)
+	spec := map[string][]string{}
+	for _, mf := range mfs[:25] {
+		spec[mf.GetName()] = []string{"pod"}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Aggregate(mfs, spec); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
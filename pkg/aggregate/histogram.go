@@ -0,0 +1,252 @@
+package aggregate
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+const (
+	bucketLabel   = "le"
+	quantileLabel = "quantile"
+	nameLabel     = "__name__"
+)
+
+// bucket is a cumulative histogram bucket
+type bucket struct {
+	upperBound float64
+	count      float64
+}
+
+// histogramGroup collects the histograms which are aggregated into one
+type histogramGroup struct {
+	labels     tsclient.LabelSet
+	count, sum float64
+	series     [][]bucket
+}
+
+// aggregateHistograms aggregates the histograms of mf and passes the
+// flattened series to add. Histograms whose buckets differ are merged on the
+// union of their bucket boundaries, counting each histogram up to its largest
+// boundary below each one. Histograms without classic buckets, such as
+// native histograms, only produce _sum and _count
+func aggregateHistograms(mf *dto.MetricFamily, labelsToRemove []string, quantiles []float64, add func(tsclient.LabelSet, float64)) {
+	var b tsclient.LabelSetBuilder
+	groups := map[uint64][]*histogramGroup{}
+	var ordered []*histogramGroup
+	find := func() *histogramGroup {
+		h := b.Hash()
+		for _, g := range groups[h] {
+			if b.Equal(g.labels) {
+				return g
+			}
+		}
+		g := &histogramGroup{labels: b.LabelSet()}
+		groups[h] = append(groups[h], g)
+		ordered = append(ordered, g)
+		return g
+	}
+
+	for _, metric := range mf.Metric {
+		h := metric.GetHistogram()
+		if h == nil {
+			continue
+		}
+		metricLabels(&b, mf.GetName(), metric.Label, labelsToRemove)
+		g := find()
+
+		count := float64(h.GetSampleCount())
+		if h.SampleCountFloat != nil {
+			count = h.GetSampleCountFloat()
+		}
+		g.count += count
+		g.sum += h.GetSampleSum()
+
+		var buckets []bucket
+		for _, b := range h.Bucket {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				continue
+			}
+			c := float64(b.GetCumulativeCount())
+			if b.CumulativeCountFloat != nil {
+				c = b.GetCumulativeCountFloat()
+			}
+			buckets = append(buckets, bucket{upperBound: b.GetUpperBound(), count: c})
+		}
+		if len(buckets) > 0 {
+			g.series = append(g.series, buckets)
+		}
+	}
+
+	for _, g := range ordered {
+		add(withName(g.labels, mf.GetName()+"_sum", "", ""), g.sum)
+		add(withName(g.labels, mf.GetName()+"_count", "", ""), g.count)
+		if len(g.series) == 0 {
+			continue
+		}
+
+		buckets := mergeBuckets(g.series)
+		if len(quantiles) > 0 {
+			for _, q := range quantiles {
+				v := bucketQuantile(q, buckets, g.count)
+				if math.IsNaN(v) {
+					continue
+				}
+				add(withName(g.labels, mf.GetName(), quantileLabel, formatFloat(q)), v)
+			}
+			continue
+		}
+
+		for _, b := range buckets {
+			add(withName(g.labels, mf.GetName()+"_bucket", bucketLabel, formatFloat(b.upperBound)), b.count)
+		}
+		add(withName(g.labels, mf.GetName()+"_bucket", bucketLabel, "+Inf"), g.count)
+	}
+}
+
+// mergeBuckets merges cumulative buckets on the union of their boundaries
+func mergeBuckets(series [][]bucket) []bucket {
+	var bounds []float64
+	seen := map[float64]bool{}
+	for _, buckets := range series {
+		for _, b := range buckets {
+			if !seen[b.upperBound] {
+				seen[b.upperBound] = true
+				bounds = append(bounds, b.upperBound)
+			}
+		}
+	}
+	sort.Float64s(bounds)
+
+	merged := make([]bucket, len(bounds))
+	for i, bound := range bounds {
+		merged[i].upperBound = bound
+		for _, buckets := range series {
+			merged[i].count += countAt(buckets, bound)
+		}
+	}
+	return merged
+}
+
+// countAt returns the cumulative count of the largest bucket whose boundary is
+// not above bound. Buckets are sorted by their boundaries
+func countAt(buckets []bucket, bound float64) float64 {
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].upperBound > bound })
+	if i == 0 {
+		return 0
+	}
+	return buckets[i-1].count
+}
+
+// bucketQuantile estimates the q quantile from cumulative buckets by linear
+// interpolation within the bucket it falls into, like histogram_quantile in
+// Prometheus. Quantiles in the +Inf bucket are reported as the largest finite
+// boundary
+func bucketQuantile(q float64, buckets []bucket, count float64) float64 {
+	switch {
+	case math.IsNaN(q) || q < 0 || q > 1 || count == 0 || len(buckets) == 0:
+		return math.NaN()
+	}
+
+	rank := q * count
+	i := sort.Search(len(buckets), func(i int) bool { return buckets[i].count >= rank })
+	if i == len(buckets) {
+		return buckets[len(buckets)-1].upperBound
+	}
+	if i == 0 && buckets[0].upperBound <= 0 {
+		return buckets[0].upperBound
+	}
+
+	var start, prevCount float64
+	if i > 0 {
+		start, prevCount = buckets[i-1].upperBound, buckets[i-1].count
+	}
+	inBucket := buckets[i].count - prevCount
+	if inBucket == 0 {
+		return buckets[i].upperBound
+	}
+	return start + (buckets[i].upperBound-start)*(rank-prevCount)/inBucket
+}
+
+// summaryGroup collects the summaries which are aggregated into one
+type summaryGroup struct {
+	labels     tsclient.LabelSet
+	count, sum float64
+	quantiles  []*dto.Quantile
+	n          int
+}
+
+// aggregateSummaries aggregates the summaries of mf and passes the flattened
+// series to add. Quantiles can not be aggregated, so they are only kept for
+// summaries which are not aggregated with others
+func aggregateSummaries(mf *dto.MetricFamily, labelsToRemove []string, add func(tsclient.LabelSet, float64)) {
+	var b tsclient.LabelSetBuilder
+	groups := map[uint64][]*summaryGroup{}
+	var ordered []*summaryGroup
+	find := func() *summaryGroup {
+		h := b.Hash()
+		for _, g := range groups[h] {
+			if b.Equal(g.labels) {
+				return g
+			}
+		}
+		g := &summaryGroup{labels: b.LabelSet()}
+		groups[h] = append(groups[h], g)
+		ordered = append(ordered, g)
+		return g
+	}
+
+	for _, metric := range mf.Metric {
+		s := metric.GetSummary()
+		if s == nil {
+			continue
+		}
+		metricLabels(&b, mf.GetName(), metric.Label, labelsToRemove)
+		g := find()
+		g.count += float64(s.GetSampleCount())
+		g.sum += s.GetSampleSum()
+		g.quantiles = s.Quantile
+		g.n++
+	}
+
+	for _, g := range ordered {
+		add(withName(g.labels, mf.GetName()+"_sum", "", ""), g.sum)
+		add(withName(g.labels, mf.GetName()+"_count", "", ""), g.count)
+		if g.n > 1 {
+			continue
+		}
+		for _, q := range g.quantiles {
+			if math.IsNaN(q.GetValue()) {
+				continue
+			}
+			add(withName(g.labels, mf.GetName(), quantileLabel, formatFloat(q.GetQuantile())), q.GetValue())
+		}
+	}
+}
+
+// withName returns a copy of labels with the given name and optionally an
+// additional label
+func withName(labels tsclient.LabelSet, name, label, value string) tsclient.LabelSet {
+	var b tsclient.LabelSetBuilder
+	for _, l := range labels.Labels() {
+		b.Set(l.Name, l.Value)
+	}
+	b.Set(nameLabel, name)
+	if label != "" {
+		b.Set(label, value)
+	}
+	return b.LabelSet()
+}
+
+// formatFloat formats bucket boundaries and quantiles like the Prometheus
+// exposition formats
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,179 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func histogram(instance string, count uint64, sum float64, buckets map[float64]uint64) *dto.Metric {
+	h := &dto.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum)}
+	for _, ub := range []float64{0.1, 0.5, 1, 5, math.Inf(+1)} {
+		if c, ok := buckets[ub]; ok {
+			h.Bucket = append(h.Bucket, &dto.Bucket{UpperBound: proto.Float64(ub), CumulativeCount: proto.Uint64(c)})
+		}
+	}
+	return &dto.Metric{
+		Label: []*dto.LabelPair{
+			{Name: proto.String("instance"), Value: proto.String(instance)},
+			{Name: proto.String("method"), Value: proto.String("GET")},
+		},
+		Histogram: h,
+	}
+}
+
+func histogramFamily(metrics ...*dto.Metric) []*dto.MetricFamily {
+	typ := dto.MetricType_HISTOGRAM
+	return []*dto.MetricFamily{{Name: proto.String("request_seconds"), Type: &typ, Metric: metrics}}
+}
+
+func byLabels(mets []MetricWithValue, labels ...string) map[string]float64 {
+	out := map[string]float64{}
+	for _, m := range mets {
+		key := m.Labels.Get("__name__")
+		for _, l := range labels {
+			if v, ok := m.Labels.Lookup(l); ok {
+				key += "{" + l + "=" + v + "}"
+			}
+		}
+		out[key] = m.Value
+	}
+	return out
+}
+
+func TestAggregateHistograms(t *testing.T) {
+	mfs := histogramFamily(
+		histogram("a", 10, 4, map[float64]uint64{0.1: 2, 0.5: 6, 1: 9, math.Inf(+1): 10}),
+		histogram("b", 4, 2, map[float64]uint64{0.1: 1, 0.5: 2, 1: 4, math.Inf(+1): 4}),
+	)
+
+	mets, err := Aggregate(mfs, nil)
+	require.NoError(t, err)
+	require.Len(t, mets, 2*6)
+	for _, m := range mets {
+		require.Equal(t, "GET", m.Labels.Get("method"))
+	}
+
+	mets, err = Aggregate(mfs, map[string][]string{"request_seconds": {"instance"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{
+		"request_seconds_sum":             6,
+		"request_seconds_count":           14,
+		"request_seconds_bucket{le=0.1}":  3,
+		"request_seconds_bucket{le=0.5}":  8,
+		"request_seconds_bucket{le=1}":    13,
+		"request_seconds_bucket{le=+Inf}": 14,
+	}, byLabels(mets, "le"))
+}
+
+func TestAggregateHistogramsWithDifferentBuckets(t *testing.T) {
+	mfs := histogramFamily(
+		histogram("a", 10, 4, map[float64]uint64{0.1: 2, 1: 9, math.Inf(+1): 10}),
+		histogram("b", 4, 2, map[float64]uint64{0.5: 2, 5: 4, math.Inf(+1): 4}),
+	)
+
+	mets, err := Aggregate(mfs, map[string][]string{"request_seconds": {"instance"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{
+		"request_seconds_sum":             6,
+		"request_seconds_count":           14,
+		"request_seconds_bucket{le=0.1}":  2,
+		"request_seconds_bucket{le=0.5}":  4,
+		"request_seconds_bucket{le=1}":    11,
+		"request_seconds_bucket{le=5}":    13,
+		"request_seconds_bucket{le=+Inf}": 14,
+	}, byLabels(mets, "le"))
+}
+
+func TestAggregateHistogramQuantiles(t *testing.T) {
+	mfs := histogramFamily(
+		histogram("a", 100, 40, map[float64]uint64{0.1: 50, 0.5: 90, 1: 98, math.Inf(+1): 100}),
+	)
+
+	mets, err := Aggregate(mfs, map[string][]string{"request_seconds": {"instance"}},
+		WithHistogramQuantiles(map[string][]float64{"request_seconds": {0.5, 0.95, 0.99}}))
+	require.NoError(t, err)
+
+	got := byLabels(mets, "quantile", "le")
+	require.NotContains(t, got, "request_seconds_bucket{le=+Inf}")
+	require.Equal(t, 100.0, got["request_seconds_count"])
+	require.InDelta(t, 0.1, got["request_seconds{quantile=0.5}"], 1e-9)
+	require.InDelta(t, 0.8125, got["request_seconds{quantile=0.95}"], 1e-9)
+	// ranks in the +Inf bucket are reported as the largest finite boundary
+	require.InDelta(t, 1, got["request_seconds{quantile=0.99}"], 1e-9)
+}
+
+func TestBucketQuantile(t *testing.T) {
+	buckets := []bucket{{1, 10}, {2, 20}}
+	require.InDelta(t, 0.5, bucketQuantile(0.25, buckets, 20), 1e-9)
+	require.InDelta(t, 1.5, bucketQuantile(0.75, buckets, 20), 1e-9)
+	require.True(t, math.IsNaN(bucketQuantile(0.5, buckets, 0)))
+	require.True(t, math.IsNaN(bucketQuantile(1.5, buckets, 20)))
+	require.Equal(t, -1.0, bucketQuantile(0.1, []bucket{{-1, 5}, {0, 10}}, 10))
+}
+
+func TestAggregateNativeHistogramsWithoutBuckets(t *testing.T) {
+	m := histogram("a", 3, 1.5, nil)
+	m.Histogram.Schema = proto.Int32(3)
+	mets, err := Aggregate(histogramFamily(m), nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"request_seconds_sum": 1.5, "request_seconds_count": 3}, byLabels(mets))
+}
+
+func TestAggregateSummaries(t *testing.T) {
+	typ := dto.MetricType_SUMMARY
+	summary := func(instance string, count uint64, sum, p50 float64) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{{Name: proto.String("instance"), Value: proto.String(instance)}},
+			Summary: &dto.Summary{
+				SampleCount: proto.Uint64(count),
+				SampleSum:   proto.Float64(sum),
+				Quantile: []*dto.Quantile{
+					{Quantile: proto.Float64(0.5), Value: proto.Float64(p50)},
+					{Quantile: proto.Float64(0.99), Value: proto.Float64(math.NaN())},
+				},
+			},
+		}
+	}
+	mfs := []*dto.MetricFamily{{
+		Name:   proto.String("rpc_seconds"),
+		Type:   &typ,
+		Metric: []*dto.Metric{summary("a", 5, 1, 0.2), summary("b", 3, 2, 0.4)},
+	}}
+
+	mets, err := Aggregate(mfs, nil)
+	require.NoError(t, err)
+	got := byLabels(mets, "instance", "quantile")
+	require.Equal(t, map[string]float64{
+		"rpc_seconds_sum{instance=a}":           1,
+		"rpc_seconds_count{instance=a}":         5,
+		"rpc_seconds{instance=a}{quantile=0.5}": 0.2,
+		"rpc_seconds_sum{instance=b}":           2,
+		"rpc_seconds_count{instance=b}":         3,
+		"rpc_seconds{instance=b}{quantile=0.5}": 0.4,
+	}, got)
+
+	// quantiles of different summaries can not be combined
+	mets, err = Aggregate(mfs, map[string][]string{"rpc_seconds": {"instance"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"rpc_seconds_sum": 3, "rpc_seconds_count": 8}, byLabels(mets, "quantile"))
+}
+
+func TestAggregateHistogramsWithBucketSpec(t *testing.T) {
+	mfs := histogramFamily(
+		histogram("a", 10, 4, map[float64]uint64{1: 9, math.Inf(+1): 10}),
+		histogram("b", 4, 2, map[float64]uint64{1: 4, math.Inf(+1): 4}),
+	)
+
+	mets, err := Aggregate(mfs, map[string][]string{"request_seconds_bucket": {"instance"}})
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{
+		"request_seconds_sum":             6,
+		"request_seconds_count":           14,
+		"request_seconds_bucket{le=1}":    13,
+		"request_seconds_bucket{le=+Inf}": 14,
+	}, byLabels(mets, "le"))
+}
@@ -0,0 +1,162 @@
+package aggregate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// RateOp is the conversion applied to the values of a counter
+type RateOp string
+
+const (
+	// RateOpRate is the per-second increase since the previous value
+	RateOpRate RateOp = "rate"
+	// RateOpDelta is the increase since the previous value
+	RateOpDelta RateOp = "delta"
+)
+
+// RateOps returns the names of all counter conversions
+func RateOps() []string {
+	return []string{string(RateOpRate), string(RateOpDelta)}
+}
+
+// ParseRateOp parses the name of a counter conversion
+func ParseRateOp(s string) (RateOp, error) {
+	switch op := RateOp(strings.TrimSpace(s)); op {
+	case RateOpRate, RateOpDelta:
+		return op, nil
+	default:
+		return "", fmt.Errorf("unknown counter conversion %q, must be one of %s", s, strings.Join(RateOps(), ", "))
+	}
+}
+
+// Rates converts counters into gauges of their per-second rate or delta since
+// the previous conversion, so sinks receive directly usable numbers.
+//
+// The first value of a series only records it and is not sent. A value below
+// the previous one is a counter reset, the counter is assumed to have started
+// over from zero. Series which are missing from a conversion are forgotten and
+// start over with their next value
+type Rates struct {
+	rules map[string]RateOp
+
+	m      sync.Mutex
+	series map[string]ratePoint
+}
+
+// ratePoint is the previous value of a series
+type ratePoint struct {
+	value float64
+	ts    time.Time
+}
+
+// NewRates creates Rates converting the counter and untyped families in rules.
+// A nil Rates converts nothing
+func NewRates(rules map[string]RateOp) *Rates {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &Rates{
+		rules:  rules,
+		series: map[string]ratePoint{},
+	}
+}
+
+// Converts returns true if the family name has a rule
+func (r *Rates) Converts(name string) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.rules[name]
+	return ok
+}
+
+// Convert replaces the families in mfs with a rule by gauges of their rate or
+// delta. Values without a timestamp are taken to be from now
+func (r *Rates) Convert(mfs []*dto.MetricFamily, now time.Time) []*dto.MetricFamily {
+	if r == nil {
+		return mfs
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	seen := make(map[string]ratePoint, len(r.series))
+	for _, mf := range mfs {
+		op, ok := r.rules[mf.GetName()]
+		if !ok {
+			continue
+		}
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER, dto.MetricType_UNTYPED:
+		default:
+			continue
+		}
+
+		metrics := mf.Metric[:0]
+		for _, m := range mf.Metric {
+			cur := ratePoint{value: counterValue(m), ts: now}
+			if m.TimestampMs != nil {
+				cur.ts = time.UnixMilli(m.GetTimestampMs())
+			}
+
+			key := mf.GetName() + "\xff" + seriesKey(sortedLabels(m.Label))
+			prev, ok := r.series[key]
+			seen[key] = cur
+			if !ok {
+				continue
+			}
+			elapsed := cur.ts.Sub(prev.ts).Seconds()
+			if elapsed <= 0 {
+				// keep the earlier value so the next rate covers the whole interval
+				seen[key] = prev
+				continue
+			}
+
+			delta := cur.value - prev.value
+			if delta < 0 {
+				delta = cur.value
+			}
+			v := delta
+			if op == RateOpRate {
+				v = delta / elapsed
+			}
+			metrics = append(metrics, &dto.Metric{
+				Label:       m.Label,
+				Gauge:       &dto.Gauge{Value: proto.Float64(v)},
+				TimestampMs: m.TimestampMs,
+			})
+		}
+
+		gauge := dto.MetricType_GAUGE
+		mf.Type = &gauge
+		mf.Metric = metrics
+		if mf.Help != nil {
+			mf.Help = proto.String(fmt.Sprintf("%s (%s)", mf.GetHelp(), op))
+		}
+	}
+	r.series = seen
+	return mfs
+}
+
+// counterValue returns the value of a counter or untyped metric
+func counterValue(m *dto.Metric) float64 {
+	if m.Counter != nil {
+		return m.Counter.GetValue()
+	}
+	return m.GetUntyped().GetValue()
+}
+
+// sortedLabels returns a sorted copy of labels
+func sortedLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	out := make([]*dto.LabelPair, len(labels))
+	copy(out, labels)
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+	return out
+}
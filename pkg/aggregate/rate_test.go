@@ -0,0 +1,98 @@
+package aggregate
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func counterFamily(name string, values map[string]float64) *dto.MetricFamily {
+	counter := dto.MetricType_COUNTER
+	mf := &dto.MetricFamily{Name: proto.String(name), Help: proto.String("bytes received."), Type: &counter}
+	for device, v := range values {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label:   []*dto.LabelPair{{Name: proto.String("device"), Value: proto.String(device)}},
+			Counter: &dto.Counter{Value: proto.Float64(v)},
+		})
+	}
+	return mf
+}
+
+func values(mf *dto.MetricFamily) map[string]float64 {
+	out := map[string]float64{}
+	for _, m := range mf.Metric {
+		out[m.Label[0].GetValue()] = m.GetGauge().GetValue()
+	}
+	return out
+}
+
+func TestRates(t *testing.T) {
+	r := NewRates(map[string]RateOp{"rx_bytes": RateOpRate, "tx_bytes": RateOpDelta})
+	start := time.Unix(1000, 0)
+
+	mfs := r.Convert([]*dto.MetricFamily{
+		counterFamily("rx_bytes", map[string]float64{"eth0": 100, "eth1": 50}),
+		counterFamily("tx_bytes", map[string]float64{"eth0": 10}),
+		counterFamily("other", map[string]float64{"eth0": 1}),
+	}, start)
+	// first values are only recorded
+	require.Empty(t, mfs[0].Metric)
+	require.Equal(t, dto.MetricType_GAUGE, mfs[0].GetType())
+	require.Equal(t, "bytes received. (rate)", mfs[0].GetHelp())
+	require.Empty(t, mfs[1].Metric)
+	require.Equal(t, dto.MetricType_COUNTER, mfs[2].GetType())
+
+	mfs = r.Convert([]*dto.MetricFamily{
+		counterFamily("rx_bytes", map[string]float64{"eth0": 700, "eth1": 20}),
+		counterFamily("tx_bytes", map[string]float64{"eth0": 40}),
+	}, start.Add(time.Minute))
+	// eth1 was reset and counted 20 since
+	require.Equal(t, map[string]float64{"eth0": 10, "eth1": 20.0 / 60}, values(mfs[0]))
+	require.Equal(t, map[string]float64{"eth0": 30}, values(mfs[1]))
+
+	// vanished series start over
+	mfs = r.Convert([]*dto.MetricFamily{
+		counterFamily("rx_bytes", map[string]float64{"eth0": 1300}),
+	}, start.Add(2*time.Minute))
+	require.Equal(t, map[string]float64{"eth0": 10}, values(mfs[0]))
+	mfs = r.Convert([]*dto.MetricFamily{
+		counterFamily("tx_bytes", map[string]float64{"eth0": 50}),
+	}, start.Add(3*time.Minute))
+	require.Empty(t, mfs[0].Metric)
+}
+
+func TestRatesUseTimestamps(t *testing.T) {
+	r := NewRates(map[string]RateOp{"rx_bytes": RateOpRate})
+	withTimestamp := func(v float64, ts int64) []*dto.MetricFamily {
+		mf := counterFamily("rx_bytes", map[string]float64{"eth0": v})
+		mf.Metric[0].TimestampMs = proto.Int64(ts)
+		return []*dto.MetricFamily{mf}
+	}
+
+	now := time.Unix(5000, 0)
+	r.Convert(withTimestamp(0, 1000), now)
+	// the same value again does not produce a rate
+	mfs := r.Convert(withTimestamp(0, 1000), now)
+	require.Empty(t, mfs[0].Metric)
+	mfs = r.Convert(withTimestamp(30, 11000), now)
+	require.Equal(t, map[string]float64{"eth0": 3}, values(mfs[0]))
+}
+
+func TestNilRates(t *testing.T) {
+	r := NewRates(nil)
+	require.Nil(t, r)
+	mfs := []*dto.MetricFamily{counterFamily("rx_bytes", map[string]float64{"eth0": 1})}
+	require.Equal(t, mfs, r.Convert(mfs, time.Now()))
+}
+
+func TestParseRateOp(t *testing.T) {
+	op, err := ParseRateOp(" delta")
+	require.NoError(t, err)
+	require.Equal(t, RateOpDelta, op)
+
+	_, err = ParseRateOp("irate")
+	require.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// RollupOp is a statistic computed over the samples of a gauge
+type RollupOp string
+
+const (
+	// RollupAvg is the average of all samples
+	RollupAvg RollupOp = "avg"
+	// RollupMax is the largest sample
+	RollupMax RollupOp = "max"
+	// RollupMin is the smallest sample
+	RollupMin RollupOp = "min"
+)
+
+// RollupOps returns the names of all rollup operations
+func RollupOps() []string {
+	return []string{string(RollupAvg), string(RollupMax), string(RollupMin)}
+}
+
+// ParseRollupOps parses a comma separated list of rollup operations
+func ParseRollupOps(s string) ([]RollupOp, error) {
+	var ops []RollupOp
+	for _, op := range strings.Split(s, ",") {
+		switch o := RollupOp(strings.TrimSpace(op)); o {
+		case RollupAvg, RollupMax, RollupMin:
+			ops = append(ops, o)
+		default:
+			return nil, fmt.Errorf("unknown rollup operation %q, must be one of %s", op, strings.Join(RollupOps(), ", "))
+		}
+	}
+	return ops, nil
+}
+
+// Rollup rolls the samples gauges take between sends up into series named
+// <name>_<op>, so short spikes remain visible at a lower send frequency.
+//
+// Each sample is aggregated with the aggregate spec and operations before it
+// is rolled up, so the rolled up series are for example the smallest total
+// across all CPUs rather than the sum of the smallest value of every CPU
+type Rollup struct {
+	rules map[string][]RollupOp
+	spec  map[string][]string
+	ops   map[string]Op
+
+	m      sync.Mutex
+	series map[string]map[string]*rollupSeries
+}
+
+// sampleAccumulator combines the series of a sample aggregated into one
+type sampleAccumulator struct {
+	accumulator
+	labels []*dto.LabelPair
+}
+
+// rollupSeries accumulates the samples of a single series
+type rollupSeries struct {
+	labels   []*dto.LabelPair
+	sum      float64
+	min, max float64
+	count    int
+}
+
+func (s *rollupSeries) add(v float64) {
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	s.sum += v
+	s.count++
+}
+
+func (s *rollupSeries) value(op RollupOp) float64 {
+	switch op {
+	case RollupMax:
+		return s.max
+	case RollupMin:
+		return s.min
+	default:
+		return s.sum / float64(s.count)
+	}
+}
+
+// NewRollup creates a Rollup computing the given operations for each gauge
+// family in rules. Aggregation operations set with WithOps are applied when
+// aggregating samples
+func NewRollup(rules map[string][]RollupOp, aggregateSpec map[string][]string, opts ...Option) *Rollup {
+	defOpts := aggregateOpts{}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	return &Rollup{
+		rules:  rules,
+		spec:   aggregateSpec,
+		ops:    defOpts.ops,
+		series: map[string]map[string]*rollupSeries{},
+	}
+}
+
+// Observe records a sample of every gauge family with a rule
+func (r *Rollup) Observe(mfs []*dto.MetricFamily) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	for _, mf := range mfs {
+		if _, ok := r.rules[mf.GetName()]; !ok || mf.GetType() != dto.MetricType_GAUGE {
+			continue
+		}
+
+		totals := r.aggregateSample(mf)
+		series, ok := r.series[mf.GetName()]
+		if !ok {
+			series = map[string]*rollupSeries{}
+			r.series[mf.GetName()] = series
+		}
+		op := r.ops[mf.GetName()]
+		for key, total := range totals {
+			v := total.value(op)
+			if math.IsNaN(v) {
+				continue
+			}
+			s, ok := series[key]
+			if !ok {
+				// samples are kept past the lifetime of the families they came from
+				s = &rollupSeries{labels: cloneLabels(total.labels)}
+				series[key] = s
+			}
+			s.add(v)
+		}
+	}
+}
+
+// aggregateSample combines the series of a family which only differ by labels
+// the aggregate spec removes
+func (r *Rollup) aggregateSample(mf *dto.MetricFamily) map[string]*sampleAccumulator {
+	drop := map[string]bool{}
+	for _, l := range r.spec[mf.GetName()] {
+		drop[l] = true
+	}
+
+	totals := map[string]*sampleAccumulator{}
+	for _, m := range mf.Metric {
+		var labels []*dto.LabelPair
+		for _, l := range m.Label {
+			if !drop[l.GetName()] {
+				labels = append(labels, l)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+
+		key := seriesKey(labels)
+		t, ok := totals[key]
+		if !ok {
+			t = &sampleAccumulator{labels: labels}
+			totals[key] = t
+		}
+		t.add(m.GetGauge().GetValue())
+	}
+	return totals
+}
+
+// Flush records mfs as the last sample, appends the rolled up families to
+// them and starts over
+func (r *Rollup) Flush(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	r.Observe(mfs)
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	names := make([]string, 0, len(r.series))
+	for name := range r.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gauge := dto.MetricType_GAUGE
+	for _, name := range names {
+		series := r.series[name]
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, op := range r.rules[name] {
+			mf := &dto.MetricFamily{
+				Name: proto.String(name + "_" + string(op)),
+				Help: proto.String(fmt.Sprintf("%s of %s since the previous send.", op, name)),
+				Type: &gauge,
+			}
+			for _, key := range keys {
+				s := series[key]
+				mf.Metric = append(mf.Metric, &dto.Metric{
+					Label: cloneLabels(s.labels),
+					Gauge: &dto.Gauge{Value: proto.Float64(s.value(op))},
+				})
+			}
+			mfs = append(mfs, mf)
+		}
+	}
+
+	r.series = map[string]map[string]*rollupSeries{}
+	return mfs
+}
+
+func cloneLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	out := make([]*dto.LabelPair, len(labels))
+	for i, l := range labels {
+		out[i] = proto.Clone(l).(*dto.LabelPair)
+	}
+	return out
+}
+
+// seriesKey identifies a series by its sorted labels
+func seriesKey(labels []*dto.LabelPair) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.GetName())
+		sb.WriteByte(0)
+		sb.WriteString(l.GetValue())
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
@@ -0,0 +1,88 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func gaugeFamily(name string, values map[string]float64) *dto.MetricFamily {
+	gauge := dto.MetricType_GAUGE
+	mf := &dto.MetricFamily{Name: proto.String(name), Type: &gauge}
+	for cpu, v := range values {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("mode"), Value: proto.String("user")},
+				{Name: proto.String("cpu"), Value: proto.String(cpu)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(v)},
+		})
+	}
+	return mf
+}
+
+func TestRollup(t *testing.T) {
+	r := NewRollup(map[string][]RollupOp{
+		"sonar_cpu": {RollupMin, RollupMax, RollupAvg},
+	}, map[string][]string{"sonar_cpu": {"cpu"}})
+
+	r.Observe([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": 1, "1": 2})})
+	r.Observe([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": 5, "1": 4})})
+	r.Observe([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": math.NaN()})})
+	r.Observe([]*dto.MetricFamily{gaugeFamily("sonar_other", map[string]float64{"0": 100})})
+
+	mfs := r.Flush([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": 3, "1": 3})})
+	mets, err := Aggregate(mfs, map[string][]string{"sonar_cpu": {"cpu"}})
+	require.NoError(t, err)
+
+	values := map[string]float64{}
+	for _, m := range mets {
+		require.Equal(t, "user", m.Labels.Get("mode"))
+		require.NotContains(t, m.Labels.Map(), "cpu")
+		values[m.Labels.Get("__name__")] = m.Value
+	}
+	require.Equal(t, map[string]float64{
+		"sonar_cpu":     6,
+		"sonar_cpu_min": 3,
+		"sonar_cpu_max": 9,
+		"sonar_cpu_avg": 6,
+	}, values)
+
+	// every flush starts over
+	mfs = r.Flush(nil)
+	require.Empty(t, mfs)
+}
+
+func TestRollupIgnoresOtherTypes(t *testing.T) {
+	r := NewRollup(map[string][]RollupOp{"requests": {RollupMax}}, nil)
+	counter := dto.MetricType_COUNTER
+	mfs := r.Flush([]*dto.MetricFamily{{
+		Name:   proto.String("requests"),
+		Type:   &counter,
+		Metric: []*dto.Metric{{Counter: &dto.Counter{Value: proto.Float64(1)}}},
+	}})
+	require.Len(t, mfs, 1)
+}
+
+func TestParseRollupOps(t *testing.T) {
+	ops, err := ParseRollupOps("min, max")
+	require.NoError(t, err)
+	require.Equal(t, []RollupOp{RollupMin, RollupMax}, ops)
+
+	_, err = ParseRollupOps("min,p99")
+	require.Error(t, err)
+}
+
+func TestRollupAppliesAggregationOps(t *testing.T) {
+	r := NewRollup(map[string][]RollupOp{"sonar_cpu": {RollupMax}},
+		map[string][]string{"sonar_cpu": {"cpu"}}, WithOps(map[string]Op{"sonar_cpu": Avg}))
+
+	r.Observe([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": 1, "1": 3})})
+	mfs := r.Flush([]*dto.MetricFamily{gaugeFamily("sonar_cpu", map[string]float64{"0": 5, "1": 7})})
+	require.Len(t, mfs, 2)
+	require.Equal(t, "sonar_cpu_max", mfs[1].GetName())
+	require.Equal(t, 6.0, mfs[1].Metric[0].GetGauge().GetValue())
+}
@@ -0,0 +1,44 @@
+package aggregate
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule describes how the series of a metric family are aggregated
+type Rule struct {
+	// Labels are removed from all series, combining series which only differ
+	// by them
+	Labels []string `yaml:"labels" json:"labels"`
+	// Op combines the values of the combined series, sum if empty
+	Op Op `yaml:"op" json:"op"`
+}
+
+// ReadSpecFile reads aggregation rules by metric family name from a YAML or
+// JSON file, for example
+//
+//	amd_gpu_prof_gui_util_percent:
+//	  labels: [gpu_partition_id]
+//	  op: avg
+func ReadSpecFile(path string) (map[string]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aggregation spec: %w", err)
+	}
+
+	rules := map[string]Rule{}
+	if err := yaml.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse aggregation spec %s: %w", path, err)
+	}
+	for name, rule := range rules {
+		if rule.Op == "" {
+			continue
+		}
+		if _, err := ParseOp(string(rule.Op)); err != nil {
+			return nil, fmt.Errorf("invalid aggregation spec for %q in %s: %w", name, path, err)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,41 @@
+package aggregate
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSpecFile(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "spec.yaml")
+	require.NoError(t, os.WriteFile(yamlFile, []byte(`
+amd_gpu_prof_gui_util_percent:
+  labels: [gpu_partition_id]
+  op: avg
+sonar_cpu:
+  labels: [cpu]
+`), 0600))
+	rules, err := ReadSpecFile(yamlFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]Rule{
+		"amd_gpu_prof_gui_util_percent": {Labels: []string{"gpu_partition_id"}, Op: Avg},
+		"sonar_cpu":                     {Labels: []string{"cpu"}},
+	}, rules)
+
+	jsonFile := filepath.Join(dir, "spec.json")
+	require.NoError(t, os.WriteFile(jsonFile, []byte(`{"temp": {"labels": ["sensor"], "op": "max"}}`), 0600))
+	rules, err = ReadSpecFile(jsonFile)
+	require.NoError(t, err)
+	require.Equal(t, map[string]Rule{"temp": {Labels: []string{"sensor"}, Op: Max}}, rules)
+
+	require.NoError(t, os.WriteFile(jsonFile, []byte(`{"temp": {"op": "median"}}`), 0600))
+	_, err = ReadSpecFile(jsonFile)
+	require.Error(t, err)
+
+	_, err = ReadSpecFile(filepath.Join(dir, "missing.yaml"))
+	require.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package aggregate
+
+import (
+	"math"
+	"sync"
+
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+// staleNaNBits is the bit pattern of the Prometheus staleness marker
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+// StaleNaN is the value Prometheus uses to mark a series as stale. It is a
+// NaN, so it is told apart from other NaN values with IsStaleNaN
+var StaleNaN = math.Float64frombits(staleNaNBits)
+
+// IsStaleNaN returns true if v is the staleness marker
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == staleNaNBits
+}
+
+// StaleTracker remembers the series sent in the previous interval so series
+// which disappear, like those of an exited process or a detached disk, end
+// with an explicit staleness marker instead of silently stopping.
+//
+// A nil StaleTracker marks nothing
+type StaleTracker struct {
+	m    sync.Mutex
+	prev []tsclient.LabelSet
+}
+
+// NewStaleTracker creates a new StaleTracker
+func NewStaleTracker() *StaleTracker {
+	return &StaleTracker{}
+}
+
+// Mark returns mets followed by a series valued StaleNaN for every series last
+// recorded with Sent which is missing from mets. A series is only marked stale
+// once, as long as the marked metrics are recorded with Sent
+func (t *StaleTracker) Mark(mets []MetricWithValue) []MetricWithValue {
+	if t == nil {
+		return mets
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	byHash := make(map[uint64][]tsclient.LabelSet, len(mets))
+	for _, m := range mets {
+		if !IsStaleNaN(m.Value) {
+			byHash[m.Labels.Hash()] = append(byHash[m.Labels.Hash()], m.Labels)
+		}
+	}
+
+	for _, ls := range t.prev {
+		if !containsLabelSet(byHash[ls.Hash()], ls) {
+			mets = append(mets, MetricWithValue{Labels: ls, Value: StaleNaN})
+		}
+	}
+	return mets
+}
+
+// Sent records the series of mets as sent, so the next Mark compares against
+// them. It is only called after a successful write so series which vanish
+// while writes fail are still marked stale once a write succeeds
+func (t *StaleTracker) Sent(mets []MetricWithValue) {
+	if t == nil {
+		return
+	}
+
+	cur := make([]tsclient.LabelSet, 0, len(mets))
+	for _, m := range mets {
+		if !IsStaleNaN(m.Value) {
+			cur = append(cur, m.Labels)
+		}
+	}
+
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.prev = cur
+}
+
+func containsLabelSet(sets []tsclient.LabelSet, ls tsclient.LabelSet) bool {
+	for _, s := range sets {
+		if s.Equal(ls) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package aggregate
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+func diskMetric(device string, v float64) MetricWithValue {
+	return MetricWithValue{
+		Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_disk_bytes_read", "device": device}),
+		Value:  v,
+	}
+}
+
+func TestStaleTracker(t *testing.T) {
+	st := NewStaleTracker()
+	mark := func(mets ...MetricWithValue) []MetricWithValue {
+		mets = st.Mark(mets)
+		st.Sent(mets)
+		return mets
+	}
+
+	mets := mark(diskMetric("sda", 1), diskMetric("sdb", 2))
+	require.Len(t, mets, 2)
+
+	// sdb was detached
+	mets = mark(diskMetric("sda", 3))
+	require.Len(t, mets, 2)
+	require.Equal(t, 3.0, mets[0].Value)
+	require.Equal(t, "sdb", mets[1].Labels.Get("device"))
+	require.True(t, IsStaleNaN(mets[1].Value))
+
+	// series are only marked stale once
+	mets = mark(diskMetric("sda", 4))
+	require.Len(t, mets, 1)
+
+	// reappearing series are tracked again
+	mark(diskMetric("sda", 5), diskMetric("sdb", 6))
+	mets = mark()
+	require.Len(t, mets, 2)
+	require.Equal(t, "sda", mets[0].Labels.Get("device"))
+	require.Equal(t, "sdb", mets[1].Labels.Get("device"))
+}
+
+func TestStaleTrackerKeepsMarkingUntilSent(t *testing.T) {
+	st := NewStaleTracker()
+	st.Sent([]MetricWithValue{diskMetric("sda", 1), diskMetric("sdb", 2)})
+
+	// the write of the first marker failed so sdb is marked again
+	for i := 0; i < 2; i++ {
+		mets := st.Mark([]MetricWithValue{diskMetric("sda", 3)})
+		require.Len(t, mets, 2)
+		require.True(t, IsStaleNaN(mets[1].Value))
+	}
+}
+
+func TestStaleTrackerNil(t *testing.T) {
+	var st *StaleTracker
+	mets := []MetricWithValue{diskMetric("sda", 1)}
+	require.Equal(t, mets, st.Mark(mets))
+	require.Empty(t, st.Mark(nil))
+	st.Sent(mets)
+}
+
+func TestIsStaleNaN(t *testing.T) {
+	require.True(t, math.IsNaN(StaleNaN))
+	require.True(t, IsStaleNaN(StaleNaN))
+	require.False(t, IsStaleNaN(math.NaN()))
+	require.False(t, IsStaleNaN(0))
+}
@@ -0,0 +1,348 @@
+// Package cardinality caps the number of series sent for metric families so
+// a single high-cardinality label can not push a whole batch over its limits
+package cardinality
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// OverflowValue replaces the values of the labels telling series apart in
+// the series excess series are folded into
+const OverflowValue = "__overflow__"
+
+type limiterOpts struct {
+	familyLimit  int
+	familyLimits map[string]int
+	totalLimit   int
+}
+
+// Option is used to configure optional limiter options.
+type Option func(o *limiterOpts)
+
+// WithFamilyLimit caps the series of every metric family. 0 means no limit
+func WithFamilyLimit(n int) Option {
+	return func(o *limiterOpts) {
+		o.familyLimit = n
+	}
+}
+
+// WithFamilyLimits overrides the limit of metric families by name
+func WithFamilyLimits(limits map[string]int) Option {
+	return func(o *limiterOpts) {
+		o.familyLimits = limits
+	}
+}
+
+// WithTotalLimit caps the series of all families together. The family
+// reaching it is folded into an overflow series and the families after it are
+// dropped, with their series counted as overflow. 0 means no limit
+func WithTotalLimit(n int) Option {
+	return func(o *limiterOpts) {
+		o.totalLimit = n
+	}
+}
+
+// Limiter folds the series of metric families exceeding their limit into a
+// single series, summing their values. Labels whose values differ between the
+// series of a family are set to OverflowValue in it, while labels shared by
+// all series are kept.
+//
+// Series which were kept by the previous Limit are kept again before any new
+// series, so the series sent do not change between sends when the limit is
+// exceeded.
+//
+// A nil Limiter does not limit anything
+type Limiter struct {
+	opts limiterOpts
+
+	m           sync.Mutex
+	admitted    map[string]map[string]bool
+	cardinality map[string]int
+	overflow    map[string]int
+
+	cardinalityDesc *prometheus.Desc
+	overflowDesc    *prometheus.Desc
+}
+
+// NewLimiter creates a new Limiter
+func NewLimiter(opts ...Option) *Limiter {
+	defOpts := limiterOpts{}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	return &Limiter{
+		opts:        defOpts,
+		admitted:    map[string]map[string]bool{},
+		cardinality: map[string]int{},
+		overflow:    map[string]int{},
+		cardinalityDesc: prometheus.NewDesc(
+			"sonar_series_cardinality",
+			"Number of series of a metric family before limiting.",
+			[]string{"family"}, nil,
+		),
+		overflowDesc: prometheus.NewDesc(
+			"sonar_series_overflow",
+			"Number of series of a metric family folded into its overflow series or dropped.",
+			[]string{"family"}, nil,
+		),
+	}
+}
+
+// limit returns the limit of a family, 0 if it has none
+func (l *Limiter) limit(name string) int {
+	if n, ok := l.opts.familyLimits[name]; ok {
+		return n
+	}
+	return l.opts.familyLimit
+}
+
+// Limit folds the excess series of the families in mfs. Families are limited
+// in place and in order, so with a total limit the families at the end are the
+// ones folded or dropped
+func (l *Limiter) Limit(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	if l == nil {
+		return mfs
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	admitted := make(map[string]map[string]bool, len(mfs))
+	cardinality := make(map[string]int, len(mfs))
+	overflow := map[string]int{}
+	used := 0
+	out := mfs[:0]
+	for _, mf := range mfs {
+		name := mf.GetName()
+		keys := make([]string, len(mf.Metric))
+		distinct := map[string]bool{}
+		for i, m := range mf.Metric {
+			keys[i] = seriesKey(m.Label)
+			distinct[keys[i]] = true
+		}
+		cardinality[name] += len(distinct)
+
+		limit := l.limit(name)
+		if l.opts.totalLimit > 0 {
+			remaining := l.opts.totalLimit - used
+			if remaining < 1 {
+				overflow[name] += len(distinct)
+				continue
+			}
+			if limit <= 0 || remaining < limit {
+				limit = remaining
+			}
+		}
+		out = append(out, mf)
+		if limit <= 0 || len(distinct) <= limit {
+			admitted[name] = distinct
+			used += len(distinct)
+			continue
+		}
+
+		// one series is taken by the overflow series
+		keep := l.choose(name, keys, limit-1)
+		var kept, folded []*dto.Metric
+		for i, m := range mf.Metric {
+			if keep[keys[i]] {
+				kept = append(kept, m)
+			} else {
+				folded = append(folded, m)
+			}
+		}
+		mf.Metric = append(kept, fold(mf.GetType(), varyingLabels(mf.Metric), folded))
+		admitted[name] = keep
+		overflow[name] += len(distinct) - len(keep)
+		used += limit
+	}
+
+	l.admitted, l.cardinality, l.overflow = admitted, cardinality, overflow
+	return out
+}
+
+// choose returns up to n of keys, preferring those admitted before
+func (l *Limiter) choose(name string, keys []string, n int) map[string]bool {
+	keep := make(map[string]bool, n)
+	before := l.admitted[name]
+	for _, key := range keys {
+		if len(keep) < n && before[key] {
+			keep[key] = true
+		}
+	}
+	for _, key := range keys {
+		if len(keep) < n {
+			keep[key] = true
+		}
+	}
+	return keep
+}
+
+// varyingLabels returns the names of labels whose values are not shared by
+// all metrics
+func varyingLabels(metrics []*dto.Metric) map[string]bool {
+	values := map[string]string{}
+	counts := map[string]int{}
+	varying := map[string]bool{}
+	for _, m := range metrics {
+		for _, lp := range m.Label {
+			v, ok := values[lp.GetName()]
+			if ok && v != lp.GetValue() {
+				varying[lp.GetName()] = true
+			}
+			values[lp.GetName()] = lp.GetValue()
+			counts[lp.GetName()]++
+		}
+	}
+	for name, n := range counts {
+		if n < len(metrics) {
+			varying[name] = true
+		}
+	}
+	return varying
+}
+
+// fold sums metrics into a single metric with the varying labels set to
+// OverflowValue. Quantiles of summaries can not be summed and are left out,
+// as are the buckets of histograms which do not share the same buckets
+func fold(typ dto.MetricType, varying map[string]bool, metrics []*dto.Metric) *dto.Metric {
+	names := map[string]string{}
+	for _, m := range metrics {
+		for _, lp := range m.Label {
+			names[lp.GetName()] = lp.GetValue()
+			if varying[lp.GetName()] {
+				names[lp.GetName()] = OverflowValue
+			}
+		}
+	}
+	out := &dto.Metric{Label: make([]*dto.LabelPair, 0, len(names))}
+	for name, value := range names {
+		out.Label = append(out.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	sort.Slice(out.Label, func(i, j int) bool { return out.Label[i].GetName() < out.Label[j].GetName() })
+
+	switch typ {
+	case dto.MetricType_COUNTER:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.GetCounter().GetValue()
+		}
+		out.Counter = &dto.Counter{Value: proto.Float64(sum)}
+	case dto.MetricType_GAUGE:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.GetGauge().GetValue()
+		}
+		out.Gauge = &dto.Gauge{Value: proto.Float64(sum)}
+	case dto.MetricType_UNTYPED:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.GetUntyped().GetValue()
+		}
+		out.Untyped = &dto.Untyped{Value: proto.Float64(sum)}
+	case dto.MetricType_SUMMARY:
+		var count uint64
+		var sum float64
+		for _, m := range metrics {
+			count += m.GetSummary().GetSampleCount()
+			sum += m.GetSummary().GetSampleSum()
+		}
+		out.Summary = &dto.Summary{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum)}
+	case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+		out.Histogram = foldHistograms(metrics)
+	}
+	return out
+}
+
+// foldHistograms sums the counts and sums of histograms, and their buckets if
+// they all have the same bucket boundaries
+func foldHistograms(metrics []*dto.Metric) *dto.Histogram {
+	var count uint64
+	var sum float64
+	var buckets []*dto.Bucket
+	sameBuckets := true
+	for i, m := range metrics {
+		h := m.GetHistogram()
+		count += h.GetSampleCount()
+		sum += h.GetSampleSum()
+
+		if i == 0 {
+			for _, b := range h.Bucket {
+				buckets = append(buckets, &dto.Bucket{UpperBound: proto.Float64(b.GetUpperBound()), CumulativeCount: proto.Uint64(b.GetCumulativeCount())})
+			}
+			continue
+		}
+		if !sameBuckets || len(h.Bucket) != len(buckets) {
+			sameBuckets = false
+			continue
+		}
+		for j, b := range h.Bucket {
+			if b.GetUpperBound() != buckets[j].GetUpperBound() {
+				sameBuckets = false
+				break
+			}
+			buckets[j].CumulativeCount = proto.Uint64(buckets[j].GetCumulativeCount() + b.GetCumulativeCount())
+		}
+	}
+	if !sameBuckets {
+		buckets = nil
+	}
+	return &dto.Histogram{SampleCount: proto.Uint64(count), SampleSum: proto.Float64(sum), Bucket: buckets}
+}
+
+// seriesKey identifies a series within its family by its labels
+func seriesKey(labels []*dto.LabelPair) string {
+	sorted := make([]*dto.LabelPair, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+
+	var sb strings.Builder
+	for _, l := range sorted {
+		sb.WriteString(l.GetName())
+		sb.WriteByte(0)
+		sb.WriteString(l.GetValue())
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
+
+// Overflow returns the series folded or dropped by the last Limit by family
+func (l *Limiter) Overflow() map[string]int {
+	if l == nil {
+		return nil
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	out := make(map[string]int, len(l.overflow))
+	for name, n := range l.overflow {
+		out[name] = n
+	}
+	return out
+}
+
+// Describe describes the cardinality metrics of the limiter
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- l.cardinalityDesc
+	ch <- l.overflowDesc
+}
+
+// Collect reports the cardinality of every family seen by the last Limit, and
+// the series folded of families which exceeded their limit
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	for name, n := range l.cardinality {
+		ch <- prometheus.MustNewConstMetric(l.cardinalityDesc, prometheus.GaugeValue, float64(n), name)
+	}
+	for name, n := range l.overflow {
+		ch <- prometheus.MustNewConstMetric(l.overflowDesc, prometheus.GaugeValue, float64(n), name)
+	}
+}
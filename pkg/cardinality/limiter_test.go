@@ -0,0 +1,151 @@
+package cardinality
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func gauges(name string, tables ...string) *dto.MetricFamily {
+	gauge := dto.MetricType_GAUGE
+	mf := &dto.MetricFamily{Name: proto.String(name), Type: &gauge}
+	for i, table := range tables {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label: []*dto.LabelPair{
+				{Name: proto.String("db"), Value: proto.String("main")},
+				{Name: proto.String("table"), Value: proto.String(table)},
+			},
+			Gauge: &dto.Gauge{Value: proto.Float64(float64(i + 1))},
+		})
+	}
+	return mf
+}
+
+func series(mf *dto.MetricFamily) map[string]float64 {
+	out := map[string]float64{}
+	for _, m := range mf.Metric {
+		labels := map[string]string{}
+		for _, l := range m.Label {
+			labels[l.GetName()] = l.GetValue()
+		}
+		out[labels["db"]+"/"+labels["table"]] = m.GetGauge().GetValue()
+	}
+	return out
+}
+
+func TestLimiter(t *testing.T) {
+	l := NewLimiter(WithFamilyLimit(3), WithFamilyLimits(map[string]int{"unlimited": 0}))
+
+	mfs := l.Limit([]*dto.MetricFamily{
+		gauges("rows", "a", "b", "c", "d", "e"),
+		gauges("size", "a", "b", "c"),
+		gauges("unlimited", "a", "b", "c", "d"),
+	})
+	require.Equal(t, map[string]float64{"main/a": 1, "main/b": 2, "main/" + OverflowValue: 12}, series(mfs[0]))
+	require.Len(t, mfs[1].Metric, 3)
+	require.Len(t, mfs[2].Metric, 4)
+
+	// previously kept series are kept again
+	mfs = l.Limit([]*dto.MetricFamily{gauges("rows", "x", "b", "y", "a")})
+	require.Equal(t, map[string]float64{"main/a": 4, "main/b": 2, "main/" + OverflowValue: 4}, series(mfs[0]))
+}
+
+func TestLimiterTotalLimit(t *testing.T) {
+	l := NewLimiter(WithTotalLimit(4))
+
+	mfs := l.Limit([]*dto.MetricFamily{
+		gauges("rows", "a", "b", "c"),
+		gauges("size", "a", "b", "c"),
+		gauges("reads", "a", "b"),
+	})
+	// reads is dropped once the limit is reached
+	require.Len(t, mfs, 2)
+	require.Len(t, mfs[0].Metric, 3)
+	require.Equal(t, map[string]float64{"main/" + OverflowValue: 6}, series(mfs[1]))
+}
+
+func TestLimiterTotalLimitWithMoreFamiliesThanTheLimit(t *testing.T) {
+	l := NewLimiter(WithTotalLimit(100))
+
+	var mfs []*dto.MetricFamily
+	for i := 0; i < 2000; i++ {
+		mfs = append(mfs, gauges(fmt.Sprintf("family_%04d", i), "a"))
+	}
+	mfs = l.Limit(mfs)
+
+	series := 0
+	for _, mf := range mfs {
+		series += len(mf.Metric)
+	}
+	require.Equal(t, 100, series)
+
+	dropped := 0
+	for _, n := range l.overflow {
+		dropped += n
+	}
+	require.Equal(t, 1900, dropped)
+}
+
+func TestLimiterFoldsHistogramsAndSummaries(t *testing.T) {
+	histogram := dto.MetricType_HISTOGRAM
+	summary := dto.MetricType_SUMMARY
+	hmf := &dto.MetricFamily{Name: proto.String("latency"), Type: &histogram}
+	smf := &dto.MetricFamily{Name: proto.String("rpc"), Type: &summary}
+	for i := 0; i < 3; i++ {
+		labels := []*dto.LabelPair{{Name: proto.String("topic"), Value: proto.String(fmt.Sprint(i))}}
+		hmf.Metric = append(hmf.Metric, &dto.Metric{Label: labels, Histogram: &dto.Histogram{
+			SampleCount: proto.Uint64(2), SampleSum: proto.Float64(1),
+			Bucket: []*dto.Bucket{
+				{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+				{UpperBound: proto.Float64(math.Inf(1)), CumulativeCount: proto.Uint64(2)},
+			},
+		}})
+		smf.Metric = append(smf.Metric, &dto.Metric{Label: labels, Summary: &dto.Summary{
+			SampleCount: proto.Uint64(1), SampleSum: proto.Float64(3),
+			Quantile: []*dto.Quantile{{Quantile: proto.Float64(0.5), Value: proto.Float64(3)}},
+		}})
+	}
+
+	mfs := NewLimiter(WithFamilyLimit(2)).Limit([]*dto.MetricFamily{hmf, smf})
+	overflow := mfs[0].Metric[1]
+	require.Equal(t, OverflowValue, overflow.Label[0].GetValue())
+	require.Equal(t, uint64(4), overflow.GetHistogram().GetSampleCount())
+	require.Equal(t, uint64(2), overflow.GetHistogram().Bucket[0].GetCumulativeCount())
+
+	overflow = mfs[1].Metric[1]
+	require.Equal(t, 6.0, overflow.GetSummary().GetSampleSum())
+	require.Empty(t, overflow.GetSummary().Quantile)
+}
+
+func TestLimiterCollect(t *testing.T) {
+	l := NewLimiter(WithFamilyLimit(2))
+	l.Limit([]*dto.MetricFamily{gauges("rows", "a", "b", "c"), gauges("size", "a")})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(l)
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	got := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			got[mf.GetName()+"/"+m.Label[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{
+		"sonar_series_cardinality/rows": 3,
+		"sonar_series_cardinality/size": 1,
+		"sonar_series_overflow/rows":    2,
+	}, got)
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	mfs := []*dto.MetricFamily{gauges("rows", "a")}
+	require.Equal(t, mfs, l.Limit(mfs))
+}
@@ -1,8 +1,11 @@
 package clients
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/digitalocean/do-agent/internal/log"
@@ -13,18 +16,51 @@ type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// HTTPOption is used to configure optional HTTP client options.
+type HTTPOption func(t *http.Transport)
+
+// WithTLSConfig configures the TLS settings used for HTTPS connections
+func WithTLSConfig(c *tls.Config) HTTPOption {
+	return func(t *http.Transport) {
+		t.TLSClientConfig = c
+	}
+}
+
+// WithProxyURL sends all requests through the proxy at u
+func WithProxyURL(u *url.URL) HTTPOption {
+	return func(t *http.Transport) {
+		t.Proxy = http.ProxyURL(u)
+	}
+}
+
+// WithUnixSocket dials the Unix domain socket at path for every request
+// regardless of the host in the request URL
+func WithUnixSocket(path string) HTTPOption {
+	return func(t *http.Transport) {
+		t.Proxy = nil
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		}
+	}
+}
+
 // NewHTTP creates a new HTTP client with the provided timeout
-func NewHTTP(timeout time.Duration) *http.Client {
+func NewHTTP(timeout time.Duration, opts ...HTTPOption) *http.Client {
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: timeout,
+		}).DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		DisableKeepAlives:     true,
+	}
+	for _, opt := range opts {
+		opt(transport)
+	}
+
 	return &http.Client{
-		Timeout: timeout,
-		Transport: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout: timeout,
-			}).DialContext,
-			TLSHandshakeTimeout:   timeout,
-			ResponseHeaderTimeout: timeout,
-			DisableKeepAlives:     true,
-		},
+		Timeout:   timeout,
+		Transport: transport,
 	}
 }
 
@@ -0,0 +1,46 @@
+package roundtrippers
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type basicAuthRoundTripper struct {
+	username     string
+	password     string
+	passwordFile string
+	rt           http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper's interface
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(req.Header.Get("Authorization")) != 0 {
+		return rt.rt.RoundTrip(req)
+	}
+
+	password := rt.password
+	if rt.passwordFile != "" {
+		p, err := os.ReadFile(rt.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read basic auth password file %s: %s", rt.passwordFile, err)
+		}
+		password = strings.TrimSpace(string(p))
+	}
+
+	req = cloneRequest(req)
+	req.SetBasicAuth(rt.username, password)
+	return rt.rt.RoundTrip(req)
+}
+
+// NewBasicAuth returns an http.RoundTripper that adds basic auth credentials to a request
+func NewBasicAuth(username, password string, rt http.RoundTripper) http.RoundTripper {
+	return &basicAuthRoundTripper{username: username, password: password, rt: rt}
+}
+
+// NewBasicAuthFile returns an http.RoundTripper that adds basic auth credentials to a
+// request with the password read from a file on every request
+func NewBasicAuthFile(username, passwordFile string, rt http.RoundTripper) http.RoundTripper {
+	return &basicAuthRoundTripper{username: username, passwordFile: passwordFile, rt: rt}
+}
@@ -0,0 +1,53 @@
+package roundtrippers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthRoundTripper_RoundTrip_Happy_Path(t *testing.T) {
+	rt := NewBasicAuth("user", "secret", http.DefaultTransport)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "secret" {
+			t.Errorf("BasicAuth() = %s, %s, %v, want user, secret, true", user, pass, ok)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestBasicAuthFileRoundTripper_RoundTrip_Happy_Path(t *testing.T) {
+	rt := NewBasicAuthFile("user", tokenPath, http.DefaultTransport)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != token {
+			t.Errorf("BasicAuth() = %s, %s, %v, want user, %s, true", user, pass, ok, token)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestBasicAuthFileRoundTripper_RoundTrip_Missing_File(t *testing.T) {
+	rt := NewBasicAuthFile("user", invalidTokenPath, http.DefaultTransport)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err == nil {
+		t.Errorf("Expected error, got none")
+	}
+}
@@ -0,0 +1,22 @@
+package roundtrippers
+
+import "net/http"
+
+type headersRoundTripper struct {
+	headers map[string]string
+	rt      http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper's interface
+func (rt *headersRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	for k, v := range rt.headers {
+		req.Header.Set(k, v)
+	}
+	return rt.rt.RoundTrip(req)
+}
+
+// NewHeaders returns an http.RoundTripper that sets the given headers on a request
+func NewHeaders(headers map[string]string, rt http.RoundTripper) http.RoundTripper {
+	return &headersRoundTripper{headers, rt}
+}
@@ -0,0 +1,23 @@
+package roundtrippers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeadersRoundTripper_RoundTrip_Happy_Path(t *testing.T) {
+	rt := NewHeaders(map[string]string{"X-Scope-OrgID": "tenant"}, http.DefaultTransport)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("X-Scope-OrgID"); got != "tenant" {
+			t.Errorf("Header.X-Scope-OrgID = %s, want tenant", got)
+		}
+	}))
+	defer ts.Close()
+
+	_, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, ts.URL, nil))
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package clients
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig describes the TLS settings used to connect to a server
+type TLSConfig struct {
+	// CAFile is a PEM encoded CA bundle used to verify the server instead of
+	// the system roots
+	CAFile string
+	// CertFile and KeyFile are a PEM encoded client certificate and key
+	// presented to the server
+	CertFile string
+	KeyFile  string
+	// ServerName overrides the name used to verify the server certificate
+	ServerName string
+	// InsecureSkipVerify disables verification of the server certificate
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig creates a *tls.Config from c, reading any referenced files
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file %s: %w", c.CAFile, err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+		}
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, fmt.Errorf("a client certificate and key must be configured together")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
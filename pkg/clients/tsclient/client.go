@@ -55,6 +55,12 @@ type Client interface {
 	ResetWaitTimer()
 }
 
+// LabelSetAdder is implemented by clients which can add a metric identified
+// by its label set without building a Definition
+type LabelSetAdder interface {
+	AddLabelSet(ls LabelSet, value float64) error
+}
+
 // HTTPClient is used to send metrics via http
 type HTTPClient struct {
 	httpClient               *http.Client
@@ -325,7 +331,20 @@ func (c *HTTPClient) AddMetricWithTime(def *Definition, t time.Time, value float
 	return c.addMetricWithMSEpochTime(def, ms, value, labels...)
 }
 
+// AddLabelSet adds a metric identified by its label set to the batch
+func (c *HTTPClient) AddLabelSet(ls LabelSet, value float64) error {
+	return c.addLFM(ls.LFM(), 0, value)
+}
+
 func (c *HTTPClient) addMetricWithMSEpochTime(def *Definition, ms int64, value float64, labels ...string) error {
+	lfm, err := GetLFM(def, labels)
+	if err != nil {
+		return fmt.Errorf("failed to get LFM: %w", err)
+	}
+	return c.addLFM(lfm, ms, value)
+}
+
+func (c *HTTPClient) addLFM(lfm string, ms int64, value float64) error {
 	isZeroTime := bool(ms == 0)
 	if c.buf == nil {
 		c.buf = new(bytes.Buffer)
@@ -337,10 +356,6 @@ func (c *HTTPClient) addMetricWithMSEpochTime(def *Definition, ms int64, value f
 			panic("client support for AddMetrics and AddMetricWithTime is mutually exclusive")
 		}
 	}
-	lfm, err := GetLFM(def, labels)
-	if err != nil {
-		return fmt.Errorf("failed to get LFM: %w", err)
-	}
 
 	if !isZeroTime {
 		// ensure sufficient time between reported metric values
@@ -0,0 +1,272 @@
+package tsclient
+
+import (
+	"sort"
+	"strings"
+)
+
+// fnv-1a, inlined so hashing does not allocate
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+	sep      = '\xff'
+)
+
+// Label is a label name and value
+type Label struct {
+	Name  string
+	Value string
+}
+
+// LabelSet is an immutable set of labels sorted by name, including the metric
+// name as __name__. Its hash is computed once so label sets are cheap to use
+// as map keys together with Equal
+type LabelSet struct {
+	labels []Label
+	hash   uint64
+}
+
+// NewLabelSet returns a label set of the given labels. Later labels replace
+// earlier ones with the same name
+func NewLabelSet(labels ...Label) LabelSet {
+	var b LabelSetBuilder
+	for _, l := range labels {
+		b.Set(l.Name, l.Value)
+	}
+	return b.LabelSet()
+}
+
+// LabelSetFromMap returns a label set of the labels in m
+func LabelSetFromMap(m map[string]string) LabelSet {
+	b := LabelSetBuilder{labels: make([]Label, 0, len(m))}
+	for k, v := range m {
+		b.labels = append(b.labels, Label{Name: k, Value: v})
+	}
+	return b.LabelSet()
+}
+
+// Name returns the metric name
+func (ls LabelSet) Name() string {
+	return ls.Get(metricNameLabel)
+}
+
+// Get returns the value of a label, empty if it is not set
+func (ls LabelSet) Get(name string) string {
+	v, _ := ls.Lookup(name)
+	return v
+}
+
+// Lookup returns the value of a label and whether it is set
+func (ls LabelSet) Lookup(name string) (string, bool) {
+	i := sort.Search(len(ls.labels), func(i int) bool { return ls.labels[i].Name >= name })
+	if i < len(ls.labels) && ls.labels[i].Name == name {
+		return ls.labels[i].Value, true
+	}
+	return "", false
+}
+
+// Len returns the number of labels including the metric name
+func (ls LabelSet) Len() int {
+	return len(ls.labels)
+}
+
+// Labels returns the labels sorted by name. They must not be modified
+func (ls LabelSet) Labels() []Label {
+	return ls.labels
+}
+
+// Hash returns the hash of the labels
+func (ls LabelSet) Hash() uint64 {
+	return ls.hash
+}
+
+// Equal returns true if both sets contain the same labels
+func (ls LabelSet) Equal(o LabelSet) bool {
+	return ls.hash == o.hash && labelsEqual(ls.labels, o.labels)
+}
+
+// Map returns the labels as a map
+func (ls LabelSet) Map() map[string]string {
+	m := make(map[string]string, len(ls.labels))
+	for _, l := range ls.labels {
+		m[l.Name] = l.Value
+	}
+	return m
+}
+
+// With returns a copy of the set with the given label set
+func (ls LabelSet) With(name, value string) LabelSet {
+	b := LabelSetBuilder{labels: make([]Label, len(ls.labels), len(ls.labels)+1)}
+	copy(b.labels, ls.labels)
+	b.Set(name, value)
+	return b.LabelSet()
+}
+
+// String returns the set in the Prometheus text format like
+// ConvertLFMMapToPrometheusEncodedName, for example sonar_cpu{cpu="cpu0",mode="idle"}
+func (ls LabelSet) String() string {
+	var sb strings.Builder
+	sb.Grow(ls.EncodedLen())
+	sb.WriteString(ls.Name())
+	sb.WriteByte('{')
+	first := true
+	for _, l := range ls.labels {
+		if l.Name == metricNameLabel {
+			continue
+		}
+		if !first {
+			sb.WriteByte(',')
+		}
+		first = false
+		sb.WriteString(l.Name)
+		sb.WriteString(`="`)
+		sb.WriteString(l.Value)
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// EncodedLen returns the length of String without building it
+func (ls LabelSet) EncodedLen() int {
+	n := len(ls.Name()) + 2
+	for _, l := range ls.labels {
+		if l.Name == metricNameLabel {
+			continue
+		}
+		// name="value" and a comma between labels
+		n += len(l.Name) + len(l.Value) + 4
+	}
+	if n > len(ls.Name())+2 {
+		n--
+	}
+	return n
+}
+
+// LFM returns the delimited metric sent to sonar, the same as GetLFM of a
+// definition with the labels as common labels
+func (ls LabelSet) LFM() string {
+	n := len(ls.Name())
+	for _, l := range ls.labels {
+		if l.Name != metricNameLabel {
+			n += len(l.Name) + len(l.Value) + 2
+		}
+	}
+
+	var sb strings.Builder
+	sb.Grow(n)
+	sb.WriteString(ls.Name())
+	for _, l := range ls.labels {
+		if l.Name == metricNameLabel {
+			continue
+		}
+		sb.WriteByte(0)
+		sb.WriteString(l.Name)
+		sb.WriteByte(0)
+		sb.WriteString(l.Value)
+	}
+	return sb.String()
+}
+
+// LabelSetBuilder builds label sets. Its buffer is reused after Reset, so
+// label sets which are only looked up, and never built, do not allocate
+type LabelSetBuilder struct {
+	labels []Label
+}
+
+// Reset removes all labels
+func (b *LabelSetBuilder) Reset() {
+	b.labels = b.labels[:0]
+}
+
+// Set sets a label, replacing its previous value
+func (b *LabelSetBuilder) Set(name, value string) {
+	for i := range b.labels {
+		if b.labels[i].Name == name {
+			b.labels[i].Value = value
+			return
+		}
+	}
+	b.labels = append(b.labels, Label{Name: name, Value: value})
+}
+
+// Del removes labels
+func (b *LabelSetBuilder) Del(names ...string) {
+	out := b.labels[:0]
+	for _, l := range b.labels {
+		if !contains(names, l.Name) {
+			out = append(out, l)
+		}
+	}
+	b.labels = out
+}
+
+// sort sorts the labels by name. Label sets are small, so insertion sort is
+// faster than sort.Slice and does not allocate
+func (b *LabelSetBuilder) sort() {
+	for i := 1; i < len(b.labels); i++ {
+		for j := i; j > 0 && b.labels[j].Name < b.labels[j-1].Name; j-- {
+			b.labels[j], b.labels[j-1] = b.labels[j-1], b.labels[j]
+		}
+	}
+}
+
+// Hash returns the hash of the label set the builder would build
+func (b *LabelSetBuilder) Hash() uint64 {
+	b.sort()
+	return hashLabels(b.labels)
+}
+
+// Equal returns true if the builder would build a set equal to ls
+func (b *LabelSetBuilder) Equal(ls LabelSet) bool {
+	b.sort()
+	return labelsEqual(b.labels, ls.labels)
+}
+
+// LabelSet builds a label set of the labels
+func (b *LabelSetBuilder) LabelSet() LabelSet {
+	b.sort()
+	labels := make([]Label, len(b.labels))
+	copy(labels, b.labels)
+	return LabelSet{labels: labels, hash: hashLabels(labels)}
+}
+
+func hashLabels(labels []Label) uint64 {
+	h := uint64(offset64)
+	for _, l := range labels {
+		for i := 0; i < len(l.Name); i++ {
+			h ^= uint64(l.Name[i])
+			h *= prime64
+		}
+		h ^= sep
+		h *= prime64
+		for i := 0; i < len(l.Value); i++ {
+			h ^= uint64(l.Value[i])
+			h *= prime64
+		}
+		h ^= sep
+		h *= prime64
+	}
+	return h
+}
+
+func labelsEqual(a, b []Label) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
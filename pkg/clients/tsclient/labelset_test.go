@@ -0,0 +1,114 @@
+package tsclient
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelSet(t *testing.T) {
+	m := map[string]string{"__name__": "sonar_cpu", "mode": "idle", "cpu": "cpu0"}
+	ls := LabelSetFromMap(m)
+
+	require.Equal(t, "sonar_cpu", ls.Name())
+	require.Equal(t, "idle", ls.Get("mode"))
+	_, ok := ls.Lookup("host_id")
+	require.False(t, ok)
+	require.Equal(t, m, ls.Map())
+	require.Equal(t, []Label{{"__name__", "sonar_cpu"}, {"cpu", "cpu0"}, {"mode", "idle"}}, ls.Labels())
+
+	require.Equal(t, ConvertLFMMapToPrometheusEncodedName(m), ls.String())
+	require.Equal(t, len(ls.String()), ls.EncodedLen())
+	require.Equal(t, "up{}", NewLabelSet(Label{"__name__", "up"}).String())
+	require.Equal(t, 4, NewLabelSet(Label{"__name__", "up"}).EncodedLen())
+
+	lfm, err := GetLFM(NewDefinitionFromMap(ls.Map()), nil)
+	require.NoError(t, err)
+	require.Equal(t, lfm, ls.LFM())
+
+	other := NewLabelSet(Label{"mode", "idle"}, Label{"cpu", "cpu1"}, Label{"__name__", "sonar_cpu"}, Label{"cpu", "cpu0"})
+	require.True(t, ls.Equal(other))
+	require.Equal(t, ls.Hash(), other.Hash())
+	require.False(t, ls.Equal(ls.With("cpu", "cpu1")))
+	require.Equal(t, "cpu0", ls.Get("cpu"), "With must not modify the set")
+}
+
+func TestLabelSetBuilder(t *testing.T) {
+	ls := NewLabelSet(Label{"__name__", "up"}, Label{"job", "node"})
+
+	var b LabelSetBuilder
+	b.Set("job", "node")
+	b.Set("instance", "a")
+	b.Set("__name__", "up")
+	require.False(t, b.Equal(ls))
+
+	b.Del("instance")
+	require.True(t, b.Equal(ls))
+	require.Equal(t, ls.Hash(), b.Hash())
+
+	built := b.LabelSet()
+	b.Reset()
+	b.Set("__name__", "down")
+	require.Equal(t, "up", built.Name(), "built sets must not share the buffer")
+
+	// label boundaries are part of the hash
+	require.NotEqual(t,
+		NewLabelSet(Label{"a", "bc"}).Hash(),
+		NewLabelSet(Label{"ab", "c"}).Hash())
+}
+
+func benchmarkLabelSets(n int) []map[string]string {
+	sets := make([]map[string]string, n)
+	for i := range sets {
+		sets[i] = map[string]string{
+			"__name__": "bench_metric_" + strconv.Itoa(i%50),
+			"instance": "10.0.0." + strconv.Itoa(i%16),
+			"job":      "exporter",
+			"pod":      "pod-" + strconv.Itoa(i),
+			"user_id":  "123456",
+		}
+	}
+	return sets
+}
+
+// BenchmarkLFMFromDefinition is how metrics were sent before label sets
+func BenchmarkLFMFromDefinition(b *testing.B) {
+	sets := benchmarkLabelSets(50000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, m := range sets {
+			labels := make(map[string]string, len(m))
+			for k, v := range m {
+				labels[k] = v
+			}
+			if len(ConvertLFMMapToPrometheusEncodedName(labels)) > defaultMaxMetricLength {
+				b.Fatal("too long")
+			}
+			if _, err := GetLFM(NewDefinitionFromMap(labels), nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkLFMFromLabelSet(b *testing.B) {
+	maps := benchmarkLabelSets(50000)
+	sets := make([]LabelSet, len(maps))
+	for i, m := range maps {
+		sets[i] = LabelSetFromMap(m)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, ls := range sets {
+			if ls.EncodedLen() > defaultMaxMetricLength {
+				b.Fatal("too long")
+			}
+			_ = ls.LFM()
+		}
+	}
+}
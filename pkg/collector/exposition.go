@@ -0,0 +1,118 @@
+package collector
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// ScrapeProtocol is an exposition format a scraper can negotiate with the
+// remote endpoint
+type ScrapeProtocol string
+
+const (
+	// PrometheusProto is the delimited protobuf format. It is the only format
+	// that can carry native histograms
+	PrometheusProto ScrapeProtocol = "PrometheusProto"
+	// OpenMetricsText1 is the OpenMetrics 1.0.0 text format
+	OpenMetricsText1 ScrapeProtocol = "OpenMetricsText1.0.0"
+	// OpenMetricsText0 is the OpenMetrics 0.0.1 text format
+	OpenMetricsText0 ScrapeProtocol = "OpenMetricsText0.0.1"
+	// PrometheusText0 is the classic Prometheus text format
+	PrometheusText0 ScrapeProtocol = "PrometheusText0.0.4"
+)
+
+// DefaultScrapeProtocols are negotiated in order of preference unless
+// configured otherwise
+var DefaultScrapeProtocols = []ScrapeProtocol{
+	PrometheusProto,
+	OpenMetricsText1,
+	OpenMetricsText0,
+	PrometheusText0,
+}
+
+var scrapeProtocolMediaTypes = map[ScrapeProtocol]string{
+	PrometheusProto:  "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited",
+	OpenMetricsText1: "application/openmetrics-text;version=1.0.0",
+	OpenMetricsText0: "application/openmetrics-text;version=0.0.1",
+	PrometheusText0:  "text/plain;version=0.0.4",
+}
+
+// ScrapeProtocols returns the names of all supported scrape protocols
+func ScrapeProtocols() []string {
+	protos := make([]string, len(DefaultScrapeProtocols))
+	for i, p := range DefaultScrapeProtocols {
+		protos[i] = string(p)
+	}
+	return protos
+}
+
+// acceptHeader builds an Accept header preferring protocols in the order
+// given. Anything else is still accepted and parsed as text
+func acceptHeader(protos []ScrapeProtocol) (string, error) {
+	vals := make([]string, 0, len(protos)+1)
+	q := 10
+	for _, p := range protos {
+		mt, ok := scrapeProtocolMediaTypes[p]
+		if !ok {
+			return "", fmt.Errorf("unknown scrape protocol %q", p)
+		}
+		vals = append(vals, fmt.Sprintf("%s;q=0.%d", mt, q-1))
+		if q > 3 {
+			q--
+		}
+	}
+	vals = append(vals, "*/*;q=0.1")
+	return strings.Join(vals, ","), nil
+}
+
+// responseFormat returns the format of a response body from its Content-Type.
+// Unknown types are treated as the classic text format as before content
+// negotiation was supported
+func responseFormat(h http.Header) expfmt.FormatType {
+	mediatype, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil && mediatype == expfmt.OpenMetricsType {
+		return expfmt.TypeOpenMetrics
+	}
+	if t := expfmt.ResponseFormat(h).FormatType(); t == expfmt.TypeProtoDelim {
+		return t
+	}
+	return expfmt.TypeTextPlain
+}
+
+// parseMetricFamilies parses a response body in the given format
+func parseMetricFamilies(r io.Reader, format expfmt.FormatType) (map[string]*dto.MetricFamily, error) {
+	switch format {
+	case expfmt.TypeProtoDelim:
+		return parseProto(r)
+	case expfmt.TypeOpenMetrics:
+		return parseOpenMetrics(r)
+	default:
+		return new(expfmt.TextParser).TextToMetricFamilies(r)
+	}
+}
+
+// parseProto parses length delimited protobuf metric families
+func parseProto(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	dec := expfmt.NewDecoder(r, expfmt.NewFormat(expfmt.TypeProtoDelim))
+	mfs := map[string]*dto.MetricFamily{}
+	for {
+		mf := new(dto.MetricFamily)
+		if err := dec.Decode(mf); err != nil {
+			if err == io.EOF {
+				return mfs, nil
+			}
+			return nil, err
+		}
+		if existing, ok := mfs[mf.GetName()]; ok {
+			existing.Metric = append(existing.Metric, mf.Metric...)
+			continue
+		}
+		mfs[mf.GetName()] = mf
+	}
+}
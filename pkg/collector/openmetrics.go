@@ -0,0 +1,194 @@
+package collector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// openMetricsTypes maps OpenMetrics family types to the closest Prometheus
+// text format type
+var openMetricsTypes = map[string]string{
+	"counter":        "counter",
+	"gauge":          "gauge",
+	"histogram":      "histogram",
+	"gaugehistogram": "histogram",
+	"summary":        "summary",
+	"info":           "gauge",
+	"stateset":       "gauge",
+	"unknown":        "untyped",
+}
+
+// parseOpenMetrics parses the OpenMetrics text format. The exposition is
+// rewritten into the Prometheus text format, which differs mostly in how
+// families are named, and then parsed with the text parser. Exemplars, units
+// and _created series have no equivalent and are dropped
+func parseOpenMetrics(r io.Reader) (map[string]*dto.MetricFamily, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(openMetricsToText(r, pw))
+	}()
+	defer pr.Close()
+
+	return new(expfmt.TextParser).TextToMetricFamilies(pr)
+}
+
+// openMetricsToText rewrites the OpenMetrics exposition read from r into the
+// Prometheus text format written to w
+func openMetricsToText(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	// OpenMetrics requires the metadata of a family to come before its
+	// samples, but HELP may precede TYPE so it is held until the type is known
+	types := map[string]string{}
+	var helpName, help string
+	flushHelp := func() {
+		if helpName != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", textFamilyName(helpName, types[helpName]), help)
+			helpName = ""
+		}
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "# TYPE ") {
+			flushHelp()
+		}
+
+		switch {
+		case line == "# EOF":
+			return bw.Flush()
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				return fmt.Errorf("invalid TYPE line %q", line)
+			}
+			name, typ := fields[2], fields[3]
+			textType, ok := openMetricsTypes[typ]
+			if !ok {
+				return fmt.Errorf("unknown metric type %q for %q", typ, name)
+			}
+			types[name] = typ
+			if helpName != name {
+				flushHelp()
+			}
+			fmt.Fprintf(bw, "# TYPE %s %s\n", textFamilyName(name, typ), textType)
+			flushHelp()
+		case strings.HasPrefix(line, "# HELP "):
+			helpName, help, _ = strings.Cut(line[len("# HELP "):], " ")
+			// the text format does not escape quotes in help strings
+			help = strings.ReplaceAll(help, `\"`, `"`)
+		case strings.HasPrefix(line, "#"):
+			// UNIT and any other comments
+			continue
+		default:
+			sample, err := openMetricsSample(line, types)
+			if err != nil {
+				return err
+			}
+			if sample != "" {
+				bw.WriteString(sample)
+				bw.WriteByte('\n')
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	flushHelp()
+	return bw.Flush()
+}
+
+// textFamilyName returns the Prometheus text format family name of an
+// OpenMetrics family. Counter and info samples carry a suffix which the text
+// format expects in the family name as well
+func textFamilyName(name, typ string) string {
+	switch typ {
+	case "counter":
+		return name + "_total"
+	case "info":
+		return name + "_info"
+	}
+	return name
+}
+
+// openMetricsSample rewrites a single sample line. It returns an empty string
+// for samples which should be dropped
+func openMetricsSample(line string, types map[string]string) (string, error) {
+	nameEnd := strings.IndexAny(line, "{ ")
+	if nameEnd <= 0 {
+		return "", fmt.Errorf("invalid sample %q", line)
+	}
+	name, rest := line[:nameEnd], line[nameEnd:]
+
+	if family, ok := strings.CutSuffix(name, "_created"); ok {
+		switch types[family] {
+		case "counter", "histogram", "gaugehistogram", "summary":
+			return "", nil
+		}
+	}
+	if family, ok := strings.CutSuffix(name, "_gcount"); ok && types[family] == "gaugehistogram" {
+		name = family + "_count"
+	}
+	if family, ok := strings.CutSuffix(name, "_gsum"); ok && types[family] == "gaugehistogram" {
+		name = family + "_sum"
+	}
+
+	var labels string
+	if rest[0] == '{' {
+		end := labelSetEnd(rest)
+		if end == -1 {
+			return "", fmt.Errorf("unterminated label set in %q", line)
+		}
+		labels, rest = rest[:end+1], rest[end+1:]
+	}
+
+	// anything after " # " is an exemplar
+	if i := strings.Index(rest, " # "); i >= 0 {
+		rest = rest[:i]
+	}
+
+	fields := strings.Fields(rest)
+	switch len(fields) {
+	case 1:
+		return name + labels + " " + fields[0], nil
+	case 2:
+		// OpenMetrics timestamps are seconds, the text format uses milliseconds
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid timestamp in %q: %w", line, err)
+		}
+		return fmt.Sprintf("%s%s %s %d", name, labels, fields[0], int64(math.Round(ts*1000))), nil
+	default:
+		return "", fmt.Errorf("invalid sample %q", line)
+	}
+}
+
+// labelSetEnd returns the index of the brace closing the label set s starts
+// with, skipping over quoted label values
+func labelSetEnd(s string) int {
+	var quoted, escaped bool
+	for i := 1; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '}' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,103 @@
+package collector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testOpenMetrics = `# HELP http_requests Total \"HTTP\" requests.
+# TYPE http_requests counter
+# UNIT http_requests requests
+http_requests_total{code="200",path="/a}b # c"} 1027 1700000000.5 # {trace_id="abc"} 1 1700000000
+http_requests_created{code="200",path="/a}b # c"} 1.6e+09
+# TYPE build info
+build_info{version="1.2.3"} 1
+# TYPE queue_size gaugehistogram
+queue_size_bucket{le="1"} 2
+queue_size_bucket{le="+Inf"} 3
+queue_size_gcount 3
+queue_size_gsum 4
+# TYPE temperature gauge
+# HELP temperature Current temperature.
+temperature 21.5
+# TYPE raw unknown
+raw 7
+# EOF
+`
+
+func TestParseOpenMetrics(t *testing.T) {
+	mfs, err := parseOpenMetrics(strings.NewReader(testOpenMetrics))
+	require.NoError(t, err)
+
+	require.Contains(t, mfs, "http_requests_total")
+	requests := mfs["http_requests_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+	assert.Equal(t, `Total "HTTP" requests.`, requests.GetHelp())
+	require.Len(t, requests.Metric, 1)
+	assert.Equal(t, float64(1027), requests.Metric[0].GetCounter().GetValue())
+	assert.Equal(t, int64(1700000000500), requests.Metric[0].GetTimestampMs())
+	assert.Equal(t, "/a}b # c", requests.Metric[0].Label[1].GetValue())
+	assert.NotContains(t, mfs, "http_requests_created")
+
+	require.Contains(t, mfs, "build_info")
+	assert.Equal(t, dto.MetricType_GAUGE, mfs["build_info"].GetType())
+
+	require.Contains(t, mfs, "queue_size")
+	queue := mfs["queue_size"].Metric[0].GetHistogram()
+	assert.Equal(t, uint64(3), queue.GetSampleCount())
+	assert.Equal(t, float64(4), queue.GetSampleSum())
+
+	require.Contains(t, mfs, "temperature")
+	assert.Equal(t, "Current temperature.", mfs["temperature"].GetHelp())
+
+	require.Contains(t, mfs, "raw")
+	assert.Equal(t, dto.MetricType_UNTYPED, mfs["raw"].GetType())
+}
+
+func TestParseOpenMetricsInvalid(t *testing.T) {
+	_, err := parseOpenMetrics(strings.NewReader("# TYPE foo widget\nfoo 1\n# EOF\n"))
+	assert.Error(t, err)
+
+	_, err = parseOpenMetrics(strings.NewReader("foo{bar=\"baz 1\n# EOF\n"))
+	assert.Error(t, err)
+}
+
+func TestScraperParsesOpenMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		_, err := w.Write([]byte(testOpenMetrics))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, map[string]bool{"http_requests_total": true}, WithTimeout(30*time.Second))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	gathered, err := reg.Gather()
+	require.NoError(t, err)
+
+	stats := map[string]bool{
+		"testscraper_scrape_collector_duration_seconds": true,
+		"testscraper_scrape_collector_success":          true,
+	}
+	for _, name := range s.StatNames() {
+		stats[name] = true
+	}
+	var names []string
+	for _, mf := range gathered {
+		if !stats[mf.GetName()] {
+			names = append(names, mf.GetName())
+		}
+	}
+	assert.Equal(t, []string{"http_requests_total"}, names)
+}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons a scrape failed, reported by the last error metric
+const (
+	reasonTimeout       = "timeout"
+	reasonRequest       = "request_failed"
+	reasonHTTPStatus    = "http_status"
+	reasonDecompress    = "decompress"
+	reasonBodySizeLimit = "body_size_limit"
+	reasonParse         = "parse"
+	reasonSampleLimit   = "sample_limit"
+)
+
+// scrapeError is a failed scrape and the reason it failed
+type scrapeError struct {
+	reason string
+	err    error
+}
+
+func (e *scrapeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *scrapeError) Unwrap() error {
+	return e.err
+}
+
+// errorReason returns the reason a scrape failed or an empty string if it
+// did not fail
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return reasonTimeout
+	}
+	var se *scrapeError
+	if errors.As(err, &se) {
+		return se.reason
+	}
+	return reasonRequest
+}
+
+// scrapeStats describes a single scrape
+type scrapeStats struct {
+	status        int
+	bytes         int64
+	samples       int
+	postWhitelist int
+	err           error
+}
+
+// statDescs describe the metrics reported about every scrape
+type statDescs struct {
+	up            *prometheus.Desc
+	samples       *prometheus.Desc
+	postWhitelist *prometheus.Desc
+	bytes         *prometheus.Desc
+	status        *prometheus.Desc
+	lastError     *prometheus.Desc
+	names         []string
+}
+
+func newStatDescs(name string, targetLabels prometheus.Labels) statDescs {
+	var names []string
+	desc := func(fqName, help string, labels ...string) *prometheus.Desc {
+		names = append(names, fqName)
+		return prometheus.NewDesc(fqName, name+": "+help, append([]string{"collector"}, labels...), targetLabels)
+	}
+
+	d := statDescs{
+		up:            desc(prometheus.BuildFQName(name, "", "up"), "Whether the target was reachable and its metrics could be parsed."),
+		samples:       desc(prometheus.BuildFQName(name, "scrape", "samples_scraped"), "Number of samples the target exposed."),
+		postWhitelist: desc(prometheus.BuildFQName(name, "scrape", "samples_post_whitelist"), "Number of samples remaining after whitelisting and relabeling."),
+		bytes:         desc(prometheus.BuildFQName(name, "scrape", "response_bytes"), "Size of the uncompressed response."),
+		status:        desc(prometheus.BuildFQName(name, "scrape", "http_status_code"), "HTTP status code of the response, 0 if there was none."),
+		lastError:     desc(prometheus.BuildFQName(name, "scrape", "last_error"), "Set to 1 with the reason the last scrape failed, absent if it succeeded.", "reason"),
+	}
+	d.names = names
+	return d
+}
+
+func (d statDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.up
+	ch <- d.samples
+	ch <- d.postWhitelist
+	ch <- d.bytes
+	ch <- d.status
+	ch <- d.lastError
+}
+
+func (d statDescs) collect(ch chan<- prometheus.Metric, st scrapeStats, collector string) {
+	reason := errorReason(st.err)
+	var up float64
+	if reason == "" {
+		up = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(d.up, prometheus.GaugeValue, up, collector)
+	ch <- prometheus.MustNewConstMetric(d.samples, prometheus.GaugeValue, float64(st.samples), collector)
+	ch <- prometheus.MustNewConstMetric(d.postWhitelist, prometheus.GaugeValue, float64(st.postWhitelist), collector)
+	ch <- prometheus.MustNewConstMetric(d.bytes, prometheus.GaugeValue, float64(st.bytes), collector)
+	ch <- prometheus.MustNewConstMetric(d.status, prometheus.GaugeValue, float64(st.status), collector)
+	if reason != "" {
+		ch <- prometheus.MustNewConstMetric(d.lastError, prometheus.GaugeValue, 1, collector, reason)
+	}
+}
+
+// bodyReader counts the bytes read from a response body and fails once more
+// than limit bytes were read if limit is positive
+type bodyReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+// Read implements io.Reader
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.limit > 0 && int64(len(p)) > b.limit-b.n+1 {
+		p = p[:b.limit-b.n+1]
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.exceeded() {
+		return n, ErrBodySizeLimit
+	}
+	return n, err
+}
+
+func (b *bodyReader) exceeded() bool {
+	return b.limit > 0 && b.n > b.limit
+}
@@ -4,27 +4,55 @@ import (
 	"bufio"
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/digitalocean/do-agent/internal/log"
 	"github.com/digitalocean/do-agent/pkg/clients"
 	"github.com/digitalocean/do-agent/pkg/clients/roundtrippers"
+	"github.com/digitalocean/do-agent/pkg/decorate"
+	"github.com/digitalocean/do-agent/pkg/relabel"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/proto"
 )
 
 var defaultScrapeTimeout = 5 * time.Second
 
+var (
+	// ErrSampleLimit is returned when a scrape exceeds its sample limit
+	ErrSampleLimit = errors.New("sample limit exceeded")
+	// ErrBodySizeLimit is returned when a response exceeds the body size limit
+	ErrBodySizeLimit = errors.New("body size limit exceeded")
+)
+
+// unixScheme prefixes endpoints served on a Unix domain socket
+const unixScheme = "unix://"
+
 type scraperOpts struct {
 	timeout         time.Duration
 	logLevel        log.Level
 	bearerToken     string
 	bearerTokenFile string
+	protocols       []ScrapeProtocol
+	tlsConfig       *clients.TLSConfig
+	basicAuthUser   string
+	basicAuthPass   string
+	basicAuthFile   string
+	headers         map[string]string
+	proxyURL        *url.URL
+	sampleLimit     int
+	bodySizeLimit   int64
+	serveStale      time.Duration
+	labelConflict   decorate.LabelConflictPolicy
+	relabelConfigs  map[string][]*relabel.Config
 }
 
 // Option is used to configure optional scraper options.
@@ -44,6 +72,84 @@ func WithBearerTokenFile(tokenFile string) Option {
 	}
 }
 
+// WithTLSConfig configures a scraper to connect using the given TLS settings
+func WithTLSConfig(c clients.TLSConfig) Option {
+	return func(o *scraperOpts) {
+		o.tlsConfig = &c
+	}
+}
+
+// WithBasicAuth configures a scraper to use basic auth
+func WithBasicAuth(username, password string) Option {
+	return func(o *scraperOpts) {
+		o.basicAuthUser = username
+		o.basicAuthPass = password
+	}
+}
+
+// WithBasicAuthPasswordFile configures a scraper to use basic auth with a
+// password read from a file
+func WithBasicAuthPasswordFile(username, passwordFile string) Option {
+	return func(o *scraperOpts) {
+		o.basicAuthUser = username
+		o.basicAuthFile = passwordFile
+	}
+}
+
+// WithHeaders configures a scraper to set additional headers on every request
+func WithHeaders(headers map[string]string) Option {
+	return func(o *scraperOpts) {
+		o.headers = headers
+	}
+}
+
+// WithProxyURL configures a scraper to connect through a proxy
+func WithProxyURL(u *url.URL) Option {
+	return func(o *scraperOpts) {
+		o.proxyURL = u
+	}
+}
+
+// WithSampleLimit rejects scrapes returning more than limit samples after
+// whitelisting
+func WithSampleLimit(limit int) Option {
+	return func(o *scraperOpts) {
+		o.sampleLimit = limit
+	}
+}
+
+// WithBodySizeLimit rejects scrapes whose uncompressed response body is larger
+// than limit bytes
+func WithBodySizeLimit(limit int64) Option {
+	return func(o *scraperOpts) {
+		o.bodySizeLimit = limit
+	}
+}
+
+// WithServeStale reports the last successful result when a scrape fails, as
+// long as it is no older than maxAge
+func WithServeStale(maxAge time.Duration) Option {
+	return func(o *scraperOpts) {
+		o.serveStale = maxAge
+	}
+}
+
+// WithLabelConflictPolicy configures how extra labels are merged with scraped
+// labels of the same name
+func WithLabelConflictPolicy(policy decorate.LabelConflictPolicy) Option {
+	return func(o *scraperOpts) {
+		o.labelConflict = policy
+	}
+}
+
+// WithScrapeProtocols configures the exposition formats negotiated with the
+// remote endpoint in order of preference
+func WithScrapeProtocols(protos ...ScrapeProtocol) Option {
+	return func(o *scraperOpts) {
+		o.protocols = protos
+	}
+}
+
 // WithTimeout configures a scraper with a timeout for scraping metrics.
 func WithTimeout(d time.Duration) Option {
 	return func(o *scraperOpts) {
@@ -58,11 +164,22 @@ func WithLogLevel(l log.Level) Option {
 	}
 }
 
+// WithRelabelConfigs relabels the scraped samples of scrapers by their name,
+// like metric_relabel_configs in Prometheus. The labels of the scraper are
+// added before relabeling
+func WithRelabelConfigs(byScraper map[string][]*relabel.Config) Option {
+	return func(o *scraperOpts) {
+		o.relabelConfigs = byScraper
+	}
+}
+
 // NewScraper creates a new scraper to scrape metrics from the provided host
 func NewScraper(name, metricsEndpoint string, extraMetricLabels []*dto.LabelPair, whitelist map[string]bool, opts ...Option) (*Scraper, error) {
 	defOpts := &scraperOpts{
-		timeout:  defaultScrapeTimeout,
-		logLevel: log.LevelError,
+		timeout:       defaultScrapeTimeout,
+		logLevel:      log.LevelError,
+		protocols:     DefaultScrapeProtocols,
+		labelConflict: decorate.RenameLabels,
 	}
 
 	for _, opt := range opts {
@@ -70,7 +187,32 @@ func NewScraper(name, metricsEndpoint string, extraMetricLabels []*dto.LabelPair
 	}
 
 	// setup http client, add auth roundtrippers
-	client := clients.NewHTTP(defOpts.timeout)
+	var httpOpts []clients.HTTPOption
+	if defOpts.tlsConfig != nil {
+		tlsConfig, err := clients.NewTLSConfig(*defOpts.tlsConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+		}
+		httpOpts = append(httpOpts, clients.WithTLSConfig(tlsConfig))
+	}
+	if defOpts.proxyURL != nil {
+		httpOpts = append(httpOpts, clients.WithProxyURL(defOpts.proxyURL))
+	}
+	// sockets are dialed directly so this must come after any proxy
+	if socket, endpoint, ok := parseUnixEndpoint(metricsEndpoint); ok {
+		metricsEndpoint = endpoint
+		httpOpts = append(httpOpts, clients.WithUnixSocket(socket))
+	}
+
+	client := clients.NewHTTP(defOpts.timeout, httpOpts...)
+	if len(defOpts.headers) > 0 {
+		client.Transport = roundtrippers.NewHeaders(defOpts.headers, client.Transport)
+	}
+	if defOpts.basicAuthFile != "" {
+		client.Transport = roundtrippers.NewBasicAuthFile(defOpts.basicAuthUser, defOpts.basicAuthFile, client.Transport)
+	} else if defOpts.basicAuthUser != "" {
+		client.Transport = roundtrippers.NewBasicAuth(defOpts.basicAuthUser, defOpts.basicAuthPass, client.Transport)
+	}
 	if defOpts.bearerTokenFile != "" {
 		client.Transport = roundtrippers.NewBearerTokenFile(defOpts.bearerTokenFile, client.Transport)
 	}
@@ -78,50 +220,101 @@ func NewScraper(name, metricsEndpoint string, extraMetricLabels []*dto.LabelPair
 		client.Transport = roundtrippers.NewBearerToken(defOpts.bearerToken, client.Transport)
 	}
 
+	accept, err := acceptHeader(defOpts.protocols)
+	if err != nil {
+		return nil, err
+	}
+
 	metricsEndpoint = strings.TrimRight(metricsEndpoint, "/")
 	req, err := http.NewRequest("GET", metricsEndpoint, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http request: %w", err)
 	}
-	req.Header.Add("Accept", `text/plain;version=0.0.4;q=1,*/*;q=0.1`)
+	req.Header.Add("Accept", accept)
 	req.Header.Add("Accept-Encoding", "gzip")
 	req.Header.Set("User-Agent", "Prometheus/2.3.0")
 	req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", fmt.Sprintf("%f", defOpts.timeout.Seconds()))
 
+	// the target labels tell the scrape metrics of targets sharing a name apart
+	targetLabels := prometheus.Labels{}
+	for _, l := range extraMetricLabels {
+		targetLabels[l.GetName()] = l.GetValue()
+	}
+
 	return &Scraper{
 		req:               req,
 		name:              name,
 		extraMetricLabels: extraMetricLabels,
 		whitelist:         whitelist,
 		timeout:           defOpts.timeout,
+		sampleLimit:       defOpts.sampleLimit,
+		bodySizeLimit:     defOpts.bodySizeLimit,
+		serveStale:        defOpts.serveStale,
+		labelConflict:     defOpts.labelConflict,
+		relabelConfigs:    defOpts.relabelConfigs[name],
 		logLevel:          defOpts.logLevel,
 		client:            client,
+		statDescs:         newStatDescs(name, targetLabels),
 		scrapeDurationDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(name, "scrape", "collector_duration_seconds"),
 			fmt.Sprintf("%s: Duration of a collector scrape.", name),
 			[]string{"collector"},
-			nil,
+			targetLabels,
 		),
 		scrapeSuccessDesc: prometheus.NewDesc(
 			prometheus.BuildFQName(name, "scrape", "collector_success"),
 			fmt.Sprintf("%s: Whether a collector succeeded.", name),
 			[]string{"collector"},
-			nil,
+			targetLabels,
+		),
+		scrapeStalenessDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(name, "scrape", "collector_staleness_seconds"),
+			fmt.Sprintf("%s: Age of the last successful collector scrape.", name),
+			[]string{"collector"},
+			targetLabels,
 		),
 	}, nil
 }
 
+// parseUnixEndpoint splits a unix:///path/to.sock:/metrics endpoint into the
+// socket path and an HTTP URL to request over it. The HTTP path defaults to /
+func parseUnixEndpoint(endpoint string) (socket, httpEndpoint string, ok bool) {
+	rest, ok := strings.CutPrefix(endpoint, unixScheme)
+	if !ok {
+		return "", "", false
+	}
+	socket, path, found := strings.Cut(rest, ":")
+	if !found || path == "" {
+		path = "/"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return socket, "http://localhost" + path, true
+}
+
 // Scraper is a remote metric scraper that scrapes HTTP endpoints
 type Scraper struct {
-	timeout            time.Duration
-	logLevel           log.Level
-	req                *http.Request
-	client             *http.Client
-	name               string
-	whitelist          map[string]bool
-	extraMetricLabels  []*dto.LabelPair
-	scrapeDurationDesc *prometheus.Desc
-	scrapeSuccessDesc  *prometheus.Desc
+	timeout             time.Duration
+	logLevel            log.Level
+	req                 *http.Request
+	client              *http.Client
+	name                string
+	whitelist           map[string]bool
+	extraMetricLabels   []*dto.LabelPair
+	sampleLimit         int
+	bodySizeLimit       int64
+	serveStale          time.Duration
+	labelConflict       decorate.LabelConflictPolicy
+	relabelConfigs      []*relabel.Config
+	scrapeDurationDesc  *prometheus.Desc
+	scrapeSuccessDesc   *prometheus.Desc
+	scrapeStalenessDesc *prometheus.Desc
+	statDescs           statDescs
+
+	m          sync.Mutex
+	lastGood   []prometheus.Metric
+	lastGoodAt time.Time
 }
 
 // log emits log messages respecting the scraper's log level.
@@ -138,8 +331,8 @@ func (s *Scraper) log(msg string, params ...interface{}) {
 }
 
 // readStream makes an HTTP request to the remote and returns the response body
-// upon successful response
-func (s *Scraper) readStream(ctx context.Context) (r io.ReadCloser, outerr error) {
+// and its format upon successful response
+func (s *Scraper) readStream(ctx context.Context, st *scrapeStats) (r io.ReadCloser, format expfmt.FormatType, outerr error) {
 	// close the reader if we return an error
 	defer func() {
 		if outerr == nil || r == nil {
@@ -154,73 +347,168 @@ func (s *Scraper) readStream(ctx context.Context) (r io.ReadCloser, outerr error
 
 	resp, err := s.client.Do(s.req.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %w", err)
+		return nil, format, fmt.Errorf("HTTP request failed: %w", err)
 	}
 
+	st.status = resp.StatusCode
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned bad HTTP status %s", resp.Status)
+		return resp.Body, format, &scrapeError{reasonHTTPStatus, fmt.Errorf("server returned bad HTTP status %s", resp.Status)}
 	}
 
+	format = responseFormat(resp.Header)
 	if resp.Header.Get("Content-Encoding") != "gzip" {
-		return resp.Body, nil
+		return resp.Body, format, nil
 	}
 
 	reader, err := gzip.NewReader(bufio.NewReader(resp.Body))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		return resp.Body, format, &scrapeError{reasonDecompress, fmt.Errorf("failed to create gzip reader: %w", err)}
 	}
 
-	return reader, nil
+	return reader, format, nil
 }
 
 // Describe describes this collector
 func (s *Scraper) Describe(ch chan<- *prometheus.Desc) {
 	ch <- s.scrapeDurationDesc
 	ch <- s.scrapeSuccessDesc
+	s.statDescs.describe(ch)
+	if s.serveStale > 0 {
+		ch <- s.scrapeStalenessDesc
+	}
 }
 
 // Collect collectrs metrics from the remote endpoint and reports them to ch
 func (s *Scraper) Collect(ch chan<- prometheus.Metric) {
-	var failed bool
-	defer func(start time.Time) {
-		dur := time.Since(start).Seconds()
-		var success float64
-		if !failed {
-			success = 1
-		}
-		ch <- prometheus.MustNewConstMetric(s.scrapeDurationDesc, prometheus.GaugeValue, dur, s.Name())
-		ch <- prometheus.MustNewConstMetric(s.scrapeSuccessDesc, prometheus.GaugeValue, success, s.Name())
-	}(time.Now())
-
+	start := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
 	defer cancel()
 
-	if err := s.scrape(ctx, ch); err != nil {
-		failed = true
+	var success float64
+	var st scrapeStats
+	mets, err := s.scrape(ctx, &st)
+	if err != nil {
+		st.err = err
 		s.log("collection failed for %q: %v", s.Name(), err)
+	} else {
+		success = 1
+	}
+
+	if s.serveStale > 0 {
+		var age time.Duration
+		var ok bool
+		mets, age, ok = s.cache(mets, err, start)
+		if ok {
+			ch <- prometheus.MustNewConstMetric(s.scrapeStalenessDesc, prometheus.GaugeValue, age.Seconds(), s.Name())
+		}
+	}
+
+	for _, m := range mets {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(s.scrapeDurationDesc, prometheus.GaugeValue, time.Since(start).Seconds(), s.Name())
+	ch <- prometheus.MustNewConstMetric(s.scrapeSuccessDesc, prometheus.GaugeValue, success, s.Name())
+	s.statDescs.collect(ch, st, s.Name())
+}
+
+// cache remembers the result of a successful scrape. When a scrape fails the
+// last good result is returned instead as long as it is no older than the
+// configured limit. The age of the last good result is returned if there is one
+func (s *Scraper) cache(mets []prometheus.Metric, err error, now time.Time) ([]prometheus.Metric, time.Duration, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err == nil {
+		s.lastGood, s.lastGoodAt = mets, now
+		return mets, 0, true
+	}
+	if s.lastGoodAt.IsZero() {
+		return nil, 0, false
+	}
+
+	age := now.Sub(s.lastGoodAt)
+	if age > s.serveStale {
+		s.lastGood = nil
+		return nil, age, true
 	}
+	s.log("serving %s old result for %q", age, s.Name())
+	return s.lastGood, age, true
 }
 
-func (s *Scraper) scrape(ctx context.Context, ch chan<- prometheus.Metric) (outerr error) {
-	stream, err := s.readStream(ctx)
+// scrape returns the metrics of the remote endpoint which pass the whitelist
+func (s *Scraper) scrape(ctx context.Context, st *scrapeStats) ([]prometheus.Metric, error) {
+	stream, format, err := s.readStream(ctx, st)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer stream.Close()
 
-	parsed, err := new(expfmt.TextParser).TextToMetricFamilies(stream)
+	body := &bodyReader{r: stream, limit: s.bodySizeLimit}
+	parsed, err := parseMetricFamilies(body, format)
+	st.bytes = body.n
+	if body.exceeded() {
+		return nil, &scrapeError{reasonBodySizeLimit, fmt.Errorf("%w of %d bytes", ErrBodySizeLimit, s.bodySizeLimit)}
+	}
 	if err != nil {
-		return fmt.Errorf("parsing message failed: %w", err)
+		return nil, &scrapeError{reasonParse, fmt.Errorf("parsing message failed: %w", err)}
 	}
 
-	for _, mf := range parsed {
+	for name, mf := range parsed {
+		st.samples += len(mf.Metric)
 		if s.FilterMetric(mf) {
-			continue
+			delete(parsed, name)
 		}
-		convertMetricFamily(mf, ch, s.extraMetricLabels)
+	}
+	extraLabels := s.extraMetricLabels
+	if len(s.relabelConfigs) > 0 {
+		parsed = s.relabel(parsed)
+		// the scraper's labels were added before relabeling
+		extraLabels = nil
+	}
+	for _, mf := range parsed {
+		st.postWhitelist += len(mf.Metric)
+	}
+	if s.sampleLimit > 0 && st.postWhitelist > s.sampleLimit {
+		return nil, &scrapeError{reasonSampleLimit, fmt.Errorf("%w: %d samples exceed the limit of %d", ErrSampleLimit, st.postWhitelist, s.sampleLimit)}
 	}
 
-	return nil
+	// every sample is converted into at most one metric
+	ch := make(chan prometheus.Metric, st.postWhitelist)
+	for _, mf := range parsed {
+		convertMetricFamily(mf, ch, extraLabels, s.labelConflict)
+	}
+	close(ch)
+
+	mets := make([]prometheus.Metric, 0, st.postWhitelist)
+	for m := range ch {
+		mets = append(mets, m)
+	}
+	return mets, nil
+}
+
+// relabel adds the scraper's labels to the samples of families and relabels
+// them
+func (s *Scraper) relabel(families map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	mfs := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			m.Label = decorate.MergeLabels(m.Label, s.extraMetricLabels, s.labelConflict)
+		}
+		mfs = append(mfs, mf)
+	}
+
+	relabeled := make(map[string]*dto.MetricFamily, len(mfs))
+	for _, mf := range relabel.Families(mfs, s.relabelConfigs) {
+		relabeled[mf.GetName()] = mf
+	}
+	return relabeled
+}
+
+// StatNames returns the names of the metrics describing the scrapes of this
+// scraper: up, samples scraped and post whitelist, response bytes, HTTP status
+// and the last error
+func (s *Scraper) StatNames() []string {
+	return append([]string(nil), s.statDescs.names...)
 }
 
 // Name returns the name of this scraper
@@ -243,14 +531,18 @@ func (s *Scraper) FilterMetric(metricFamily *dto.MetricFamily) bool {
 // this was copied and extended/refactored from github.com/prometheus/node_exporter
 // see https://github.com/prometheus/node_exporter/blob/f56e8fcdf48ead56f1f149dbf1301ac028ef589b/collector/textfile.go#L63
 // for more details
-func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Metric, extraLabels []*dto.LabelPair) {
+func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Metric, extraLabels []*dto.LabelPair, policy decorate.LabelConflictPolicy) {
 	var valType prometheus.ValueType
 	var val float64
 
-	allLabelNames := getAllLabelNames(metricFamily, extraLabels)
+	labelSets := make([][]*dto.LabelPair, len(metricFamily.Metric))
+	for i, metric := range metricFamily.Metric {
+		labelSets[i] = decorate.MergeLabels(metric.GetLabel(), extraLabels, policy)
+	}
+	allLabelNames := getAllLabelNames(labelSets)
 
-	for _, metric := range metricFamily.Metric {
-		names, values := getLabelNamesAndValues(metric, extraLabels, allLabelNames)
+	for i, metric := range metricFamily.Metric {
+		names, values := getLabelNamesAndValues(labelSets[i], allLabelNames)
 
 		metricType := metricFamily.GetType()
 		switch metricType {
@@ -282,20 +574,16 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 				quantiles, values...,
 			)
 		case dto.MetricType_HISTOGRAM:
-			buckets := map[float64]uint64{}
-			for _, b := range metric.Histogram.Bucket {
-				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
-			}
-			ch <- prometheus.MustNewConstHistogram(
-				prometheus.NewDesc(
-					*metricFamily.Name,
-					metricFamily.GetHelp(),
-					names, nil,
-				),
-				metric.Histogram.GetSampleCount(),
-				metric.Histogram.GetSampleSum(),
-				buckets, values...,
+			desc := prometheus.NewDesc(
+				*metricFamily.Name,
+				metricFamily.GetHelp(),
+				names, nil,
 			)
+			ch <- &histogramMetric{
+				desc:   desc,
+				labels: prometheus.MakeLabelPairs(desc, values),
+				h:      metric.Histogram,
+			}
 		default:
 			log.Error("unknown metric type %q", metricType.String())
 			continue
@@ -313,12 +601,33 @@ func convertMetricFamily(metricFamily *dto.MetricFamily, ch chan<- prometheus.Me
 	}
 }
 
-// getLabelNamesAndValues returns a slice of label names and a slice of label values from the metric and extra labels.
-func getLabelNamesAndValues(metric *dto.Metric, extraLabels []*dto.LabelPair, allLabelNames map[string]struct{}) ([]string, []string) {
-	labels := metric.GetLabel()
-	if extraLabels != nil {
-		labels = append(labels, extraLabels...)
+// histogramMetric passes a scraped histogram through unchanged. Unlike
+// prometheus.NewConstHistogram it keeps native histogram buckets and exemplars
+// which are only available when scraping the protobuf format
+type histogramMetric struct {
+	desc   *prometheus.Desc
+	labels []*dto.LabelPair
+	h      *dto.Histogram
+}
+
+// Desc returns the descriptor of the histogram
+func (m *histogramMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+// Write writes a copy of the histogram to out. The metric may be served again
+// from the cache of stale results so out must not share anything with it
+func (m *histogramMetric) Write(out *dto.Metric) error {
+	out.Label = make([]*dto.LabelPair, len(m.labels))
+	for i, l := range m.labels {
+		out.Label[i] = proto.Clone(l).(*dto.LabelPair)
 	}
+	out.Histogram = proto.Clone(m.h).(*dto.Histogram)
+	return nil
+}
+
+// getLabelNamesAndValues returns a slice of label names and a slice of label values from the labels of a metric.
+func getLabelNamesAndValues(labels []*dto.LabelPair, allLabelNames map[string]struct{}) ([]string, []string) {
 	names := make([]string, len(labels))
 	values := make([]string, len(labels))
 	for i, label := range labels {
@@ -341,14 +650,10 @@ func getLabelNamesAndValues(metric *dto.Metric, extraLabels []*dto.LabelPair, al
 	return names, values
 }
 
-// getAllLabelNames returns the map of all label names from the metric family including any extra labels provided.
-func getAllLabelNames(metricFamily *dto.MetricFamily, extraLabels []*dto.LabelPair) map[string]struct{} {
+// getAllLabelNames returns the map of all label names used by the metrics of a family.
+func getAllLabelNames(labelSets [][]*dto.LabelPair) map[string]struct{} {
 	allLabelNames := map[string]struct{}{}
-	for _, metric := range metricFamily.Metric {
-		labels := metric.GetLabel()
-		if extraLabels != nil {
-			labels = append(labels, extraLabels...)
-		}
+	for _, labels := range labelSets {
 		for _, label := range labels {
 			if _, ok := allLabelNames[label.GetName()]; !ok {
 				allLabelNames[label.GetName()] = struct{}{}
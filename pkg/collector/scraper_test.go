@@ -1,9 +1,16 @@
 package collector
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/pem"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,9 +18,14 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/clients"
+	"github.com/digitalocean/do-agent/pkg/decorate"
+	"github.com/digitalocean/do-agent/pkg/relabel"
 )
 
 var testmetrics = `# HELP kube_configmap_info Information about configmap.
@@ -125,3 +137,456 @@ func TestWhitelist(t *testing.T) {
 	// There are 3 whitelisted metrics we expected to receive
 	require.Equal(t, 3, whitelist)
 }
+
+func TestScraperNegotiatesProtobuf(t *testing.T) {
+	mfs := []*dto.MetricFamily{
+		{
+			Name: proto.String("requests_total"),
+			Help: proto.String("Total requests."),
+			Type: dto.MetricType_COUNTER.Enum(),
+			Metric: []*dto.Metric{{
+				Label:   []*dto.LabelPair{{Name: proto.String("code"), Value: proto.String("200")}},
+				Counter: &dto.Counter{Value: proto.Float64(42)},
+			}},
+		},
+		{
+			Name: proto.String("request_duration_seconds"),
+			Help: proto.String("Request latency."),
+			Type: dto.MetricType_HISTOGRAM.Enum(),
+			Metric: []*dto.Metric{{
+				Histogram: &dto.Histogram{
+					SampleCount:   proto.Uint64(3),
+					SampleSum:     proto.Float64(1.5),
+					Schema:        proto.Int32(3),
+					ZeroThreshold: proto.Float64(1e-128),
+					ZeroCount:     proto.Uint64(0),
+					PositiveSpan:  []*dto.BucketSpan{{Offset: proto.Int32(0), Length: proto.Uint32(2)}},
+					PositiveDelta: []int64{1, 1},
+				},
+			}},
+		},
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.Negotiate(r.Header)
+		require.Equal(t, expfmt.TypeProtoDelim, format.FormatType())
+		w.Header().Set("Content-Type", string(format))
+		enc := expfmt.NewEncoder(w, format)
+		for _, mf := range mfs {
+			assert.NoError(t, enc.Encode(mf))
+		}
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, nil, WithTimeout(30*time.Second))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	gathered, err := reg.Gather()
+	require.NoError(t, err)
+
+	got := map[string]*dto.MetricFamily{}
+	for _, mf := range gathered {
+		got[mf.GetName()] = mf
+	}
+
+	require.Contains(t, got, "requests_total")
+	assert.Equal(t, float64(42), got["requests_total"].Metric[0].GetCounter().GetValue())
+
+	require.Contains(t, got, "request_duration_seconds")
+	h := got["request_duration_seconds"].Metric[0].GetHistogram()
+	assert.Equal(t, int32(3), h.GetSchema())
+	assert.Equal(t, []int64{1, 1}, h.GetPositiveDelta())
+	assert.Equal(t, uint64(3), h.GetSampleCount())
+}
+
+func TestScraperFallsBackToText(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, nil, WithTimeout(30*time.Second), WithScrapeProtocols(PrometheusText0))
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain;version=0.0.4;q=0.9,*/*;q=0.1", s.req.Header.Get("Accept"))
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	gathered, err := reg.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, mf := range gathered {
+		names = append(names, mf.GetName())
+	}
+	assert.Contains(t, names, "kube_configmap_info")
+}
+
+func TestNewScraperRejectsUnknownProtocol(t *testing.T) {
+	_, err := NewScraper("testscraper", "http://localhost", nil, nil, WithScrapeProtocols("Carrier Pigeon"))
+	assert.Error(t, err)
+}
+
+func TestScraperTLSAndBasicAuth(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "scraper" || pass != "hunter2" || r.Header.Get("X-Tenant") != "droplet" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, os.WriteFile(caFile, ca, 0600))
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("hunter2\n"), 0600))
+
+	s, err := NewScraper("testscraper", ts.URL, nil, nil,
+		WithTimeout(30*time.Second),
+		WithTLSConfig(clients.TLSConfig{CAFile: caFile, ServerName: "example.com"}),
+		WithBasicAuthPasswordFile("scraper", passwordFile),
+		WithHeaders(map[string]string{"X-Tenant": "droplet"}),
+	)
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	gathered, err := reg.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, mf := range gathered {
+		names = append(names, mf.GetName())
+	}
+	assert.Contains(t, names, "kube_configmap_info")
+}
+
+func TestNewScraperRejectsInvalidTLSConfig(t *testing.T) {
+	_, err := NewScraper("testscraper", "https://localhost", nil, nil,
+		WithTLSConfig(clients.TLSConfig{CertFile: "testdata/missing.crt"}))
+	assert.Error(t, err)
+
+	_, err = NewScraper("testscraper", "https://localhost", nil, nil,
+		WithTLSConfig(clients.TLSConfig{CAFile: "testdata/missing.pem"}))
+	assert.Error(t, err)
+}
+
+func TestScraperUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "metrics.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/custom/metrics" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		_, err := io.WriteString(gz, testmetrics)
+		assert.NoError(t, err)
+		assert.NoError(t, gz.Close())
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	s, err := NewScraper("testscraper", "unix://"+socket+":/custom/metrics", nil, nil, WithTimeout(30*time.Second))
+	require.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	gathered, err := reg.Gather()
+	require.NoError(t, err)
+
+	var names []string
+	for _, mf := range gathered {
+		names = append(names, mf.GetName())
+		if mf.GetName() == "testscraper_scrape_collector_success" {
+			assert.Equal(t, float64(1), mf.Metric[0].GetGauge().GetValue())
+		}
+	}
+	assert.Contains(t, names, "kube_configmap_info")
+}
+
+func TestParseUnixEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		socket   string
+		url      string
+		ok       bool
+	}{
+		{"unix:///run/app.sock:/metrics", "/run/app.sock", "http://localhost/metrics", true},
+		{"unix:///run/app.sock", "/run/app.sock", "http://localhost/", true},
+		{"unix:///run/app.sock:metrics", "/run/app.sock", "http://localhost/metrics", true},
+		{"http://localhost:9100/metrics", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			socket, url, ok := parseUnixEndpoint(tt.endpoint)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.socket, socket)
+			assert.Equal(t, tt.url, url)
+		})
+	}
+}
+
+// gatherScraper registers s on a new registry and returns the gathered
+// families by name
+func gatherScraper(t *testing.T, s *Scraper) map[string]*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+
+	byName := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		byName[mf.GetName()] = mf
+	}
+	return byName
+}
+
+func TestScraperLimits(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		success float64
+	}{
+		{"no limits", nil, 1},
+		{"samples within limit", []Option{WithSampleLimit(9)}, 1},
+		{"too many samples", []Option{WithSampleLimit(8)}, 0},
+		{"body within limit", []Option{WithBodySizeLimit(int64(len(testmetrics)))}, 1},
+		{"body too large", []Option{WithBodySizeLimit(int64(len(testmetrics)) - 1)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewScraper("testscraper", ts.URL, nil, nil, append(tt.opts, WithTimeout(30*time.Second))...)
+			require.NoError(t, err)
+
+			mfs := gatherScraper(t, s)
+			assert.Equal(t, tt.success, mfs["testscraper_scrape_collector_success"].Metric[0].GetGauge().GetValue())
+			assert.Equal(t, tt.success, mfs["testscraper_up"].Metric[0].GetGauge().GetValue())
+			if tt.success == 0 {
+				assert.NotContains(t, mfs, "kube_configmap_info")
+			} else {
+				assert.Contains(t, mfs, "kube_configmap_info")
+			}
+		})
+	}
+}
+
+func TestScraperSampleLimitAppliesAfterWhitelist(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, map[string]bool{"kube_configmap_info": true}, WithSampleLimit(3))
+	require.NoError(t, err)
+
+	mets, err := s.scrape(context.Background(), &scrapeStats{})
+	require.NoError(t, err)
+	assert.Len(t, mets, 3)
+
+	s.sampleLimit = 2
+	_, err = s.scrape(context.Background(), &scrapeStats{})
+	assert.ErrorIs(t, err, ErrSampleLimit)
+}
+
+func TestScraperServesStaleResults(t *testing.T) {
+	var failing atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, nil, WithServeStale(time.Minute))
+	require.NoError(t, err)
+
+	mfs := gatherScraper(t, s)
+	assert.Equal(t, float64(0), mfs["testscraper_scrape_collector_staleness_seconds"].Metric[0].GetGauge().GetValue())
+
+	failing.Store(true)
+	mfs = gatherScraper(t, s)
+	assert.Equal(t, float64(0), mfs["testscraper_scrape_collector_success"].Metric[0].GetGauge().GetValue())
+	assert.Contains(t, mfs, "kube_configmap_info")
+	assert.Greater(t, mfs["testscraper_scrape_collector_staleness_seconds"].Metric[0].GetGauge().GetValue(), float64(0))
+
+	// results older than the limit are no longer served
+	s.lastGoodAt = s.lastGoodAt.Add(-2 * time.Minute)
+	mfs = gatherScraper(t, s)
+	assert.NotContains(t, mfs, "kube_configmap_info")
+	assert.Greater(t, mfs["testscraper_scrape_collector_staleness_seconds"].Metric[0].GetGauge().GetValue(), float64(120))
+}
+
+func TestScraperStats(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	s, err := NewScraper("testscraper", ts.URL, nil, map[string]bool{"kube_configmap_info": true})
+	require.NoError(t, err)
+
+	value := func(mfs map[string]*dto.MetricFamily, name string) float64 {
+		require.Contains(t, mfs, name)
+		return mfs[name].Metric[0].GetGauge().GetValue()
+	}
+	reason := func(mfs map[string]*dto.MetricFamily) string {
+		if _, ok := mfs["testscraper_scrape_last_error"]; !ok {
+			return ""
+		}
+		for _, l := range mfs["testscraper_scrape_last_error"].Metric[0].Label {
+			if l.GetName() == "reason" {
+				return l.GetValue()
+			}
+		}
+		return "missing"
+	}
+
+	mfs := gatherScraper(t, s)
+	assert.Equal(t, float64(1), value(mfs, "testscraper_up"))
+	assert.Equal(t, float64(9), value(mfs, "testscraper_scrape_samples_scraped"))
+	assert.Equal(t, float64(3), value(mfs, "testscraper_scrape_samples_post_whitelist"))
+	assert.Equal(t, float64(len(testmetrics)), value(mfs, "testscraper_scrape_response_bytes"))
+	assert.Equal(t, float64(200), value(mfs, "testscraper_scrape_http_status_code"))
+	assert.NotContains(t, mfs, "testscraper_scrape_last_error")
+
+	status.Store(http.StatusServiceUnavailable)
+	mfs = gatherScraper(t, s)
+	assert.Equal(t, float64(0), value(mfs, "testscraper_up"))
+	assert.Equal(t, float64(503), value(mfs, "testscraper_scrape_http_status_code"))
+	assert.Equal(t, "http_status", reason(mfs))
+
+	assert.Contains(t, s.StatNames(), "testscraper_up")
+	assert.Contains(t, s.StatNames(), "testscraper_scrape_last_error")
+	assert.NotContains(t, s.StatNames(), "testscraper_scrape_collector_success")
+}
+
+func TestScraperLabelConflictPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, "up{instance=\"scraped\"} 1\nup{instance=\"other\"} 0\n")
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	labelName, labelValue := "instance", "target"
+	extra := []*dto.LabelPair{{Name: &labelName, Value: &labelValue}}
+
+	tests := []struct {
+		policy decorate.LabelConflictPolicy
+		want   []map[string]string
+	}{
+		{decorate.HonorLabels, []map[string]string{{"instance": "other"}, {"instance": "scraped"}}},
+		{decorate.RenameLabels, []map[string]string{
+			{"instance": "target", "exported_instance": "other"},
+			{"instance": "target", "exported_instance": "scraped"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			s, err := NewScraper("testscraper", ts.URL, extra, nil, WithTimeout(30*time.Second), WithLabelConflictPolicy(tt.policy))
+			require.NoError(t, err)
+
+			mfs := gatherScraper(t, s)
+			require.Contains(t, mfs, "up")
+			var got []map[string]string
+			for _, m := range mfs["up"].Metric {
+				labels := map[string]string{}
+				for _, l := range m.GetLabel() {
+					labels[l.GetName()] = l.GetValue()
+				}
+				got = append(got, labels)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// both series collapse into one when scraped labels are overwritten
+	s, err := NewScraper("testscraper", ts.URL, extra, nil, WithTimeout(30*time.Second), WithLabelConflictPolicy(decorate.OverwriteLabels))
+	require.NoError(t, err)
+	reg := prometheus.NewRegistry()
+	require.NoError(t, reg.Register(s))
+	_, err = reg.Gather()
+	assert.Error(t, err)
+}
+
+func TestScraperRelabelConfigs(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, testmetrics)
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	labelName, labelValue := "node", "worker-1"
+	extra := []*dto.LabelPair{{Name: &labelName, Value: &labelValue}}
+	cfgs := map[string][]*relabel.Config{
+		"testscraper": {
+			{SourceLabels: []string{"__name__"}, Regex: relabel.MustNewRegex("kube_configmap_(created|metadata.*)"), Action: relabel.Drop},
+			{SourceLabels: []string{"node", "configmap"}, Separator: "/", Regex: relabel.MustNewRegex("(.*)"),
+				TargetLabel: "instance", Replacement: "$1", Action: relabel.Replace},
+			{Regex: relabel.MustNewRegex("namespace"), Action: relabel.LabelDrop},
+		},
+		"other": {{SourceLabels: []string{"__name__"}, Regex: relabel.MustNewRegex(".*"), Action: relabel.Drop}},
+	}
+	s, err := NewScraper("testscraper", ts.URL, extra, nil, WithRelabelConfigs(cfgs), WithSampleLimit(3))
+	require.NoError(t, err)
+
+	var st scrapeStats
+	mets, err := s.scrape(context.Background(), &st)
+	require.NoError(t, err)
+	assert.Equal(t, 3, st.postWhitelist)
+	require.Len(t, mets, 3)
+
+	for _, m := range mets {
+		out := &dto.Metric{}
+		require.NoError(t, m.Write(out))
+		labels := map[string]string{}
+		for _, l := range out.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		assert.NotContains(t, labels, "namespace")
+		assert.Equal(t, "worker-1/"+labels["configmap"], labels["instance"])
+	}
+}
+
+func TestHistogramMetricWritesCopies(t *testing.T) {
+	m := &histogramMetric{
+		labels: []*dto.LabelPair{{Name: proto.String("path"), Value: proto.String("/")}},
+		h:      &dto.Histogram{SampleCount: proto.Uint64(1)},
+	}
+
+	var out dto.Metric
+	require.NoError(t, m.Write(&out))
+	out.Label[0].Value = proto.String("/changed")
+	out.Label = append(out.Label, &dto.LabelPair{})
+	out.Histogram.SampleCount = proto.Uint64(2)
+
+	assert.Len(t, m.labels, 1)
+	assert.Equal(t, "/", m.labels[0].GetValue())
+	assert.Equal(t, uint64(1), m.h.GetSampleCount())
+}
@@ -4,20 +4,113 @@ import (
 	dto "github.com/prometheus/client_model/go"
 )
 
-// LabelAppender is a list of label pairs that need to be added on all metrics
+// LabelConflictPolicy decides how labels being added are merged with labels a
+// metric already has with the same name
+type LabelConflictPolicy string
+
+const (
+	// HonorLabels keeps the existing label and ignores the added one
+	HonorLabels LabelConflictPolicy = "honor"
+	// OverwriteLabels replaces the existing label with the added one
+	OverwriteLabels LabelConflictPolicy = "overwrite"
+	// RenameLabels keeps both, renaming the existing label to exported_<name>
+	RenameLabels LabelConflictPolicy = "rename"
+)
+
+// exportedPrefix is prepended to conflicting labels renamed by RenameLabels
+const exportedPrefix = "exported_"
+
+// LabelConflictPolicies returns the names of all label conflict policies
+func LabelConflictPolicies() []string {
+	return []string{string(HonorLabels), string(OverwriteLabels), string(RenameLabels)}
+}
+
+// MergeLabels returns labels with extra added, resolving labels present in
+// both according to policy. Neither slice is modified
+func MergeLabels(labels, extra []*dto.LabelPair, policy LabelConflictPolicy) []*dto.LabelPair {
+	merged := make([]*dto.LabelPair, 0, len(labels)+len(extra))
+	if len(extra) == 0 {
+		return append(merged, labels...)
+	}
+
+	names := make(map[string]bool, len(labels)+len(extra))
+	extraNames := make(map[string]bool, len(extra))
+	for _, l := range extra {
+		names[l.GetName()] = true
+		extraNames[l.GetName()] = true
+	}
+	for _, l := range labels {
+		names[l.GetName()] = true
+	}
+
+	honored := map[string]bool{}
+	for _, l := range labels {
+		name := l.GetName()
+		if !extraNames[name] {
+			merged = append(merged, l)
+			continue
+		}
+
+		switch policy {
+		case HonorLabels:
+			honored[name] = true
+			merged = append(merged, l)
+		case RenameLabels:
+			renamed := exportedPrefix + name
+			for names[renamed] {
+				renamed = exportedPrefix + renamed
+			}
+			names[renamed] = true
+			merged = append(merged, &dto.LabelPair{Name: &renamed, Value: l.Value})
+		default:
+			// OverwriteLabels drops the existing label for the added one
+		}
+	}
+
+	for _, l := range extra {
+		if !honored[l.GetName()] {
+			merged = append(merged, l)
+		}
+	}
+	return merged
+}
+
+// LabelAppender is a list of label pairs that need to be added on all metrics.
+// Labels a metric already has are overwritten unless another policy is set
+// with WithConflictPolicy
 type LabelAppender []*dto.LabelPair
 
 // Decorate adds metric labels from its list
 func (l LabelAppender) Decorate(mfs []*dto.MetricFamily) {
+	l.WithConflictPolicy(OverwriteLabels).Decorate(mfs)
+}
+
+// Name is the name of this decorator
+func (LabelAppender) Name() string {
+	return "LabelsAppender"
+}
+
+// WithConflictPolicy returns a decorator adding the labels which resolves
+// conflicts with existing labels according to policy
+func (l LabelAppender) WithConflictPolicy(policy LabelConflictPolicy) Decorator {
+	return policyLabelAppender{labels: l, policy: policy}
+}
+
+type policyLabelAppender struct {
+	labels LabelAppender
+	policy LabelConflictPolicy
+}
+
+// Decorate adds metric labels from its list
+func (p policyLabelAppender) Decorate(mfs []*dto.MetricFamily) {
 	for _, fam := range mfs {
-		metrics := fam.GetMetric()
-		for _, metric := range metrics {
-			metric.Label = append(metric.Label, l...)
+		for _, metric := range fam.GetMetric() {
+			metric.Label = MergeLabels(metric.Label, p.labels, p.policy)
 		}
 	}
 }
 
 // Name is the name of this decorator
-func (LabelAppender) Name() string {
-	return "LabelsAppender"
+func (p policyLabelAppender) Name() string {
+	return p.labels.Name()
 }
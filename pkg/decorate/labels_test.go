@@ -122,3 +122,58 @@ func TestAppendLabelsToEmptyMetric(t *testing.T) {
 	decorator.Decorate(items)
 	require.Equal(t, 0, len(items[0].Metric))
 }
+
+func labelPairs(kv ...string) []*dto.LabelPair {
+	var pairs []*dto.LabelPair
+	for i := 0; i < len(kv); i += 2 {
+		pairs = append(pairs, &dto.LabelPair{Name: sPtr(kv[i]), Value: sPtr(kv[i+1])})
+	}
+	return pairs
+}
+
+func TestMergeLabels(t *testing.T) {
+	labels := labelPairs("instance", "scraped", "exported_job", "taken", "path", "/")
+	extra := labelPairs("instance", "added", "job", "agent", "exported_job", "extra")
+
+	tests := []struct {
+		policy LabelConflictPolicy
+		want   []*dto.LabelPair
+	}{
+		{
+			policy: HonorLabels,
+			want:   labelPairs("instance", "scraped", "exported_job", "taken", "path", "/", "job", "agent"),
+		},
+		{
+			policy: OverwriteLabels,
+			want:   labelPairs("path", "/", "instance", "added", "job", "agent", "exported_job", "extra"),
+		},
+		{
+			policy: RenameLabels,
+			want: labelPairs("exported_instance", "scraped", "exported_exported_job", "taken", "path", "/",
+				"instance", "added", "job", "agent", "exported_job", "extra"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			require.Equal(t, tt.want, MergeLabels(labels, extra, tt.policy))
+			require.Equal(t, labelPairs("instance", "scraped", "exported_job", "taken", "path", "/"), labels)
+		})
+	}
+}
+
+func TestAppendLabelsWithConflictPolicy(t *testing.T) {
+	items := []*dto.MetricFamily{
+		{
+			Name:   sPtr("sonar_cpu"),
+			Metric: []*dto.Metric{{Label: labelPairs("user_id", "1", "cpu", "0")}},
+		},
+	}
+
+	decorator := LabelAppender(labelPairs("user_id", "1234"))
+	decorator.WithConflictPolicy(HonorLabels).Decorate(items)
+	require.Equal(t, labelPairs("user_id", "1", "cpu", "0"), items[0].Metric[0].Label)
+	require.Equal(t, decorator.Name(), decorator.WithConflictPolicy(HonorLabels).Name())
+
+	decorator.Decorate(items)
+	require.Equal(t, labelPairs("cpu", "0", "user_id", "1234"), items[0].Metric[0].Label)
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// FileSource is the name of targets discovered from files
+const FileSource = "file"
+
+// FileDiscoverer discovers targets from files in the Prometheus file_sd
+// format. Files are JSON unless their extension is .yml or .yaml. On Linux
+// the directories of the files are watched with inotify so changes are picked
+// up immediately, they are polled as well in case a change is missed
+type FileDiscoverer struct {
+	patterns []string
+	interval time.Duration
+
+	// last holds the groups last read successfully from each file so a
+	// file being rewritten does not drop its targets
+	last map[string][]TargetGroup
+}
+
+// NewFileDiscoverer creates a new FileDiscoverer reading all files matching
+// the glob patterns every interval
+func NewFileDiscoverer(patterns []string, interval time.Duration) (*FileDiscoverer, error) {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid file pattern %q: %w", p, err)
+		}
+	}
+	return &FileDiscoverer{
+		patterns: patterns,
+		interval: interval,
+		last:     map[string][]TargetGroup{},
+	}, nil
+}
+
+// Run syncs the targets found with m immediately and then whenever a file
+// changes or the interval passes, until ctx is done
+func (d *FileDiscoverer) Run(ctx context.Context, m *Manager) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	changes := watch(ctx, d.dirs())
+
+	for {
+		m.Sync(FileSource, d.Refresh())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+		}
+	}
+}
+
+// dirs returns the directories of the patterns. Patterns matching several
+// directories are only polled
+func (d *FileDiscoverer) dirs() []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, p := range d.patterns {
+		dir := filepath.Dir(p)
+		if strings.ContainsAny(dir, `*?[\`) || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// Refresh reads all files and returns the targets they describe
+func (d *FileDiscoverer) Refresh() []Target {
+	files := map[string]bool{}
+	for _, p := range d.patterns {
+		// patterns are validated when creating the discoverer
+		matches, _ := filepath.Glob(p)
+		for _, f := range matches {
+			files[f] = true
+		}
+	}
+
+	for f := range d.last {
+		if !files[f] {
+			delete(d.last, f)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	for f := range files {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+
+	var targets []Target
+	for _, f := range names {
+		groups, err := readTargetFile(f)
+		if err != nil {
+			log.Error("failed to read targets from %s, keeping previous targets: %v", f, err)
+			groups = d.last[f]
+		}
+
+		ts, err := Targets(groups)
+		if err != nil {
+			log.Error("invalid targets in %s, keeping previous targets: %v", f, err)
+			if ts, err = Targets(d.last[f]); err != nil {
+				continue
+			}
+		} else {
+			d.last[f] = groups
+		}
+		targets = append(targets, ts...)
+	}
+	return targets
+}
+
+// readTargetFile reads the target groups from a file_sd file
+func readTargetFile(path string) ([]TargetGroup, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []TargetGroup
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		err = yaml.Unmarshal(b, &groups)
+	default:
+		err = json.Unmarshal(b, &groups)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return groups, nil
+}
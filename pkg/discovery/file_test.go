@@ -0,0 +1,64 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDiscovererRefresh(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app.json"), `[
+		{"targets": ["10.0.0.1:9100", "10.0.0.2:9100"], "labels": {"job": "app"}}
+	]`)
+	writeFile(t, filepath.Join(dir, "sidecar.yaml"), `
+- targets: ["localhost:8080"]
+  labels:
+    job: sidecar
+    __metrics_path__: /internal/metrics
+    __scheme__: https
+    __meta_ignored: "true"
+`)
+
+	d, err := NewFileDiscoverer([]string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yaml")}, time.Minute)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Target{
+		{Endpoint: "http://10.0.0.1:9100/metrics", Labels: map[string]string{"job": "app", "instance": "10.0.0.1:9100"}},
+		{Endpoint: "http://10.0.0.2:9100/metrics", Labels: map[string]string{"job": "app", "instance": "10.0.0.2:9100"}},
+		{Endpoint: "https://localhost:8080/internal/metrics", Labels: map[string]string{"job": "sidecar", "instance": "localhost:8080"}},
+	}, d.Refresh())
+}
+
+func TestFileDiscovererKeepsTargetsOfInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	writeFile(t, path, `[{"targets": ["unix:///run/app.sock:/metrics"]}]`)
+
+	d, err := NewFileDiscoverer([]string{path}, time.Minute)
+	require.NoError(t, err)
+
+	want := []Target{{Endpoint: "unix:///run/app.sock:/metrics", Labels: map[string]string{"instance": "unix:///run/app.sock:/metrics"}}}
+	assert.Equal(t, want, d.Refresh())
+
+	// a partially written file keeps the previous targets
+	writeFile(t, path, `[{"targets": [`)
+	assert.Equal(t, want, d.Refresh())
+
+	// removing the file removes its targets
+	require.NoError(t, os.Remove(path))
+	assert.Empty(t, d.Refresh())
+}
+
+func TestNewFileDiscovererRejectsInvalidPattern(t *testing.T) {
+	_, err := NewFileDiscoverer([]string{"[-]"}, time.Minute)
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/clients"
+)
+
+// KubernetesSource is the name of targets discovered from pod annotations
+const KubernetesSource = "kubernetes"
+
+// Pod annotations controlling how pods are scraped. These follow the
+// convention used by the Prometheus example configuration
+const (
+	ScrapeAnnotation = "prometheus.io/scrape"
+	PortAnnotation   = "prometheus.io/port"
+	PathAnnotation   = "prometheus.io/path"
+	SchemeAnnotation = "prometheus.io/scheme"
+)
+
+const (
+	// NamespaceLabel is the namespace of a discovered pod
+	NamespaceLabel = "namespace"
+	// PodLabel is the name of a discovered pod
+	PodLabel = "pod"
+)
+
+// podList is the subset of the Kubernetes PodList needed for discovery
+type podList struct {
+	Items []pod `json:"items"`
+}
+
+type pod struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers []struct {
+			Ports []struct {
+				ContainerPort int    `json:"containerPort"`
+				Protocol      string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// KubernetesDiscoverer discovers pods running on a node which are annotated
+// with prometheus.io/scrape=true
+type KubernetesDiscoverer struct {
+	apiServer string
+	nodeName  string
+	client    clients.HTTPClient
+	interval  time.Duration
+}
+
+// NewKubernetesDiscoverer creates a new KubernetesDiscoverer listing the pods
+// of nodeName from the API server every interval. The client must be
+// authorized to list pods
+func NewKubernetesDiscoverer(apiServer, nodeName string, client clients.HTTPClient, interval time.Duration) (*KubernetesDiscoverer, error) {
+	if nodeName == "" {
+		return nil, fmt.Errorf("node name is required to discover pods")
+	}
+	if apiServer == "" {
+		return nil, fmt.Errorf("API server URL is required to discover pods")
+	}
+	if _, err := url.Parse(apiServer); err != nil {
+		return nil, fmt.Errorf("invalid API server URL: %w", err)
+	}
+	return &KubernetesDiscoverer{
+		apiServer: strings.TrimRight(apiServer, "/"),
+		nodeName:  nodeName,
+		client:    client,
+		interval:  interval,
+	}, nil
+}
+
+// Run syncs the pods found with m immediately and then every interval until
+// ctx is done. Targets are kept if the API server can not be reached
+func (d *KubernetesDiscoverer) Run(ctx context.Context, m *Manager) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		targets, err := d.Refresh(ctx)
+		if err != nil {
+			log.Error("failed to discover kubernetes pods, keeping previous targets: %v", err)
+		} else {
+			m.Sync(KubernetesSource, targets)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh lists the pods on the node and returns the targets to scrape
+func (d *KubernetesDiscoverer) Refresh(ctx context.Context) ([]Target, error) {
+	pods, err := d.listPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []TargetGroup
+	for _, p := range pods {
+		if g, ok := podTargetGroup(p); ok {
+			groups = append(groups, g)
+		}
+	}
+	return Targets(groups)
+}
+
+func (d *KubernetesDiscoverer) listPods(ctx context.Context) ([]pod, error) {
+	q := url.Values{"fieldSelector": {"spec.nodeName=" + d.nodeName}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.apiServer+"/api/v1/pods?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API server returned bad HTTP status %s", resp.Status)
+	}
+
+	var list podList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("failed to decode pod list: %w", err)
+	}
+	return list.Items, nil
+}
+
+// podTargetGroup returns the targets of a running pod annotated for scraping.
+// Without a port annotation every TCP port declared by its containers is
+// scraped
+func podTargetGroup(p pod) (TargetGroup, bool) {
+	annotations := p.Metadata.Annotations
+	if annotations[ScrapeAnnotation] != "true" || p.Status.Phase != "Running" || p.Status.PodIP == "" {
+		return TargetGroup{}, false
+	}
+
+	var ports []string
+	if port := annotations[PortAnnotation]; port != "" {
+		if _, err := strconv.Atoi(port); err != nil {
+			log.Error("invalid %s annotation %q on pod %s/%s", PortAnnotation, port, p.Metadata.Namespace, p.Metadata.Name)
+			return TargetGroup{}, false
+		}
+		ports = append(ports, port)
+	} else {
+		for _, c := range p.Spec.Containers {
+			for _, cp := range c.Ports {
+				if cp.Protocol == "" || cp.Protocol == "TCP" {
+					ports = append(ports, strconv.Itoa(cp.ContainerPort))
+				}
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return TargetGroup{}, false
+	}
+
+	g := TargetGroup{
+		Labels: map[string]string{
+			NamespaceLabel: p.Metadata.Namespace,
+			PodLabel:       p.Metadata.Name,
+		},
+	}
+	if path := annotations[PathAnnotation]; path != "" {
+		g.Labels[MetricsPathLabel] = path
+	}
+	if scheme := annotations[SchemeAnnotation]; scheme != "" {
+		g.Labels[SchemeLabel] = scheme
+	}
+	for _, port := range ports {
+		g.Targets = append(g.Targets, net.JoinHostPort(p.Status.PodIP, port))
+	}
+	return g, true
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/clients"
+	"github.com/digitalocean/do-agent/pkg/clients/roundtrippers"
+)
+
+const testPods = `{
+  "kind": "PodList",
+  "items": [
+    {
+      "metadata": {"name": "web-1", "namespace": "shop", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "9102", "prometheus.io/path": "/stats"}},
+      "spec": {"containers": [{"ports": [{"containerPort": 80, "protocol": "TCP"}]}]},
+      "status": {"phase": "Running", "podIP": "10.244.0.5"}
+    },
+    {
+      "metadata": {"name": "dns-1", "namespace": "kube-system", "annotations": {"prometheus.io/scrape": "true"}},
+      "spec": {"containers": [{"ports": [{"containerPort": 53, "protocol": "UDP"}, {"containerPort": 9153}]}]},
+      "status": {"phase": "Running", "podIP": "10.244.0.6"}
+    },
+    {
+      "metadata": {"name": "unannotated", "namespace": "shop"},
+      "spec": {"containers": [{"ports": [{"containerPort": 8080}]}]},
+      "status": {"phase": "Running", "podIP": "10.244.0.7"}
+    },
+    {
+      "metadata": {"name": "starting", "namespace": "shop", "annotations": {"prometheus.io/scrape": "true", "prometheus.io/port": "8080"}},
+      "status": {"phase": "Pending"}
+    }
+  ]
+}`
+
+// newFakeAPIServer serves testPods for node "node-1" to requests
+// authenticated with the test token
+func newFakeAPIServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/pods" || r.URL.Query().Get("fieldSelector") != "spec.nodeName=node-1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, err := io.WriteString(w, testPods)
+		assert.NoError(t, err)
+	}))
+}
+
+func newTestKubernetesClient(t *testing.T) clients.HTTPClient {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	writeFile(t, tokenFile, "test-token\n")
+
+	client := clients.NewHTTP(5 * time.Second)
+	client.Transport = roundtrippers.NewBearerTokenFile(tokenFile, client.Transport)
+	return client
+}
+
+func TestKubernetesDiscovererRefresh(t *testing.T) {
+	ts := newFakeAPIServer(t)
+	defer ts.Close()
+
+	d, err := NewKubernetesDiscoverer(ts.URL, "node-1", newTestKubernetesClient(t), time.Minute)
+	require.NoError(t, err)
+
+	targets, err := d.Refresh(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []Target{
+		{
+			Endpoint: "http://10.244.0.5:9102/stats",
+			Labels:   map[string]string{"namespace": "shop", "pod": "web-1", "instance": "10.244.0.5:9102"},
+		},
+		{
+			Endpoint: "http://10.244.0.6:9153/metrics",
+			Labels:   map[string]string{"namespace": "kube-system", "pod": "dns-1", "instance": "10.244.0.6:9153"},
+		},
+	}, targets)
+}
+
+func TestKubernetesDiscovererKeepsTargetsOnError(t *testing.T) {
+	var unavailable atomic.Bool
+	api := newFakeAPIServer(t)
+	defer api.Close()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		api.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	m := NewManager(func(t Target) (prometheus.Collector, error) {
+		return prometheus.NewRegistry(), nil
+	}, &fakeRegistry{names: map[prometheus.Collector]string{}})
+	targets := func() int {
+		m.m.Lock()
+		defer m.m.Unlock()
+		return len(m.sources[KubernetesSource])
+	}
+
+	d, err := NewKubernetesDiscoverer(ts.URL, "node-1", newTestKubernetesClient(t), 10*time.Millisecond)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, m)
+
+	require.Eventually(t, func() bool { return targets() == 2 }, time.Second, 5*time.Millisecond)
+
+	unavailable.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, targets())
+}
+
+func TestNewKubernetesDiscovererRequiresNodeName(t *testing.T) {
+	_, err := NewKubernetesDiscoverer("https://10.245.0.1", "", clients.NewHTTP(time.Second), time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package discovery
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// NewCollectorFunc creates the collector scraping a target
+type NewCollectorFunc func(t Target) (prometheus.Collector, error)
+
+// Registry is where the collectors of targets are registered and unregistered
+// as their targets come and go
+type Registry interface {
+	Register(name string, c prometheus.Collector) error
+	Unregister(c prometheus.Collector) bool
+}
+
+// Manager keeps a collector registered for every discovered target. Targets
+// are reported by one or more sources and collectors are created and removed
+// as their targets come and go.
+//
+// Every collector is registered under its own name, <source>/<instance>, so
+// it can be configured, and fails, independently of the other targets
+type Manager struct {
+	newCollector NewCollectorFunc
+	reg          Registry
+
+	m       sync.Mutex
+	sources map[string]map[string]managedTarget
+}
+
+type managedTarget struct {
+	target    Target
+	collector prometheus.Collector
+}
+
+// NewManager creates a new Manager which uses newCollector to scrape targets
+// and registers their collectors with reg
+func NewManager(newCollector NewCollectorFunc, reg Registry) *Manager {
+	return &Manager{
+		newCollector: newCollector,
+		reg:          reg,
+		sources:      map[string]map[string]managedTarget{},
+	}
+}
+
+// TargetName returns the name the collector of a target from source is
+// registered under
+func TargetName(source string, t Target) string {
+	return source + "/" + t.Labels[InstanceLabel]
+}
+
+// Sync replaces the targets reported by source. Collectors for unchanged
+// targets are kept
+func (m *Manager) Sync(source string, targets []Target) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	current := m.sources[source]
+	next := make(map[string]managedTarget, len(targets))
+	for _, t := range targets {
+		key := t.key()
+		if _, ok := next[key]; ok {
+			continue
+		}
+		if mt, ok := current[key]; ok {
+			next[key] = mt
+			continue
+		}
+
+		c, err := m.newCollector(t)
+		if err != nil {
+			log.Error("failed to create collector for %s target %s: %v", source, t.Endpoint, err)
+			continue
+		}
+		if err := m.reg.Register(TargetName(source, t), c); err != nil {
+			log.Error("failed to register collector for %s target %s: %v", source, t.Endpoint, err)
+			continue
+		}
+		log.Debug("added %s target %s", source, t.Endpoint)
+		next[key] = managedTarget{target: t, collector: c}
+	}
+
+	for key, mt := range current {
+		if _, ok := next[key]; !ok {
+			m.reg.Unregister(mt.collector)
+			log.Debug("removed %s target %s", source, mt.target.Endpoint)
+		}
+	}
+
+	m.sources[source] = next
+}
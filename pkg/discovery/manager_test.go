@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/collector"
+	"github.com/digitalocean/do-agent/pkg/gather"
+)
+
+// fakeRegistry records the names of registered collectors
+type fakeRegistry struct {
+	names map[prometheus.Collector]string
+}
+
+func (r *fakeRegistry) Register(name string, c prometheus.Collector) error {
+	if name == "file/conflict" {
+		return fmt.Errorf("conflict")
+	}
+	r.names[c] = name
+	return nil
+}
+
+func (r *fakeRegistry) Unregister(c prometheus.Collector) bool {
+	_, ok := r.names[c]
+	delete(r.names, c)
+	return ok
+}
+
+func (r *fakeRegistry) registered() []string {
+	var names []string
+	for _, name := range r.names {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestManagerSync(t *testing.T) {
+	var created []string
+	reg := &fakeRegistry{names: map[prometheus.Collector]string{}}
+	m := NewManager(func(t Target) (prometheus.Collector, error) {
+		created = append(created, t.Endpoint)
+		if t.Endpoint == "bad" {
+			return nil, fmt.Errorf("bad target")
+		}
+		return prometheus.NewRegistry(), nil
+	}, reg)
+
+	a := Target{Endpoint: "a", Labels: map[string]string{"instance": "a"}}
+	b := Target{Endpoint: "b", Labels: map[string]string{"instance": "b"}}
+	conflict := Target{Endpoint: "c", Labels: map[string]string{"instance": "conflict"}}
+
+	m.Sync(FileSource, []Target{a, a, {Endpoint: "bad"}, conflict})
+	assert.Equal(t, []string{"a", "bad", "c"}, created)
+	assert.Equal(t, []string{"file/a"}, reg.registered())
+
+	// unchanged targets keep their collector
+	m.Sync(FileSource, []Target{a, b})
+	assert.Equal(t, []string{"a", "bad", "c", "b"}, created)
+	assert.ElementsMatch(t, []string{"file/a", "file/b"}, reg.registered())
+
+	m.Sync(FileSource, []Target{b})
+	assert.Equal(t, []string{"file/b"}, reg.registered())
+}
+
+// gathererRegistry registers collectors with a gatherer
+type gathererRegistry struct {
+	*gather.Gatherer
+}
+
+func (r gathererRegistry) Register(name string, c prometheus.Collector) error {
+	return r.Gatherer.Register(name, c)
+}
+
+func TestManagerRegistersTargetsExposingTheSameMetrics(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.WriteString(w, "# TYPE app_requests_total counter\napp_requests_total 7\n")
+		assert.NoError(t, err)
+	})
+	ts1 := httptest.NewServer(handler)
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler)
+	defer ts2.Close()
+
+	g := gather.NewGatherer()
+	m := NewManager(func(t Target) (prometheus.Collector, error) {
+		return collector.NewScraper("discovered", t.Endpoint, t.LabelPairs(), nil)
+	}, gathererRegistry{g})
+
+	targets, err := Targets([]TargetGroup{{
+		Targets: []string{ts1.Listener.Addr().String(), ts2.Listener.Addr().String()},
+		Labels:  map[string]string{"job": "app", MetricsPathLabel: "/"},
+	}})
+	require.NoError(t, err)
+	m.Sync(FileSource, targets)
+
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+
+	counts := map[string]int{}
+	for _, mf := range mfs {
+		counts[mf.GetName()] = len(mf.Metric)
+	}
+	assert.Equal(t, 2, counts["app_requests_total"])
+	assert.Equal(t, 2, counts["discovered_up"])
+	assert.Equal(t, 2, counts["discovered_scrape_collector_success"])
+
+	m.Sync(FileSource, nil)
+	mfs, err = g.Gather()
+	require.NoError(t, err)
+	assert.Empty(t, mfs)
+}
@@ -0,0 +1,120 @@
+// Package discovery finds scrape targets at runtime and registers a scraper
+// for each of them.
+package discovery
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// Labels with this prefix configure how a target is scraped and are not
+// attached to its metrics
+const reservedLabelPrefix = "__"
+
+const (
+	// SchemeLabel overrides the scheme used to scrape a target
+	SchemeLabel = "__scheme__"
+	// MetricsPathLabel overrides the HTTP path used to scrape a target
+	MetricsPathLabel = "__metrics_path__"
+	// InstanceLabel identifies the target metrics were scraped from. It
+	// defaults to the target address
+	InstanceLabel = "instance"
+)
+
+const (
+	defaultScheme      = "http"
+	defaultMetricsPath = "/metrics"
+)
+
+// TargetGroup is a set of targets sharing the same labels. It matches the
+// Prometheus file_sd format
+type TargetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// Target is a single endpoint to scrape and the labels added to its metrics
+type Target struct {
+	Endpoint string
+	Labels   map[string]string
+}
+
+// Targets resolves the groups into the targets to scrape. Addresses are
+// host:port pairs scraped at __scheme__://host:port__metrics_path__ unless
+// they are already a URL
+func Targets(groups []TargetGroup) ([]Target, error) {
+	var targets []Target
+	for _, g := range groups {
+		for _, addr := range g.Targets {
+			t, err := newTarget(addr, g.Labels)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+func newTarget(addr string, groupLabels map[string]string) (Target, error) {
+	if addr == "" {
+		return Target{}, fmt.Errorf("empty target address")
+	}
+
+	scheme, path := defaultScheme, defaultMetricsPath
+	labels := map[string]string{InstanceLabel: addr}
+	for k, v := range groupLabels {
+		switch {
+		case k == SchemeLabel:
+			scheme = v
+		case k == MetricsPathLabel:
+			path = v
+		case strings.HasPrefix(k, reservedLabelPrefix):
+		default:
+			labels[k] = v
+		}
+	}
+
+	endpoint := addr
+	if !strings.Contains(addr, "://") {
+		u := url.URL{Scheme: scheme, Host: addr, Path: path}
+		endpoint = u.String()
+	}
+	return Target{Endpoint: endpoint, Labels: labels}, nil
+}
+
+// LabelPairs returns the target labels sorted by name
+func (t Target) LabelPairs() []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(t.Labels))
+	for _, name := range t.labelNames() {
+		pairs = append(pairs, &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(t.Labels[name]),
+		})
+	}
+	return pairs
+}
+
+// key uniquely identifies the target
+func (t Target) key() string {
+	var sb strings.Builder
+	sb.WriteString(t.Endpoint)
+	for _, name := range t.labelNames() {
+		fmt.Fprintf(&sb, "\xff%s=%s", name, t.Labels[name])
+	}
+	return sb.String()
+}
+
+func (t Target) labelNames() []string {
+	names := make([]string, 0, len(t.Labels))
+	for name := range t.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,60 @@
+package discovery
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// watchMask are the inotify events of files being written, moved or removed
+const watchMask = unix.IN_CLOSE_WRITE | unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO
+
+// watch returns a channel receiving a value whenever a file in dirs changes
+// until ctx is done. It returns nil if no directory can be watched
+func watch(ctx context.Context, dirs []string) <-chan struct{} {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		log.Error("failed to watch target files, only polling them: %v", err)
+		return nil
+	}
+
+	watched := 0
+	for _, dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, watchMask); err != nil {
+			log.Debug("failed to watch %s, only polling it: %v", dir, err)
+			continue
+		}
+		watched++
+	}
+	if watched == 0 {
+		unix.Close(fd)
+		return nil
+	}
+
+	// a non-blocking file is read through the runtime poller, so closing it
+	// interrupts a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := f.Read(buf); err != nil {
+				return
+			}
+			// changes are coalesced, the files are all read again anyway
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes
+}
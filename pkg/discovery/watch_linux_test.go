@@ -0,0 +1,37 @@
+package discovery
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDiscovererWatchesFiles(t *testing.T) {
+	dir := t.TempDir()
+	reg := &fakeRegistry{names: map[prometheus.Collector]string{}}
+	m := NewManager(func(t Target) (prometheus.Collector, error) {
+		return prometheus.NewRegistry(), nil
+	}, reg)
+	registered := func() []string {
+		m.m.Lock()
+		defer m.m.Unlock()
+		return reg.registered()
+	}
+
+	// polling alone would not pick the file up within the test
+	d, err := NewFileDiscoverer([]string{filepath.Join(dir, "*.json")}, time.Hour)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, m)
+
+	require.Eventually(t, func() bool {
+		writeFile(t, filepath.Join(dir, "app.json"), `[{"targets": ["10.0.0.1:9100"]}]`)
+		return len(registered()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, []string{"file/10.0.0.1:9100"}, registered())
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package discovery
+
+import "context"
+
+// watch is only supported on Linux, elsewhere target files are only polled
+func watch(ctx context.Context, dirs []string) <-chan struct{} {
+	return nil
+}
@@ -0,0 +1,557 @@
+// Package gather collects metrics from many collectors while isolating them
+// from each other, so a misbehaving collector only loses its own metrics
+// instead of failing the whole collection.
+package gather
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/digitalocean/do-agent/internal/log"
+	"github.com/digitalocean/do-agent/pkg/cardinality"
+)
+
+// ErrorsMetricName is the name of the metric counting collector failures
+const ErrorsMetricName = "sonar_collector_errors"
+
+// OverflowMetricName is the name of the metric reporting the series of a
+// collector folded or dropped by its series limit
+const OverflowMetricName = "sonar_collector_series_overflow"
+
+// Reasons a collector failed, used as the reason label of ErrorsMetricName
+const (
+	// ReasonGather means the collector returned invalid or inconsistent metrics
+	ReasonGather = "gather"
+	// ReasonPanic means the collector panicked
+	ReasonPanic = "panic"
+	// ReasonConflict means the collector returned metrics already returned by
+	// another collector
+	ReasonConflict = "conflict"
+	// ReasonTimeout means the collector did not complete within its time budget
+	ReasonTimeout = "timeout"
+)
+
+type gathererOpts struct {
+	timeout     time.Duration
+	interval    time.Duration
+	seriesLimit int
+}
+
+// Option is used to configure optional gatherer and collector options.
+// Options given to NewGatherer are the defaults of all collectors, options
+// given to Register override the defaults for that collector.
+type Option func(o *gathererOpts)
+
+// WithTimeout sets the time budget of collectors. Collectors which do not
+// complete within it are skipped until they do. 0 means no limit
+func WithTimeout(d time.Duration) Option {
+	return func(o *gathererOpts) {
+		o.timeout = d
+	}
+}
+
+// WithInterval sets how often collectors are gathered. Results are cached and
+// returned by every Gather until the interval has passed, so expensive
+// collectors can be gathered less often than others. 0 gathers collectors on
+// every Gather
+func WithInterval(d time.Duration) Option {
+	return func(o *gathererOpts) {
+		o.interval = d
+	}
+}
+
+// WithSeriesLimit caps the series of collectors across all of their families.
+// The family reaching it is folded into an overflow series and the remaining
+// families are dropped, see cardinality.WithTotalLimit. 0 means no limit
+func WithSeriesLimit(n int) Option {
+	return func(o *gathererOpts) {
+		o.seriesLimit = n
+	}
+}
+
+// member is a collector gathered with its own registry
+type member struct {
+	name     string
+	c        *recoverCollector
+	reg      *prometheus.Registry
+	timeout  time.Duration
+	interval time.Duration
+	limiter  *cardinality.Limiter
+
+	// cached is the last result of a collector with an interval
+	cached   []*dto.MetricFamily
+	cachedAt time.Time
+
+	// families are the names of the families of the last successful gather
+	families map[string]bool
+
+	// pending receives the result of a gather that exceeded its budget
+	pending  chan result
+	timedOut bool
+}
+
+type result struct {
+	mfs []*dto.MetricFamily
+	err error
+}
+
+// Gatherer gathers each registered collector independently. Families of
+// collectors which fail are dropped and the failure is counted, while the
+// families of all other collectors are still returned
+type Gatherer struct {
+	opts    gathererOpts
+	now     func() time.Time
+	m       sync.Mutex
+	members []*member
+	errors  *prometheus.CounterVec
+	reg     *prometheus.Registry
+
+	overflowDesc *prometheus.Desc
+}
+
+// NewGatherer creates a new Gatherer without any collectors
+func NewGatherer(opts ...Option) *Gatherer {
+	defOpts := gathererOpts{}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	g := &Gatherer{
+		opts: defOpts,
+		now:  time.Now,
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: ErrorsMetricName,
+			Help: "Total collections which failed, by collector and reason.",
+		}, []string{"collector", "reason"}),
+		reg: prometheus.NewRegistry(),
+		overflowDesc: prometheus.NewDesc(
+			OverflowMetricName,
+			"Number of series of a metric family folded or dropped by the series limit of a collector.",
+			[]string{"collector", "family"}, nil,
+		),
+	}
+	g.reg.MustRegister(g.errors)
+	return g
+}
+
+// Describe describes the series limit metrics of the gatherer
+func (g *Gatherer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.overflowDesc
+}
+
+// Collect reports the series folded or dropped by the last gather of every
+// collector with a series limit. They are reported locally rather than with
+// the gathered families
+func (g *Gatherer) Collect(ch chan<- prometheus.Metric) {
+	g.m.Lock()
+	overflow := map[[2]string]int{}
+	for _, mem := range g.members {
+		for family, n := range mem.limiter.Overflow() {
+			overflow[[2]string{mem.name, family}] += n
+		}
+	}
+	g.m.Unlock()
+
+	for key, n := range overflow {
+		ch <- prometheus.MustNewConstMetric(g.overflowDesc, prometheus.GaugeValue, float64(n), key[0], key[1])
+	}
+}
+
+// Register adds a collector gathered under the given name. Names are used to
+// report failures and do not need to be unique
+func (g *Gatherer) Register(name string, c prometheus.Collector, opts ...Option) error {
+	rc := &recoverCollector{Collector: c}
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(rc); err != nil {
+		return fmt.Errorf("failed to register collector %q: %w", name, err)
+	}
+	if p := rc.recovered(); p != nil {
+		return fmt.Errorf("failed to register collector %q: %v", name, p)
+	}
+
+	g.m.Lock()
+	defer g.m.Unlock()
+	memOpts := g.opts
+	for _, opt := range opts {
+		opt(&memOpts)
+	}
+	mem := &member{
+		name:     name,
+		c:        rc,
+		reg:      reg,
+		timeout:  memOpts.timeout,
+		interval: memOpts.interval,
+	}
+	if memOpts.seriesLimit > 0 {
+		mem.limiter = cardinality.NewLimiter(cardinality.WithTotalLimit(memOpts.seriesLimit))
+	}
+	g.members = append(g.members, mem)
+	return nil
+}
+
+// Unregister removes every member gathering c and returns true if there was
+// any. A gather of c still running in the background is discarded
+func (g *Gatherer) Unregister(c prometheus.Collector) bool {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	members := g.members[:0]
+	for _, mem := range g.members {
+		if !sameCollector(mem.c.Collector, c) {
+			members = append(members, mem)
+		}
+	}
+	removed := len(members) < len(g.members)
+	// clear the tail so removed members can be garbage collected
+	for i := len(members); i < len(g.members); i++ {
+		g.members[i] = nil
+	}
+	g.members = members
+	return removed
+}
+
+// sameCollector returns true if a and b are the same collector. Collectors of
+// types which can not be compared, like functions, are never the same
+func sameCollector(a, b prometheus.Collector) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// Gather gathers all collectors concurrently. The returned error lists every
+// collector which failed, but the families of successful collectors are
+// returned regardless. Collectors exceeding their time budget are counted and
+// logged when they start and stop doing so, but are not part of the error
+func (g *Gatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	results, errs := collectMembers(g.members, g.now())
+	var merr prometheus.MultiError
+	merged := map[string]*dto.MetricFamily{}
+	for i, mem := range g.members {
+		if _, ok := errs[i].(*timeoutError); ok {
+			g.errors.WithLabelValues(mem.name, ReasonTimeout).Inc()
+			continue
+		}
+		if errs[i] != nil {
+			g.errors.WithLabelValues(mem.name, reason(errs[i])).Inc()
+			merr.Append(fmt.Errorf("collector %q: %w", mem.name, errs[i]))
+			continue
+		}
+		mem.families = familyNames(results[i])
+		if err := merge(merged, results[i]); err != nil {
+			g.errors.WithLabelValues(mem.name, ReasonConflict).Inc()
+			merr.Append(fmt.Errorf("collector %q: %w", mem.name, err))
+		}
+	}
+
+	// the failures of this gather are reported with its results
+	own, err := g.reg.Gather()
+	if err != nil {
+		merr.Append(err)
+	}
+	if err := merge(merged, own); err != nil {
+		merr.Append(err)
+	}
+
+	mfs := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, merr.MaybeUnwrap()
+}
+
+// GatherFamilies gathers only the collectors which returned a family matching
+// keep on the last Gather and returns only the matching families. It is meant
+// for sampling a few families between regular gathers, so failures are
+// returned but not counted. Collectors are not gathered before their first
+// successful Gather
+func (g *Gatherer) GatherFamilies(keep func(name string) bool) ([]*dto.MetricFamily, error) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	var members []*member
+	for _, mem := range g.members {
+		for name := range mem.families {
+			if keep(name) {
+				members = append(members, mem)
+				break
+			}
+		}
+	}
+	results, errs := collectMembers(members, g.now())
+
+	var merr prometheus.MultiError
+	merged := map[string]*dto.MetricFamily{}
+	for i, mem := range members {
+		if _, ok := errs[i].(*timeoutError); ok {
+			continue
+		}
+		if errs[i] != nil {
+			merr.Append(fmt.Errorf("collector %q: %w", mem.name, errs[i]))
+			continue
+		}
+		var kept []*dto.MetricFamily
+		for _, mf := range results[i] {
+			if keep(mf.GetName()) {
+				kept = append(kept, mf)
+			}
+		}
+		if err := merge(merged, kept); err != nil {
+			merr.Append(fmt.Errorf("collector %q: %w", mem.name, err))
+		}
+	}
+
+	mfs := make([]*dto.MetricFamily, 0, len(merged))
+	for _, mf := range merged {
+		mfs = append(mfs, mf)
+	}
+	sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	return mfs, merr.MaybeUnwrap()
+}
+
+// collectMembers collects all members concurrently
+func collectMembers(members []*member, now time.Time) ([][]*dto.MetricFamily, []error) {
+	results := make([][]*dto.MetricFamily, len(members))
+	errs := make([]error, len(members))
+	var wg sync.WaitGroup
+	for i, mem := range members {
+		wg.Add(1)
+		go func(i int, mem *member) {
+			defer wg.Done()
+			results[i], errs[i] = mem.collect(now)
+		}(i, mem)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// familyNames returns the names of mfs
+func familyNames(mfs []*dto.MetricFamily) map[string]bool {
+	names := make(map[string]bool, len(mfs))
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	return names
+}
+
+// panicError is returned for collectors which panicked
+type panicError struct {
+	v interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.v)
+}
+
+// timeoutError is returned for collectors which exceeded their time budget
+type timeoutError struct {
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("exceeded time budget of %s", e.timeout)
+}
+
+func reason(err error) string {
+	if _, ok := err.(*panicError); ok {
+		return ReasonPanic
+	}
+	return ReasonGather
+}
+
+// collect returns the cached result of the collector if its interval has not
+// passed yet and gathers it otherwise. Cached metrics are stamped with the time
+// they were gathered so they are not mistaken for newer values. Failures are
+// not cached so the collector is gathered again on the next call
+func (mem *member) collect(now time.Time) ([]*dto.MetricFamily, error) {
+	if mem.interval <= 0 {
+		return mem.gather()
+	}
+	if mem.cachedAt.IsZero() || now.Sub(mem.cachedAt) >= mem.interval {
+		mfs, err := mem.gather()
+		if err != nil {
+			mem.cached, mem.cachedAt = nil, time.Time{}
+			return nil, err
+		}
+		stamp(mfs, now)
+		mem.cached, mem.cachedAt = mfs, now
+	}
+	// families are modified after gathering so the cache is never handed out
+	return cloneFamilies(mem.cached), nil
+}
+
+// stamp sets the timestamp of the metrics in mfs which have none to t
+func stamp(mfs []*dto.MetricFamily, t time.Time) {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			if m.TimestampMs == nil {
+				m.TimestampMs = proto.Int64(t.UnixMilli())
+			}
+		}
+	}
+}
+
+// cloneFamilies returns a deep copy of mfs
+func cloneFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	out := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		out[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return out
+}
+
+// gather gathers the collector within its time budget. A collector which
+// exceeds it keeps running in the background, and is skipped without being
+// gathered again until it completes. The result of such a late gather is
+// discarded as it belongs to an earlier interval
+func (mem *member) gather() ([]*dto.MetricFamily, error) {
+	if mem.pending != nil {
+		select {
+		case <-mem.pending:
+		default:
+			return nil, &timeoutError{mem.timeout}
+		}
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		mfs, err := gatherMember(mem)
+		done <- result{mfs, err}
+	}()
+
+	var timeout <-chan time.Time
+	if mem.timeout > 0 {
+		t := time.NewTimer(mem.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case res := <-done:
+		mem.pending = nil
+		if mem.timedOut {
+			mem.timedOut = false
+			log.Error("collector %q completed within its time budget again", mem.name)
+		}
+		return res.mfs, res.err
+	case <-timeout:
+		mem.pending = done
+		if !mem.timedOut {
+			mem.timedOut = true
+			log.Error("collector %q exceeded its time budget of %s, skipping it until it completes", mem.name, mem.timeout)
+		}
+		return nil, &timeoutError{mem.timeout}
+	}
+}
+
+// gatherMember gathers a single collector. Any error discards all of its
+// families since a collector returning inconsistent metrics can not be trusted
+// to have returned the remaining ones correctly either
+func gatherMember(mem *member) ([]*dto.MetricFamily, error) {
+	mfs, err := mem.reg.Gather()
+	if p := mem.c.recovered(); p != nil {
+		return nil, &panicError{p}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mem.limiter.Limit(mfs), nil
+}
+
+// merge adds the families in mfs to merged. Families already returned by
+// another collector are merged unless their types differ or they contain the
+// same series. Nothing is added when an error is returned
+func merge(merged map[string]*dto.MetricFamily, mfs []*dto.MetricFamily) error {
+	for _, mf := range mfs {
+		existing, ok := merged[mf.GetName()]
+		if !ok {
+			continue
+		}
+		if existing.GetType() != mf.GetType() {
+			return fmt.Errorf("metric %q has type %s but was already gathered with type %s",
+				mf.GetName(), mf.GetType(), existing.GetType())
+		}
+		seen := make(map[string]bool, len(existing.Metric))
+		for _, m := range existing.Metric {
+			seen[labelsKey(m)] = true
+		}
+		for _, m := range mf.Metric {
+			if seen[labelsKey(m)] {
+				return fmt.Errorf("metric %q with labels {%s} was already gathered", mf.GetName(), labelsKey(m))
+			}
+		}
+	}
+
+	for _, mf := range mfs {
+		if existing, ok := merged[mf.GetName()]; ok {
+			existing.Metric = append(existing.Metric, mf.Metric...)
+			continue
+		}
+		merged[mf.GetName()] = mf
+	}
+	return nil
+}
+
+// labelsKey identifies a series within its family. Gathered labels are
+// already sorted by name
+func labelsKey(m *dto.Metric) string {
+	var sb strings.Builder
+	for i, l := range m.GetLabel() {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=%q", l.GetName(), l.GetValue())
+	}
+	return sb.String()
+}
+
+// recoverCollector recovers panics of the wrapped collector so they can be
+// reported instead of crashing the agent. Only panics on the goroutine calling
+// Describe or Collect are recovered. A collector which collects on goroutines
+// of its own, like one per subsystem, must recover their panics itself or they
+// still crash the agent
+type recoverCollector struct {
+	prometheus.Collector
+
+	m     sync.Mutex
+	panic interface{}
+}
+
+// Describe describes the wrapped collector
+func (c *recoverCollector) Describe(ch chan<- *prometheus.Desc) {
+	defer c.recoverPanic()
+	c.Collector.Describe(ch)
+}
+
+// Collect collects the wrapped collector
+func (c *recoverCollector) Collect(ch chan<- prometheus.Metric) {
+	defer c.recoverPanic()
+	c.Collector.Collect(ch)
+}
+
+func (c *recoverCollector) recoverPanic() {
+	if p := recover(); p != nil {
+		c.m.Lock()
+		c.panic = p
+		c.m.Unlock()
+	}
+}
+
+// recovered returns the panic recovered since it was last called, if any
+func (c *recoverCollector) recovered() interface{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+	p := c.panic
+	c.panic = nil
+	return p
+}
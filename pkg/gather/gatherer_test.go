@@ -0,0 +1,313 @@
+package gather
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/cardinality"
+)
+
+// collectorFunc is an unchecked collector collecting with a function
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) { f(ch) }
+
+func gauge(name string, value float64, labels ...string) prometheus.Metric {
+	var names, values []string
+	for i := 0; i < len(labels); i += 2 {
+		names = append(names, labels[i])
+		values = append(values, labels[i+1])
+	}
+	desc := prometheus.NewDesc(name, name, names, nil)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, values...)
+}
+
+func byName(mfs []*dto.MetricFamily) map[string]*dto.MetricFamily {
+	out := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		out[mf.GetName()] = mf
+	}
+	return out
+}
+
+func errorCount(t *testing.T, mfs map[string]*dto.MetricFamily, collector, reason string) float64 {
+	t.Helper()
+	for _, m := range mfs[ErrorsMetricName].GetMetric() {
+		labels := map[string]string{}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["collector"] == collector && labels["reason"] == reason {
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestGathererKeepsSuccessfulCollectors(t *testing.T) {
+	g := NewGatherer()
+	require.NoError(t, g.Register("good", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("good_metric", 1)
+	})))
+	require.NoError(t, g.Register("duplicate", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("duplicate_metric", 1)
+		ch <- gauge("duplicate_metric", 2)
+		ch <- gauge("duplicate_other", 1)
+	})))
+	require.NoError(t, g.Register("panics", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("panics_metric", 1)
+		panic("collector failed")
+	})))
+
+	for i := 1; i <= 2; i++ {
+		mfs, err := g.Gather()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `collector "duplicate"`)
+		assert.Contains(t, err.Error(), `collector "panics": panic: collector failed`)
+
+		got := byName(mfs)
+		assert.Contains(t, got, "good_metric")
+		assert.NotContains(t, got, "duplicate_metric")
+		assert.NotContains(t, got, "duplicate_other")
+		assert.NotContains(t, got, "panics_metric")
+		assert.Equal(t, float64(i), errorCount(t, got, "duplicate", ReasonGather))
+		assert.Equal(t, float64(i), errorCount(t, got, "panics", ReasonPanic))
+	}
+}
+
+func TestGathererDoesNotRecoverPanicsOfCollectorGoroutines(t *testing.T) {
+	if os.Getenv("GATHER_PANIC_IN_GOROUTINE") == "1" {
+		g := NewGatherer()
+		require.NoError(t, g.Register("fans-out", collectorFunc(func(ch chan<- prometheus.Metric) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				panic("subsystem failed")
+			}()
+			wg.Wait()
+		})))
+		_, _ = g.Gather()
+		return
+	}
+
+	// the panic crashes the process so it is gathered in a separate one
+	cmd := exec.Command(os.Args[0], "-test.run=^TestGathererDoesNotRecoverPanicsOfCollectorGoroutines$")
+	cmd.Env = append(os.Environ(), "GATHER_PANIC_IN_GOROUTINE=1")
+	out, err := cmd.CombinedOutput()
+	require.Error(t, err)
+	assert.Contains(t, string(out), "panic: subsystem failed")
+}
+
+func TestGathererMergesCollectors(t *testing.T) {
+	g := NewGatherer()
+	require.NoError(t, g.Register("first", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("shared", 1, "target", "first")
+	})))
+	require.NoError(t, g.Register("second", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("shared", 2, "target", "second")
+	})))
+	require.NoError(t, g.Register("conflicting", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("shared", 3, "target", "first")
+		ch <- gauge("conflicting_metric", 1)
+	})))
+
+	mfs, err := g.Gather()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `collector "conflicting": metric "shared" with labels {target="first"} was already gathered`)
+
+	got := byName(mfs)
+	require.Contains(t, got, "shared")
+	assert.Len(t, got["shared"].Metric, 2)
+	assert.NotContains(t, got, "conflicting_metric")
+	assert.Equal(t, float64(1), errorCount(t, got, "conflicting", ReasonConflict))
+}
+
+func TestGathererWithoutFailures(t *testing.T) {
+	g := NewGatherer()
+	require.NoError(t, g.Register("good", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("good_metric", 1)
+	})))
+
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+	assert.Equal(t, "good_metric", mfs[0].GetName())
+}
+
+func TestGathererUnregister(t *testing.T) {
+	g := NewGatherer()
+	target := prometheus.NewGauge(prometheus.GaugeOpts{Name: "target_metric", Help: "target_metric"})
+	require.NoError(t, g.Register("file/10.0.0.1:9100", target))
+	fn := collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("good_metric", 1)
+	})
+	require.NoError(t, g.Register("good", fn))
+
+	assert.True(t, g.Unregister(target))
+	assert.False(t, g.Unregister(target))
+	// collectors which can not be compared are never unregistered
+	assert.False(t, g.Unregister(fn))
+
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+	assert.Equal(t, "good_metric", mfs[0].GetName())
+}
+
+func TestGathererRegisterRecoversPanics(t *testing.T) {
+	g := NewGatherer()
+	err := g.Register("broken", &panickingDescriber{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "describe failed")
+}
+
+type panickingDescriber struct{}
+
+func (panickingDescriber) Describe(ch chan<- *prometheus.Desc) { panic("describe failed") }
+
+func (panickingDescriber) Collect(ch chan<- prometheus.Metric) {}
+
+func TestGathererSkipsCollectorsExceedingTheirBudget(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	g := NewGatherer(WithTimeout(time.Minute))
+	require.NoError(t, g.Register("good", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("good_metric", 1)
+	})))
+	require.NoError(t, g.Register("hung", collectorFunc(func(ch chan<- prometheus.Metric) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		ch <- gauge("hung_metric", 1)
+	}), WithTimeout(10*time.Millisecond)))
+
+	for i := 1; i <= 2; i++ {
+		start := time.Now()
+		mfs, err := g.Gather()
+		require.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Minute)
+
+		got := byName(mfs)
+		assert.Contains(t, got, "good_metric")
+		assert.NotContains(t, got, "hung_metric")
+		assert.Equal(t, float64(i), errorCount(t, got, "hung", ReasonTimeout))
+	}
+	// a collector still running is not started again
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		mfs, err := g.Gather()
+		require.NoError(t, err)
+		_, ok := byName(mfs)["hung_metric"]
+		return ok
+	}, time.Second, 20*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestGathererCachesCollectorsWithInterval(t *testing.T) {
+	var fastCalls, slowCalls int32
+	g := NewGatherer()
+	now := time.Unix(1000, 0)
+	g.now = func() time.Time { return now }
+	require.NoError(t, g.Register("fast", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("fast_metric", float64(atomic.AddInt32(&fastCalls, 1)))
+	})))
+	require.NoError(t, g.Register("slow", collectorFunc(func(ch chan<- prometheus.Metric) {
+		ch <- gauge("slow_metric", float64(atomic.AddInt32(&slowCalls, 1)), "label", "value")
+	}), WithInterval(5*time.Minute)))
+
+	for i := 0; i < 6; i++ {
+		mfs, err := g.Gather()
+		require.NoError(t, err)
+		got := byName(mfs)
+		require.Contains(t, got, "slow_metric")
+
+		// modifying the results must not change what is cached
+		slow := got["slow_metric"].Metric[0]
+		slow.Label = append(slow.Label, &dto.LabelPair{})
+		assert.Len(t, slow.Label, 2)
+
+		assert.Equal(t, float64(i+1), got["fast_metric"].Metric[0].GetGauge().GetValue())
+		assert.Equal(t, float64(i/5+1), slow.GetGauge().GetValue())
+		// cached metrics carry the time they were gathered at
+		assert.Equal(t, time.Unix(1000, 0).Add(time.Duration(i/5)*5*time.Minute).UnixMilli(), slow.GetTimestampMs())
+		assert.Nil(t, got["fast_metric"].Metric[0].TimestampMs)
+		now = now.Add(time.Minute)
+	}
+	assert.Equal(t, int32(6), atomic.LoadInt32(&fastCalls))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&slowCalls))
+}
+
+func TestGathererLimitsSeriesOfCollectors(t *testing.T) {
+	topics := collectorFunc(func(ch chan<- prometheus.Metric) {
+		for _, topic := range []string{"a", "b", "c", "d"} {
+			ch <- gauge("kafka_lag", 1, "topic", topic)
+		}
+	})
+	g := NewGatherer(WithSeriesLimit(3))
+	require.NoError(t, g.Register("kafka", topics))
+	require.NoError(t, g.Register("unlimited", collectorFunc(func(ch chan<- prometheus.Metric) {
+		for _, table := range []string{"a", "b", "c", "d"} {
+			ch <- gauge("table_rows", 1, "table", table)
+		}
+	}), WithSeriesLimit(0)))
+
+	mfs, err := g.Gather()
+	require.NoError(t, err)
+	got := byName(mfs)
+	require.Len(t, got["kafka_lag"].Metric, 3)
+	overflow := got["kafka_lag"].Metric[2]
+	assert.Equal(t, cardinality.OverflowValue, overflow.Label[0].GetValue())
+	assert.Equal(t, float64(2), overflow.GetGauge().GetValue())
+	assert.Len(t, got["table_rows"].Metric, 4)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(g)
+	local, err := reg.Gather()
+	require.NoError(t, err)
+	overflowed := byName(local)[OverflowMetricName].GetMetric()
+	require.Len(t, overflowed, 1)
+	assert.Equal(t, float64(2), overflowed[0].GetGauge().GetValue())
+}
+
+func TestGathererGatherFamilies(t *testing.T) {
+	var sampledCalls, otherCalls atomic.Int32
+	g := NewGatherer()
+	require.NoError(t, g.Register("sampled", collectorFunc(func(ch chan<- prometheus.Metric) {
+		sampledCalls.Add(1)
+		ch <- gauge("sampled_metric", 1)
+		ch <- gauge("sampled_other", 1)
+	})))
+	require.NoError(t, g.Register("other", collectorFunc(func(ch chan<- prometheus.Metric) {
+		otherCalls.Add(1)
+		ch <- gauge("other_metric", 1)
+	})))
+	keep := func(name string) bool { return name == "sampled_metric" }
+
+	// nothing is known about the collectors before the first Gather
+	mfs, err := g.GatherFamilies(keep)
+	require.NoError(t, err)
+	assert.Empty(t, mfs)
+
+	_, err = g.Gather()
+	require.NoError(t, err)
+	mfs, err = g.GatherFamilies(keep)
+	require.NoError(t, err)
+	require.Len(t, mfs, 1)
+	assert.Equal(t, "sampled_metric", mfs[0].GetName())
+	assert.Equal(t, int32(2), sampledCalls.Load())
+	assert.Equal(t, int32(1), otherCalls.Load())
+}
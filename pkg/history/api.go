@@ -0,0 +1,115 @@
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// QueryRangePath is the path the history API is served on. It mirrors the
+// Prometheus HTTP API so existing tooling can read from it
+const QueryRangePath = "/api/v1/query_range"
+
+// apiResponse is the Prometheus HTTP API response envelope
+type apiResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type matrixData struct {
+	ResultType string         `json:"resultType"`
+	Result     []matrixSeries `json:"result"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+// Handler serves range queries against the store. The query parameter is a
+// series selector, start and end are unix timestamps or RFC3339 times and
+// default to the whole retention window
+func Handler(s *Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+
+		matchers, err := ParseSelector(r.FormValue("query"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		end := s.now()
+		if v := r.FormValue("end"); v != "" {
+			if end, err = parseTime(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid end: %w", err))
+				return
+			}
+		}
+		start := end.Add(-s.retention)
+		if v := r.FormValue("start"); v != "" {
+			if start, err = parseTime(v); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid start: %w", err))
+				return
+			}
+		}
+		if end.Before(start) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("end must not be before start"))
+			return
+		}
+
+		series := s.Query(matchers, start, end)
+		result := make([]matrixSeries, len(series))
+		for i, ser := range series {
+			values := make([][2]interface{}, len(ser.Samples))
+			for j, sample := range ser.Samples {
+				values[j] = [2]interface{}{
+					float64(sample.Timestamp.UnixMilli()) / 1000,
+					strconv.FormatFloat(sample.Value, 'f', -1, 64),
+				}
+			}
+			result[i] = matrixSeries{Metric: ser.Labels, Values: values}
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{
+			Status: "success",
+			Data:   matrixData{ResultType: "matrix", Result: result},
+		})
+	})
+}
+
+// parseTime parses a unix timestamp with optional fractional seconds or an
+// RFC3339 time
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiResponse{
+		Status:    "error",
+		ErrorType: "bad_data",
+		Error:     err.Error(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("failed to write history response: %v", err)
+	}
+}
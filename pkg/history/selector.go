@@ -0,0 +1,175 @@
+package history
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// MatchType is the type of a label matcher
+type MatchType string
+
+const (
+	// MatchEqual matches labels equal to the value
+	MatchEqual MatchType = "="
+	// MatchNotEqual matches labels not equal to the value
+	MatchNotEqual MatchType = "!="
+	// MatchRegexp matches labels matching the anchored regular expression
+	MatchRegexp MatchType = "=~"
+	// MatchNotRegexp matches labels not matching the anchored regular expression
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher matches a single label against a value. Missing labels are treated
+// as an empty value like Prometheus does
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher creates a new Matcher
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Name: name, Type: t, Value: value}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression for label %q: %w", name, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type %q", t)
+	}
+	return m, nil
+}
+
+// Matches returns true if the value matches
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// ParseSelector parses a Prometheus series selector such as
+// sonar_cpu{mode="user",cpu=~"cpu[0-3]"} into label matchers. The metric name,
+// if present, becomes an equality matcher on __name__
+func ParseSelector(s string) ([]*Matcher, error) {
+	s = strings.TrimSpace(s)
+	var matchers []*Matcher
+
+	nameEnd := strings.IndexByte(s, '{')
+	if nameEnd == -1 {
+		nameEnd = len(s)
+	}
+	if name := strings.TrimSpace(s[:nameEnd]); name != "" {
+		if !validName(name, true) {
+			return nil, fmt.Errorf("invalid metric name %q", name)
+		}
+		matchers = append(matchers, &Matcher{Name: metricNameLabel, Type: MatchEqual, Value: name})
+	}
+
+	if nameEnd < len(s) {
+		if !strings.HasSuffix(s, "}") {
+			return nil, fmt.Errorf("selector %q is missing a closing brace", s)
+		}
+		ms, err := parseMatchers(s[nameEnd+1 : len(s)-1])
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, ms...)
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("selector %q must contain a metric name or at least one matcher", s)
+	}
+	return matchers, nil
+}
+
+// parseMatchers parses the comma separated matchers between the braces of a selector
+func parseMatchers(s string) ([]*Matcher, error) {
+	var matchers []*Matcher
+	for {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if s == "" {
+			return matchers, nil
+		}
+
+		i := strings.IndexAny(s, "=!")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid matcher %q", s)
+		}
+		name := strings.TrimSpace(s[:i])
+		if !validName(name, false) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		s = s[i:]
+
+		var t MatchType
+		for _, candidate := range []MatchType{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual} {
+			if strings.HasPrefix(s, string(candidate)) {
+				t = candidate
+				break
+			}
+		}
+		if t == "" {
+			return nil, fmt.Errorf("invalid operator for label %q", name)
+		}
+		s = strings.TrimLeftFunc(s[len(t):], unicode.IsSpace)
+
+		quoted, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for label %q: %w", name, err)
+		}
+		s = strings.TrimLeftFunc(s[len(quoted):], unicode.IsSpace)
+
+		m, err := NewMatcher(t, name, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		if s == "" {
+			return matchers, nil
+		}
+		if s[0] != ',' {
+			return nil, fmt.Errorf("expected ',' after matcher for label %q", name)
+		}
+		s = s[1:]
+	}
+}
+
+// validName reports whether s is a valid label name, or metric name if
+// metric is true
+func validName(s string, metric bool) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case r >= '0' && r <= '9' && i > 0:
+		case r == ':' && metric:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package history
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	ms, err := ParseSelector(`sonar_cpu{mode="user", cpu=~"cpu[0-1]",host!="a\"b" , x!~"y.*"}`)
+	require.NoError(t, err)
+	require.Len(t, ms, 5)
+
+	expected := []struct {
+		name  string
+		t     MatchType
+		value string
+	}{
+		{"__name__", MatchEqual, "sonar_cpu"},
+		{"mode", MatchEqual, "user"},
+		{"cpu", MatchRegexp, "cpu[0-1]"},
+		{"host", MatchNotEqual, `a"b`},
+		{"x", MatchNotRegexp, "y.*"},
+	}
+	for i, e := range expected {
+		assert.Equal(t, e.name, ms[i].Name)
+		assert.Equal(t, e.t, ms[i].Type)
+		assert.Equal(t, e.value, ms[i].Value)
+	}
+
+	assert.True(t, ms[2].Matches("cpu1"))
+	assert.False(t, ms[2].Matches("cpu10"))
+	assert.True(t, ms[4].Matches("z"))
+	assert.False(t, ms[4].Matches("yes"))
+}
+
+func TestParseSelectorWithoutName(t *testing.T) {
+	ms, err := ParseSelector(`{__name__=~"sonar_.*"}`)
+	require.NoError(t, err)
+	require.Len(t, ms, 1)
+	assert.True(t, ms[0].Matches("sonar_load1"))
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, s := range []string{
+		``,
+		`{}`,
+		`sonar_cpu{mode="user"`,
+		`sonar_cpu{mode}`,
+		`sonar_cpu{mode=user}`,
+		`sonar_cpu{mode="user" cpu="0"}`,
+		`sonar_cpu{mode=~"("}`,
+		`0sonar`,
+		`sonar_cpu{0mode="a"}`,
+	} {
+		_, err := ParseSelector(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -0,0 +1,259 @@
+// Package history keeps a bounded in-memory history of the metrics sent by
+// the agent so recent values can be inspected locally when the remote
+// pipeline is delayed or unreachable.
+package history
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+)
+
+const metricNameLabel = "__name__"
+
+const (
+	defaultMaxSeries  = 10000
+	defaultMaxSamples = 720
+)
+
+// Sample is a single value observed at a point in time
+type Sample struct {
+	Timestamp time.Time
+	Value     float64
+}
+
+// Series is a set of labels and the samples recorded for them
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+// ring holds the most recent samples of a series. It grows up to max samples
+// and then overwrites the oldest ones
+type ring struct {
+	labels  map[string]string
+	samples []Sample
+	head    int
+	max     int
+}
+
+func (r *ring) push(s Sample) {
+	if len(r.samples) < r.max {
+		r.samples = append(r.samples, s)
+		return
+	}
+	r.samples[r.head] = s
+	r.head = (r.head + 1) % r.max
+}
+
+// newest returns the most recently pushed sample
+func (r *ring) newest() Sample {
+	if len(r.samples) < r.max || r.head == 0 {
+		return r.samples[len(r.samples)-1]
+	}
+	return r.samples[r.head-1]
+}
+
+// between returns all samples in [start, end] oldest first
+func (r *ring) between(start, end time.Time) []Sample {
+	var out []Sample
+	for i := 0; i < len(r.samples); i++ {
+		s := r.samples[(r.head+i)%len(r.samples)]
+		if s.Timestamp.Before(start) || s.Timestamp.After(end) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+type storeOpts struct {
+	maxSeries  int
+	maxSamples int
+}
+
+// Option is used to configure optional store options.
+type Option func(o *storeOpts)
+
+// WithMaxSeries limits the number of series kept. New series beyond the limit
+// are dropped until older ones expire. Values below 1 keep the default
+func WithMaxSeries(n int) Option {
+	return func(o *storeOpts) {
+		if n >= 1 {
+			o.maxSeries = n
+		}
+	}
+}
+
+// WithMaxSamples limits the number of samples kept per series. Values below 1
+// keep the default
+func WithMaxSamples(n int) Option {
+	return func(o *storeOpts) {
+		if n >= 1 {
+			o.maxSamples = n
+		}
+	}
+}
+
+// Store is a bounded in-memory time series store
+type Store struct {
+	retention time.Duration
+	opts      storeOpts
+	now       func() time.Time
+
+	m      sync.RWMutex
+	series map[string]*ring
+
+	seriesDesc  *prometheus.Desc
+	samplesDesc *prometheus.Desc
+	dropped     prometheus.Counter
+}
+
+// NewStore creates a new Store which keeps samples for the given retention
+func NewStore(retention time.Duration, opts ...Option) *Store {
+	defOpts := storeOpts{
+		maxSeries:  defaultMaxSeries,
+		maxSamples: defaultMaxSamples,
+	}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	return &Store{
+		retention: retention,
+		opts:      defOpts,
+		now:       time.Now,
+		series:    map[string]*ring{},
+		seriesDesc: prometheus.NewDesc(
+			"history_series",
+			"Number of series held in the local history.",
+			nil, nil,
+		),
+		samplesDesc: prometheus.NewDesc(
+			"history_samples",
+			"Number of samples held in the local history.",
+			nil, nil,
+		),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "history_dropped_series_total",
+			Help: "Total new series not recorded in the local history because it was full.",
+		}),
+	}
+}
+
+// Append records the metrics observed at ts
+func (s *Store) Append(ts time.Time, mets []aggregate.MetricWithValue) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.expire()
+
+	for _, met := range mets {
+		// staleness markers end a series, they are not a sample of it
+		if aggregate.IsStaleNaN(met.Value) {
+			continue
+		}
+		key := met.Labels.String()
+		r, ok := s.series[key]
+		if !ok {
+			if len(s.series) >= s.opts.maxSeries {
+				s.dropped.Inc()
+				continue
+			}
+			r = &ring{labels: met.Labels.Map(), max: s.opts.maxSamples}
+			s.series[key] = r
+		}
+		r.push(Sample{Timestamp: ts, Value: met.Value})
+	}
+}
+
+// expire removes series without samples inside the retention window. It must
+// be called with the write lock held
+func (s *Store) expire() {
+	cutoff := s.now().Add(-s.retention)
+	for key, r := range s.series {
+		if r.newest().Timestamp.Before(cutoff) {
+			delete(s.series, key)
+		}
+	}
+}
+
+// Query returns all series matching every matcher with their samples in
+// [start, end]. Series without samples in the range are omitted and results
+// are sorted by their labels
+func (s *Store) Query(matchers []*Matcher, start, end time.Time) []Series {
+	if cutoff := s.now().Add(-s.retention); start.Before(cutoff) {
+		start = cutoff
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	var keys []string
+	var out []Series
+	for key, r := range s.series {
+		if !matchesAll(matchers, r.labels) {
+			continue
+		}
+		samples := r.between(start, end)
+		if len(samples) == 0 {
+			continue
+		}
+		labels := make(map[string]string, len(r.labels))
+		for k, v := range r.labels {
+			labels[k] = v
+		}
+		keys = append(keys, key)
+		out = append(out, Series{Labels: labels, Samples: samples})
+	}
+
+	sort.Sort(byKey{keys, out})
+	return out
+}
+
+func matchesAll(matchers []*Matcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+type byKey struct {
+	keys   []string
+	series []Series
+}
+
+func (b byKey) Len() int           { return len(b.keys) }
+func (b byKey) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.series[i], b.series[j] = b.series[j], b.series[i]
+}
+
+// Describe describes the metrics about this store
+func (s *Store) Describe(ch chan<- *prometheus.Desc) {
+	ch <- s.seriesDesc
+	ch <- s.samplesDesc
+	s.dropped.Describe(ch)
+}
+
+// Collect collects metrics about this store
+func (s *Store) Collect(ch chan<- prometheus.Metric) {
+	s.m.RLock()
+	series := len(s.series)
+	var samples int
+	for _, r := range s.series {
+		samples += len(r.samples)
+	}
+	s.m.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(s.seriesDesc, prometheus.GaugeValue, float64(series))
+	ch <- prometheus.MustNewConstMetric(s.samplesDesc, prometheus.GaugeValue, float64(samples))
+	s.dropped.Collect(ch)
+}
@@ -0,0 +1,140 @@
+package history
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func cpu(mode string, v float64) aggregate.MetricWithValue {
+	return aggregate.MetricWithValue{
+		Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_cpu", "mode": mode}),
+		Value:  v,
+	}
+}
+
+func newTestStore(retention time.Duration, opts ...Option) (*Store, *time.Time) {
+	now := start
+	s := NewStore(retention, opts...)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestStoreQueryByMatchers(t *testing.T) {
+	s, now := newTestStore(time.Hour)
+	for i := 0; i < 3; i++ {
+		s.Append(*now, []aggregate.MetricWithValue{cpu("user", float64(i)), cpu("system", float64(i*10))})
+		*now = now.Add(time.Minute)
+	}
+
+	ms, err := ParseSelector(`sonar_cpu{mode="user"}`)
+	require.NoError(t, err)
+	res := s.Query(ms, start, *now)
+	require.Len(t, res, 1)
+	assert.Equal(t, "user", res[0].Labels["mode"])
+	require.Len(t, res[0].Samples, 3)
+	assert.Equal(t, 2.0, res[0].Samples[2].Value)
+
+	res = s.Query(ms, start.Add(time.Minute), start.Add(time.Minute))
+	require.Len(t, res, 1)
+	require.Len(t, res[0].Samples, 1)
+	assert.Equal(t, 1.0, res[0].Samples[0].Value)
+
+	ms, err = ParseSelector(`sonar_cpu`)
+	require.NoError(t, err)
+	res = s.Query(ms, start, *now)
+	require.Len(t, res, 2)
+	// sorted by labels
+	assert.Equal(t, "system", res[0].Labels["mode"])
+}
+
+func TestStoreRingOverwritesOldestSamples(t *testing.T) {
+	s, now := newTestStore(time.Hour, WithMaxSamples(2))
+	for i := 0; i < 5; i++ {
+		s.Append(*now, []aggregate.MetricWithValue{cpu("user", float64(i))})
+		*now = now.Add(time.Second)
+	}
+
+	ms, err := ParseSelector(`sonar_cpu`)
+	require.NoError(t, err)
+	res := s.Query(ms, start, *now)
+	require.Len(t, res, 1)
+	require.Len(t, res[0].Samples, 2)
+	assert.Equal(t, 3.0, res[0].Samples[0].Value)
+	assert.Equal(t, 4.0, res[0].Samples[1].Value)
+}
+
+func TestStoreExpiresSeriesAndLimitsSeries(t *testing.T) {
+	s, now := newTestStore(time.Hour, WithMaxSeries(1))
+	s.Append(*now, []aggregate.MetricWithValue{cpu("user", 1), cpu("system", 1)})
+
+	ms, err := ParseSelector(`sonar_cpu`)
+	require.NoError(t, err)
+	require.Len(t, s.Query(ms, start, *now), 1)
+
+	*now = now.Add(2 * time.Hour)
+	s.Append(*now, []aggregate.MetricWithValue{cpu("system", 2)})
+	res := s.Query(ms, start, *now)
+	require.Len(t, res, 1)
+	assert.Equal(t, "system", res[0].Labels["mode"])
+}
+
+func TestStoreIgnoresLimitsBelowOne(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		s, now := newTestStore(time.Hour, WithMaxSamples(n), WithMaxSeries(n))
+		s.Append(*now, []aggregate.MetricWithValue{cpu("user", 1), cpu("system", 1)})
+
+		ms, err := ParseSelector(`sonar_cpu`)
+		require.NoError(t, err)
+		require.Len(t, s.Query(ms, start, *now), 2)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s, now := newTestStore(time.Hour)
+	s.Append(*now, []aggregate.MetricWithValue{cpu("user", 1.5)})
+
+	srv := httptest.NewServer(Handler(s))
+	defer srv.Close()
+
+	q := url.Values{"query": {`sonar_cpu{mode="user"}`}, "start": {"1699999990"}, "end": {start.Format(time.RFC3339)}}
+	resp, err := http.Get(srv.URL + "?" + q.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var body struct {
+		Status string
+		Data   struct {
+			ResultType string
+			Result     []struct {
+				Metric map[string]string
+				Values [][2]interface{}
+			}
+		}
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, "success", body.Status)
+	assert.Equal(t, "matrix", body.Data.ResultType)
+	require.Len(t, body.Data.Result, 1)
+	assert.Equal(t, "user", body.Data.Result[0].Metric["mode"])
+	assert.Equal(t, [][2]interface{}{{1700000000.0, "1.5"}}, body.Data.Result[0].Values)
+}
+
+func TestHandlerRejectsBadSelector(t *testing.T) {
+	s, _ := newTestStore(time.Hour)
+	rec := httptest.NewRecorder()
+	Handler(s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?query=%7B", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,75 @@
+package relabel
+
+import (
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// Families applies the configs to the labels of every metric in mfs, with the
+// family name as __name__. Dropped metrics are removed and metrics whose name
+// is rewritten are moved to the family of their new name. Families left
+// without metrics are removed
+func Families(mfs []*dto.MetricFamily, cfgs []*Config) []*dto.MetricFamily {
+	if len(cfgs) == 0 {
+		return mfs
+	}
+
+	byName := make(map[string]*dto.MetricFamily, len(mfs))
+	var names []string
+	family := func(name string, like *dto.MetricFamily) *dto.MetricFamily {
+		if mf, ok := byName[name]; ok {
+			return mf
+		}
+		mf := &dto.MetricFamily{Name: proto.String(name), Help: like.Help, Type: like.Type, Unit: like.Unit}
+		byName[name] = mf
+		names = append(names, name)
+		return mf
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			labels := make(map[string]string, len(m.Label)+1)
+			for _, l := range m.Label {
+				labels[l.GetName()] = l.GetValue()
+			}
+			labels[nameLabel] = mf.GetName()
+
+			labels, keep := Process(labels, cfgs...)
+			if !keep {
+				continue
+			}
+			name := labels[nameLabel]
+			if name == "" {
+				continue
+			}
+			delete(labels, nameLabel)
+
+			out := family(name, mf)
+			if out.GetType() != mf.GetType() {
+				log.Debug("dropping %s relabeled to %s of a different type", mf.GetName(), name)
+				continue
+			}
+			m.Label = labelPairs(labels)
+			out.Metric = append(out.Metric, m)
+		}
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(names))
+	for _, name := range names {
+		if mf := byName[name]; len(mf.Metric) > 0 {
+			out = append(out, mf)
+		}
+	}
+	return out
+}
+
+// labelPairs converts labels into label pairs sorted by name
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for _, name := range sortedNames(labels) {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+	}
+	return pairs
+}
@@ -0,0 +1,268 @@
+// Package relabel rewrites the labels of metrics following the semantics of
+// Prometheus relabel_configs
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Action is the action a relabel config takes
+type Action string
+
+const (
+	// Replace sets target_label to replacement with the capture groups of
+	// regex matching the joined source_labels expanded
+	Replace Action = "replace"
+	// Keep drops series whose joined source_labels do not match regex
+	Keep Action = "keep"
+	// Drop drops series whose joined source_labels match regex
+	Drop Action = "drop"
+	// HashMod sets target_label to the modulus of a hash of the joined
+	// source_labels
+	HashMod Action = "hashmod"
+	// LabelMap copies the values of labels whose names match regex to labels
+	// named by replacement with the capture groups of regex expanded
+	LabelMap Action = "labelmap"
+	// LabelDrop removes labels whose names match regex
+	LabelDrop Action = "labeldrop"
+	// LabelKeep removes labels whose names do not match regex
+	LabelKeep Action = "labelkeep"
+)
+
+// nameLabel is the label holding the metric name
+const nameLabel = "__name__"
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// Regex is a regular expression which must match a whole string
+type Regex struct {
+	*regexp.Regexp
+	original string
+}
+
+// NewRegex compiles a regular expression anchored at both ends
+func NewRegex(s string) (Regex, error) {
+	re, err := regexp.Compile("^(?:" + s + ")$")
+	if err != nil {
+		return Regex{}, err
+	}
+	return Regex{Regexp: re, original: s}, nil
+}
+
+// MustNewRegex is like NewRegex but panics if s does not compile
+func MustNewRegex(s string) Regex {
+	re, err := NewRegex(s)
+	if err != nil {
+		panic(err)
+	}
+	return re
+}
+
+// String returns the regular expression as written
+func (re Regex) String() string {
+	return re.original
+}
+
+// UnmarshalYAML parses and compiles a regular expression
+func (re *Regex) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	r, err := NewRegex(s)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", s, err)
+	}
+	*re = r
+	return nil
+}
+
+// Config is a single relabeling step. Fields which are not set take the same
+// defaults as in Prometheus
+type Config struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    string   `yaml:"separator"`
+	Regex        Regex    `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       Action   `yaml:"action"`
+}
+
+// DefaultConfig is the config fields not set in a relabel config default to
+var DefaultConfig = Config{
+	Separator:   ";",
+	Regex:       MustNewRegex("(.*)"),
+	Replacement: "$1",
+	Action:      Replace,
+}
+
+// UnmarshalYAML parses a relabel config, applying the defaults, and validates it
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	*c = DefaultConfig
+	type plain Config
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	return c.Validate()
+}
+
+// Validate returns an error if the config can not be applied
+func (c *Config) Validate() error {
+	if c.Regex.Regexp == nil {
+		c.Regex = DefaultConfig.Regex
+	}
+	c.Action = Action(strings.ToLower(string(c.Action)))
+	switch c.Action {
+	case Replace, HashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel action %q requires a target_label", c.Action)
+		}
+		if c.Action == Replace && !strings.Contains(c.TargetLabel, "$") && !labelNameRE.MatchString(c.TargetLabel) {
+			return fmt.Errorf("%q is an invalid target_label for action %q", c.TargetLabel, c.Action)
+		}
+		if c.Action == HashMod && c.Modulus == 0 {
+			return fmt.Errorf("relabel action %q requires a non-zero modulus", c.Action)
+		}
+	case Keep, Drop, LabelMap:
+	case LabelDrop, LabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" || c.Modulus != 0 ||
+			c.Separator != DefaultConfig.Separator || c.Replacement != DefaultConfig.Replacement {
+			return fmt.Errorf("relabel action %q only takes a regex", c.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// Process applies the configs to labels in order. It returns the relabeled
+// labels and false if the series is to be dropped. labels is modified
+func Process(labels map[string]string, cfgs ...*Config) (map[string]string, bool) {
+	for _, cfg := range cfgs {
+		if !relabel(labels, cfg) {
+			return nil, false
+		}
+	}
+	return labels, true
+}
+
+func relabel(labels map[string]string, cfg *Config) bool {
+	values := make([]string, len(cfg.SourceLabels))
+	for i, name := range cfg.SourceLabels {
+		values[i] = labels[name]
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case Drop:
+		if cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Keep:
+		if !cfg.Regex.MatchString(val) {
+			return false
+		}
+	case Replace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		// no match, no replacement
+		if indexes == nil {
+			break
+		}
+		target := string(cfg.Regex.ExpandString(nil, cfg.TargetLabel, val, indexes))
+		if !labelNameRE.MatchString(target) {
+			break
+		}
+		res := cfg.Regex.ExpandString(nil, cfg.Replacement, val, indexes)
+		if len(res) == 0 {
+			delete(labels, target)
+			break
+		}
+		labels[target] = string(res)
+	case HashMod:
+		hash := md5.Sum([]byte(val))
+		// only the lower 64 bits are used, like Prometheus
+		mod := binary.BigEndian.Uint64(hash[8:]) % cfg.Modulus
+		labels[cfg.TargetLabel] = fmt.Sprintf("%d", mod)
+	case LabelMap:
+		// names are sorted so overlapping mappings resolve deterministically
+		for _, name := range sortedNames(labels) {
+			if cfg.Regex.MatchString(name) {
+				labels[cfg.Regex.ReplaceAllString(name, cfg.Replacement)] = labels[name]
+			}
+		}
+	case LabelDrop:
+		for name := range labels {
+			if cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case LabelKeep:
+		for name := range labels {
+			if !cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// File is the relabel configs applied to all metrics and those applied to
+// the metrics of scrapers by their name
+type File struct {
+	Global   []*Config            `yaml:"global"`
+	Scrapers map[string][]*Config `yaml:"scrapers"`
+}
+
+// ReadFile reads relabel configs from a YAML or JSON file, for example
+//
+//	global:
+//	  - source_labels: [__name__]
+//	    regex: go_.*
+//	    action: drop
+//	scrapers:
+//	  gpu:
+//	    - regex: (pci_bus_id|uuid)
+//	      action: labeldrop
+func ReadFile(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relabel configs: %w", err)
+	}
+
+	f := &File{}
+	if err := yaml.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("failed to parse relabel configs %s: %w", path, err)
+	}
+	for _, cfg := range f.Global {
+		if cfg == nil {
+			return nil, errors.New("empty relabel config")
+		}
+	}
+	for name, cfgs := range f.Scrapers {
+		for _, cfg := range cfgs {
+			if cfg == nil {
+				return nil, fmt.Errorf("empty relabel config for scraper %q", name)
+			}
+		}
+	}
+	return f, nil
+}
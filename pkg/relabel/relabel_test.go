@@ -0,0 +1,226 @@
+package relabel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// config returns cfg with the defaults of unset fields applied
+func config(t *testing.T, cfg string) *Config {
+	c := &Config{}
+	require.NoError(t, yaml.Unmarshal([]byte(cfg), c))
+	return c
+}
+
+// the cases follow the reference tests of Prometheus' relabel package
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  map[string]string
+		cfgs   []string
+		output map[string]string
+	}{
+		{
+			name:   "replace with capture groups",
+			input:  map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			cfgs:   []string{`{source_labels: [a], regex: f(.*), target_label: d, replacement: "ch${1}-ch${1}"}`},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "choo-choo"},
+		},
+		{
+			name:  "chained replaces with separators",
+			input: map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			cfgs: []string{
+				`{source_labels: [a, b], regex: "f(.*);(.*)r", target_label: a, replacement: "b${1}${2}m"}`,
+				`{source_labels: [c, a], regex: "(b).*b(.*)ba(.*)", target_label: d, replacement: "$1$2$2$3"}`,
+			},
+			output: map[string]string{"a": "boobam", "b": "bar", "c": "baz", "d": "boooom"},
+		},
+		{
+			name:  "drop stops processing",
+			input: map[string]string{"a": "foo"},
+			cfgs: []string{
+				`{source_labels: [a], regex: ".*o.*", action: drop}`,
+				`{source_labels: [a], target_label: d, replacement: bar}`,
+			},
+		},
+		{
+			name:   "drop without match",
+			input:  map[string]string{"a": "foo"},
+			cfgs:   []string{`{source_labels: [a], regex: "no-match", action: drop}`},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name:  "keep without match",
+			input: map[string]string{"a": "foo"},
+			cfgs:  []string{`{source_labels: [a], regex: "no-match", action: keep}`},
+		},
+		{
+			name:   "keep is anchored",
+			input:  map[string]string{"a": "foo"},
+			cfgs:   []string{`{source_labels: [a], regex: "f.*", action: keep}`, `{source_labels: [a], regex: "o", action: drop}`},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name:   "replace without match",
+			input:  map[string]string{"a": "boo"},
+			cfgs:   []string{`{source_labels: [a], regex: f, target_label: b, replacement: bar}`},
+			output: map[string]string{"a": "boo"},
+		},
+		{
+			name:   "replace from missing labels",
+			input:  map[string]string{"a": "foo"},
+			cfgs:   []string{`{source_labels: [b], regex: "(.*)", target_label: b, replacement: "x$1"}`},
+			output: map[string]string{"a": "foo", "b": "x"},
+		},
+		{
+			name:   "empty replacement removes the target",
+			input:  map[string]string{"a": "foo", "b": "bar"},
+			cfgs:   []string{`{source_labels: [c], target_label: b}`},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name:   "target label from capture groups",
+			input:  map[string]string{"a": "some-name-value"},
+			cfgs:   []string{`{source_labels: [a], regex: "some-([^-]+)-([^,]+)", replacement: "${2}", target_label: "${1}"}`},
+			output: map[string]string{"a": "some-name-value", "name": "value"},
+		},
+		{
+			name:   "invalid target label",
+			input:  map[string]string{"a": "some-name-value"},
+			cfgs:   []string{`{source_labels: [a], regex: "some-([^-]+)-([^,]+)", replacement: "${1}", target_label: "${3}"}`},
+			output: map[string]string{"a": "some-name-value"},
+		},
+		{
+			name:   "invalid target label with prefix",
+			input:  map[string]string{"a": "some-name-value"},
+			cfgs:   []string{`{source_labels: [a], regex: "some-([^-]+)-([^,]+)", replacement: "${1}", target_label: "0${3}"}`},
+			output: map[string]string{"a": "some-name-value"},
+		},
+		{
+			name:   "hashmod",
+			input:  map[string]string{"a": "foo", "b": "bar", "c": "baz"},
+			cfgs:   []string{`{source_labels: [c], target_label: d, modulus: 1000, action: hashmod}`},
+			output: map[string]string{"a": "foo", "b": "bar", "c": "baz", "d": "976"},
+		},
+		{
+			name:  "labelmap",
+			input: map[string]string{"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc"},
+			cfgs:  []string{`{regex: "__meta_(my.*)", replacement: "${1}", action: labelmap}`},
+			output: map[string]string{
+				"a": "foo", "__meta_my_bar": "aaa", "__meta_my_baz": "bbb", "__meta_other": "ccc",
+				"my_bar": "aaa", "my_baz": "bbb",
+			},
+		},
+		{
+			name:   "labeldrop",
+			input:  map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			cfgs:   []string{`{regex: "(b.*)", action: labeldrop}`},
+			output: map[string]string{"a": "foo"},
+		},
+		{
+			name:   "labelkeep",
+			input:  map[string]string{"a": "foo", "b1": "bar", "b2": "baz"},
+			cfgs:   []string{`{regex: "(b.*)", action: labelkeep}`},
+			output: map[string]string{"b1": "bar", "b2": "baz"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfgs []*Config
+			for _, c := range tt.cfgs {
+				cfgs = append(cfgs, config(t, c))
+			}
+			out, keep := Process(tt.input, cfgs...)
+			require.Equal(t, tt.output != nil, keep)
+			if keep {
+				require.Equal(t, tt.output, out)
+			}
+		})
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	for _, cfg := range []string{
+		`{action: replace, target_label: ""}`,
+		`{action: replace, target_label: "0abc"}`,
+		`{action: hashmod, target_label: d}`,
+		`{action: labeldrop, source_labels: [a]}`,
+		`{action: labelkeep, replacement: x}`,
+		`{action: lowercase}`,
+		`{regex: "("}`,
+	} {
+		require.Error(t, yaml.Unmarshal([]byte(cfg), &Config{}), cfg)
+	}
+
+	c := config(t, `{target_label: "${1}"}`)
+	require.Equal(t, Replace, c.Action)
+	require.Equal(t, ";", c.Separator)
+	require.Equal(t, "(.*)", c.Regex.String())
+}
+
+func TestFamilies(t *testing.T) {
+	gauge := dto.MetricType_GAUGE
+	counter := dto.MetricType_COUNTER
+	metric := func(labels ...string) *dto.Metric {
+		m := &dto.Metric{Gauge: &dto.Gauge{Value: proto.Float64(1)}}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+		}
+		return m
+	}
+	mfs := []*dto.MetricFamily{
+		{Name: proto.String("gpu_util"), Type: &gauge, Metric: []*dto.Metric{metric("gpu", "0", "uuid", "a"), metric("gpu", "1", "uuid", "b")}},
+		{Name: proto.String("go_goroutines"), Type: &gauge, Metric: []*dto.Metric{metric()}},
+		{Name: proto.String("gpu_temp"), Type: &gauge, Metric: []*dto.Metric{metric("gpu", "0")}},
+		{Name: proto.String("gpu_errors"), Type: &counter, Metric: []*dto.Metric{metric("gpu", "0")}},
+	}
+
+	out := Families(mfs, []*Config{
+		config(t, `{source_labels: [__name__], regex: "go_.*", action: drop}`),
+		config(t, `{regex: uuid, action: labeldrop}`),
+		config(t, `{source_labels: [__name__], regex: "gpu_(util|errors)", target_label: __name__, replacement: gpu_temp}`),
+		config(t, `{source_labels: [gpu], regex: "1", action: drop}`),
+	})
+	require.Len(t, out, 1)
+	require.Equal(t, "gpu_temp", out[0].GetName())
+	// the counter can not join the gauges
+	require.Len(t, out[0].Metric, 2)
+	for _, m := range out[0].Metric {
+		require.Len(t, m.Label, 1)
+		require.Equal(t, "gpu", m.Label[0].GetName())
+	}
+
+	require.Equal(t, mfs, Families(mfs, nil))
+}
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relabel.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+global:
+  - source_labels: [__name__]
+    regex: go_.*
+    action: drop
+scrapers:
+  gpu:
+    - regex: (pci_bus_id|uuid)
+      action: labeldrop
+`), 0o600))
+
+	f, err := ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, f.Global, 1)
+	require.Equal(t, Drop, f.Global[0].Action)
+	require.Len(t, f.Scrapers["gpu"], 1)
+	require.Equal(t, LabelDrop, f.Scrapers["gpu"][0].Action)
+
+	require.NoError(t, os.WriteFile(path, []byte("global:\n  - action: hashmod\n"), 0o600))
+	_, err = ReadFile(path)
+	require.Error(t, err)
+}
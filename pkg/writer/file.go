@@ -1,9 +1,11 @@
 package writer
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/digitalocean/do-agent/pkg/aggregate"
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,27 +13,67 @@ import (
 
 // File writes metrics to an io.Writer
 type File struct {
-	w io.Writer
-	m *sync.Mutex
-	c *prometheus.CounterVec
+	w   io.Writer
+	m   *sync.Mutex
+	c   *prometheus.CounterVec
+	enc encoder
+	now func() time.Time
 }
 
-// NewFile creates a new File writer with the provided writer
-func NewFile(w io.Writer, c *prometheus.CounterVec) *File {
+type fileOpts struct {
+	format Format
+}
+
+// FileOption is used to configure optional File writer options.
+type FileOption func(o *fileOpts)
+
+// WithFormat configures the output format of the File writer
+func WithFormat(f Format) FileOption {
+	return func(o *fileOpts) {
+		o.format = f
+	}
+}
+
+// NewFile creates a new File writer with the provided writer. It fails if the
+// format is unknown
+func NewFile(w io.Writer, c *prometheus.CounterVec, opts ...FileOption) (*File, error) {
+	defOpts := &fileOpts{
+		format: FormatText,
+	}
+	for _, opt := range opts {
+		opt(defOpts)
+	}
+
+	enc, ok := encoders[defOpts.format]
+	if !ok {
+		return nil, fmt.Errorf("unknown output format %q", defOpts.format)
+	}
+
 	c = c.MustCurryWith(prometheus.Labels{"writer": "file"})
 	return &File{
-		w: w,
-		m: new(sync.Mutex),
-		c: c,
-	}
+		w:   w,
+		m:   new(sync.Mutex),
+		c:   c,
+		enc: enc,
+		now: time.Now,
+	}, nil
 }
 
-// Write writes metrics to the file
+// Write writes metrics to the file. The whole batch is encoded before it is
+// written so it is never interleaved with or split from other batches
 func (w *File) Write(mets []aggregate.MetricWithValue) error {
 	w.m.Lock()
 	defer w.m.Unlock()
-	for _, met := range mets {
-		fmt.Fprintf(w.w, "[%s]: %v: %v\n", met.LFM["__name__"], met.LFM, met.Value)
+
+	buf := new(bytes.Buffer)
+	if err := w.enc(buf, mets, w.now()); err != nil {
+		w.c.WithLabelValues("failure", "failed to encode metrics").Inc()
+		return err
+	}
+
+	if _, err := w.w.Write(buf.Bytes()); err != nil {
+		w.c.WithLabelValues("failure", "failed to write metrics").Inc()
+		return fmt.Errorf("failed to write metrics: %w", err)
 	}
 	w.c.WithLabelValues("success", "").Inc()
 	return nil
@@ -0,0 +1,170 @@
+package writer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+const metricNameLabel = "__name__"
+
+// Format is an output format supported by the File writer
+type Format string
+
+const (
+	// FormatText is a human readable dump of each metric
+	FormatText Format = "text"
+	// FormatJSON writes one JSON object per metric per line
+	FormatJSON Format = "json"
+	// FormatPrometheus writes the Prometheus text exposition format
+	FormatPrometheus Format = "prometheus"
+	// FormatInflux writes the InfluxDB line protocol
+	FormatInflux Format = "influx"
+)
+
+// Formats is the list of all supported formats
+var Formats = []Format{FormatText, FormatJSON, FormatPrometheus, FormatInflux}
+
+// encoder writes a batch of metrics observed at ts to w
+type encoder func(w io.Writer, mets []aggregate.MetricWithValue, ts time.Time) error
+
+var encoders = map[Format]encoder{
+	FormatText:       encodeText,
+	FormatJSON:       encodeJSON,
+	FormatPrometheus: encodePrometheus,
+	FormatInflux:     encodeInflux,
+}
+
+func encodeText(w io.Writer, mets []aggregate.MetricWithValue, _ time.Time) error {
+	for _, met := range mets {
+		if _, err := fmt.Fprintf(w, "[%s]: %v: %v\n", met.Labels.Name(), met.Labels.Map(), met.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type jsonMetric struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     *float64          `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+func encodeJSON(w io.Writer, mets []aggregate.MetricWithValue, ts time.Time) error {
+	enc := json.NewEncoder(w)
+	for _, met := range mets {
+		labels := make(map[string]string, met.Labels.Len())
+		for _, l := range met.Labels.Labels() {
+			if l.Name == metricNameLabel {
+				continue
+			}
+			labels[l.Name] = l.Value
+		}
+		jm := jsonMetric{
+			Name:      met.Labels.Name(),
+			Labels:    labels,
+			Timestamp: ts.UnixMilli(),
+		}
+		// json cannot represent NaN or infinities so they are written as null
+		if !math.IsNaN(met.Value) && !math.IsInf(met.Value, 0) {
+			v := met.Value
+			jm.Value = &v
+		}
+		if err := enc.Encode(jm); err != nil {
+			return fmt.Errorf("failed to encode %q: %w", jm.Name, err)
+		}
+	}
+	return nil
+}
+
+var promLabelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func encodePrometheus(w io.Writer, mets []aggregate.MetricWithValue, ts time.Time) error {
+	for _, met := range mets {
+		var b strings.Builder
+		b.WriteString(met.Labels.Name())
+		names := sortedLabelNames(met.Labels)
+		if len(names) > 0 {
+			b.WriteByte('{')
+			for i, name := range names {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteString(name)
+				b.WriteString(`="`)
+				promLabelValueEscaper.WriteString(&b, met.Labels.Get(name))
+				b.WriteByte('"')
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(formatFloat(met.Value))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(ts.UnixMilli(), 10))
+		b.WriteByte('\n')
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	influxTagEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+)
+
+func encodeInflux(w io.Writer, mets []aggregate.MetricWithValue, ts time.Time) error {
+	for _, met := range mets {
+		// the line protocol cannot represent NaN or infinities
+		if math.IsNaN(met.Value) || math.IsInf(met.Value, 0) {
+			continue
+		}
+		var b strings.Builder
+		influxMeasurementEscaper.WriteString(&b, met.Labels.Name())
+		for _, name := range sortedLabelNames(met.Labels) {
+			// the line protocol does not allow empty tag values
+			if met.Labels.Get(name) == "" {
+				continue
+			}
+			b.WriteByte(',')
+			influxTagEscaper.WriteString(&b, name)
+			b.WriteByte('=')
+			influxTagEscaper.WriteString(&b, met.Labels.Get(name))
+		}
+		b.WriteString(" value=")
+		b.WriteString(formatFloat(met.Value))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+		b.WriteByte('\n')
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedLabelNames returns the label names of ls without __name__ in sorted order
+func sortedLabelNames(ls tsclient.LabelSet) []string {
+	names := make([]string, 0, ls.Len())
+	for _, l := range ls.Labels() {
+		if l.Name == metricNameLabel {
+			continue
+		}
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// formatFloat formats a value the way the Prometheus exposition format expects
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
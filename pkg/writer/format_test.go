@@ -0,0 +1,86 @@
+package writer
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+var (
+	testTime = time.Unix(1700000000, 0)
+	testMets = []aggregate.MetricWithValue{{
+		Labels: tsclient.LabelSetFromMap(map[string]string{
+			"__name__": "sonar_cpu",
+			"mode":     "user",
+			"host_id":  "1234",
+		}),
+		Value: 12.5,
+	}}
+)
+
+func newTestCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_writes"}, []string{"writer", "result", "reason"})
+}
+
+func writeFormat(t *testing.T, f Format, mets []aggregate.MetricWithValue) string {
+	buf := new(bytes.Buffer)
+	w, err := NewFile(buf, newTestCounter(), WithFormat(f))
+	require.NoError(t, err)
+	w.now = func() time.Time { return testTime }
+	require.NoError(t, w.Write(mets))
+	return buf.String()
+}
+
+func TestNewFileRejectsUnknownFormat(t *testing.T) {
+	_, err := NewFile(new(bytes.Buffer), newTestCounter(), WithFormat("yaml"))
+	require.Error(t, err)
+}
+
+func TestFileFormatJSON(t *testing.T) {
+	out := writeFormat(t, FormatJSON, testMets)
+	assert.JSONEq(t, `{"name":"sonar_cpu","labels":{"mode":"user","host_id":"1234"},"value":12.5,"timestamp":1700000000000}`, out)
+}
+
+func TestFileFormatJSONNaN(t *testing.T) {
+	out := writeFormat(t, FormatJSON, []aggregate.MetricWithValue{{
+		Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "up"}),
+		Value:  math.NaN(),
+	}})
+	assert.JSONEq(t, `{"name":"up","labels":{},"value":null,"timestamp":1700000000000}`, out)
+}
+
+func TestFileFormatPrometheus(t *testing.T) {
+	out := writeFormat(t, FormatPrometheus, []aggregate.MetricWithValue{
+		testMets[0],
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "escaped", "path": "C:\\a \"b\"\n"}), Value: math.Inf(1)},
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "unlabeled"}), Value: 1},
+	})
+	assert.Equal(t, `sonar_cpu{host_id="1234",mode="user"} 12.5 1700000000000
+escaped{path="C:\\a \"b\"\n"} +Inf 1700000000000
+unlabeled 1 1700000000000
+`, out)
+}
+
+func TestFileFormatInflux(t *testing.T) {
+	out := writeFormat(t, FormatInflux, []aggregate.MetricWithValue{
+		testMets[0],
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "disk free", "mount": "/mnt/a,b=c", "empty": ""}), Value: 3},
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "skipped"}), Value: math.NaN()},
+	})
+	assert.Equal(t, `sonar_cpu,host_id=1234,mode=user value=12.5 1700000000000000000
+disk\ free,mount=/mnt/a\,b\=c value=3 1700000000000000000
+`, out)
+}
+
+func TestFileFormatText(t *testing.T) {
+	out := writeFormat(t, FormatText, testMets)
+	assert.Equal(t, "[sonar_cpu]: map[__name__:sonar_cpu host_id:1234 mode:user]: 12.5\n", out)
+}
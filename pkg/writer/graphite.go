@@ -0,0 +1,302 @@
+package writer
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GraphiteProtocol is a plaintext protocol supported by the Graphite writer
+type GraphiteProtocol string
+
+const (
+	// ProtocolGraphite writes the Graphite plaintext protocol with dotted paths
+	ProtocolGraphite GraphiteProtocol = "graphite"
+	// ProtocolDogStatsD writes DogStatsD gauges with tags
+	ProtocolDogStatsD GraphiteProtocol = "dogstatsd"
+)
+
+const (
+	defaultGraphiteTimeout = 10 * time.Second
+	// defaultMaxPacketSize keeps UDP datagrams below a typical MTU
+	defaultMaxPacketSize = 1432
+)
+
+var (
+	graphiteSanitizer   = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+	dogstatsdTagEscaper = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+)
+
+type graphiteOpts struct {
+	protocol      GraphiteProtocol
+	prefix        string
+	labelOrder    []string
+	replacement   string
+	timeout       time.Duration
+	maxPacketSize int
+}
+
+// GraphiteOption is used to configure optional Graphite writer options.
+type GraphiteOption func(o *graphiteOpts)
+
+// WithProtocol configures the plaintext protocol to write
+func WithProtocol(p GraphiteProtocol) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.protocol = p
+	}
+}
+
+// WithPrefix prepends prefix to every metric path
+func WithPrefix(prefix string) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.prefix = prefix
+	}
+}
+
+// WithLabelOrder places the values of the given labels first, in order, when
+// flattening labels into a Graphite path. Remaining labels follow sorted by name
+func WithLabelOrder(labels ...string) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.labelOrder = labels
+	}
+}
+
+// WithReplacement replaces characters which are not valid in path components
+// with replacement instead of an underscore
+func WithReplacement(replacement string) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.replacement = replacement
+	}
+}
+
+// WithWriteTimeout configures the timeout for connecting and writing
+func WithWriteTimeout(d time.Duration) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.timeout = d
+	}
+}
+
+// WithMaxPacketSize limits the size of each datagram when writing over UDP
+func WithMaxPacketSize(size int) GraphiteOption {
+	return func(o *graphiteOpts) {
+		o.maxPacketSize = size
+	}
+}
+
+// Graphite writes metrics to a Graphite or StatsD server in a plaintext
+// protocol over TCP or UDP
+type Graphite struct {
+	network string
+	address string
+	opts    graphiteOpts
+	c       *prometheus.CounterVec
+	now     func() time.Time
+
+	m    sync.Mutex
+	conn net.Conn
+}
+
+// NewGraphite creates a new Graphite writer which writes to address over
+// network, which must be either "tcp" or "udp"
+func NewGraphite(network, address string, c *prometheus.CounterVec, opts ...GraphiteOption) (*Graphite, error) {
+	defOpts := graphiteOpts{
+		protocol:      ProtocolGraphite,
+		replacement:   "_",
+		timeout:       defaultGraphiteTimeout,
+		maxPacketSize: defaultMaxPacketSize,
+	}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
+	switch network {
+	case "tcp", "udp":
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	switch defOpts.protocol {
+	case ProtocolGraphite, ProtocolDogStatsD:
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", defOpts.protocol)
+	}
+
+	g := &Graphite{
+		network: network,
+		address: address,
+		opts:    defOpts,
+		c:       c.MustCurryWith(prometheus.Labels{"writer": string(defOpts.protocol)}),
+		now:     time.Now,
+	}
+	// the prefix may span several dotted path components
+	if g.opts.prefix != "" {
+		parts := strings.Split(g.opts.prefix, ".")
+		for i, p := range parts {
+			parts[i] = g.sanitize(p)
+		}
+		g.opts.prefix = strings.Join(parts, ".")
+	}
+	return g, nil
+}
+
+// Write writes the metrics to the remote server
+func (g *Graphite) Write(mets []aggregate.MetricWithValue) error {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	ts := g.now()
+	packets := g.encode(mets, ts)
+
+	if g.conn == nil {
+		conn, err := net.DialTimeout(g.network, g.address, g.opts.timeout)
+		if err != nil {
+			g.c.WithLabelValues("failure", "failed to connect").Inc()
+			return fmt.Errorf("failed to connect to %s: %w", g.address, err)
+		}
+		g.conn = conn
+	}
+
+	for _, p := range packets {
+		if err := g.conn.SetWriteDeadline(time.Now().Add(g.opts.timeout)); err != nil {
+			g.reset()
+			g.c.WithLabelValues("failure", "failed to write").Inc()
+			return fmt.Errorf("failed to set write deadline: %w", err)
+		}
+		if _, err := g.conn.Write(p); err != nil {
+			// reconnect on the next write
+			g.reset()
+			g.c.WithLabelValues("failure", "failed to write").Inc()
+			return fmt.Errorf("failed to write to %s: %w", g.address, err)
+		}
+	}
+
+	g.c.WithLabelValues("success", "").Inc()
+	return nil
+}
+
+// Name is the name of this writer
+func (g *Graphite) Name() string {
+	return string(g.opts.protocol)
+}
+
+// Close closes the connection to the remote server
+func (g *Graphite) Close() error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
+
+func (g *Graphite) reset() {
+	g.conn.Close()
+	g.conn = nil
+}
+
+// encode encodes the metrics into payloads to write. Over TCP everything is
+// written at once, over UDP lines are grouped into datagrams no larger than
+// maxPacketSize
+func (g *Graphite) encode(mets []aggregate.MetricWithValue, ts time.Time) [][]byte {
+	var packets [][]byte
+	buf := new(bytes.Buffer)
+	for _, met := range mets {
+		// neither protocol can represent NaN or infinities
+		if math.IsNaN(met.Value) || math.IsInf(met.Value, 0) {
+			continue
+		}
+
+		var line string
+		switch g.opts.protocol {
+		case ProtocolDogStatsD:
+			line = g.dogstatsdLine(met)
+		default:
+			line = g.graphiteLine(met, ts)
+		}
+
+		if g.network == "udp" && buf.Len() > 0 && buf.Len()+len(line) > g.opts.maxPacketSize {
+			packets = append(packets, buf.Bytes())
+			buf = new(bytes.Buffer)
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		packets = append(packets, buf.Bytes())
+	}
+	return packets
+}
+
+// graphiteLine renders "<prefix>.<name>.<label values...> <value> <timestamp>"
+func (g *Graphite) graphiteLine(met aggregate.MetricWithValue, ts time.Time) string {
+	parts := make([]string, 0, met.Labels.Len()+1)
+	if g.opts.prefix != "" {
+		parts = append(parts, g.opts.prefix)
+	}
+	parts = append(parts, g.sanitize(met.Labels.Name()))
+	for _, name := range g.orderedLabelNames(met.Labels) {
+		parts = append(parts, g.sanitize(met.Labels.Get(name)))
+	}
+
+	return fmt.Sprintf("%s %s %d\n", strings.Join(parts, "."), formatFloat(met.Value), ts.Unix())
+}
+
+// dogstatsdLine renders "<prefix>.<name>:<value>|g|#label:value,..."
+func (g *Graphite) dogstatsdLine(met aggregate.MetricWithValue) string {
+	name := g.sanitize(met.Labels.Name())
+	if g.opts.prefix != "" {
+		name = g.opts.prefix + "." + name
+	}
+
+	names := g.orderedLabelNames(met.Labels)
+	tags := make([]string, 0, len(names))
+	for _, n := range names {
+		tags = append(tags, dogstatsdTagEscaper.Replace(n+":"+met.Labels.Get(n)))
+	}
+
+	line := name + ":" + strconv.FormatFloat(met.Value, 'f', -1, 64) + "|g"
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line + "\n"
+}
+
+// orderedLabelNames returns the label names configured with WithLabelOrder
+// that are present on the metric followed by the remaining names sorted
+func (g *Graphite) orderedLabelNames(ls tsclient.LabelSet) []string {
+	names := make([]string, 0, ls.Len())
+	seen := make(map[string]bool, len(g.opts.labelOrder))
+	for _, n := range g.opts.labelOrder {
+		if _, ok := ls.Lookup(n); !ok || n == metricNameLabel {
+			continue
+		}
+		seen[n] = true
+		names = append(names, n)
+	}
+
+	for _, n := range sortedLabelNames(ls) {
+		if !seen[n] {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// sanitize makes s safe to use as a single path component
+func (g *Graphite) sanitize(s string) string {
+	if s == "" {
+		return g.opts.replacement
+	}
+	return graphiteSanitizer.ReplaceAllString(s, g.opts.replacement)
+}
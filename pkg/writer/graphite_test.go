@@ -0,0 +1,111 @@
+package writer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+func TestGraphiteWritesPlaintextOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	g, err := NewGraphite("tcp", l.Addr().String(), newTestCounter(),
+		WithPrefix("droplets"),
+		WithLabelOrder("host_id", "mode"),
+	)
+	require.NoError(t, err)
+	defer g.Close()
+	g.now = func() time.Time { return testTime }
+
+	require.NoError(t, g.Write([]aggregate.MetricWithValue{
+		testMets[0],
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_filesystem_free", "mountpoint": "/mnt/vol 1", "device": ""}), Value: 7},
+	}))
+
+	assert.Equal(t, "droplets.sonar_cpu.1234.user 12.5 1700000000", <-lines)
+	assert.Equal(t, "droplets.sonar_filesystem_free._._mnt_vol_1 7 1700000000", <-lines)
+}
+
+func TestGraphiteWritesDogStatsDOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	g, err := NewGraphite("udp", conn.LocalAddr().String(), newTestCounter(),
+		WithProtocol(ProtocolDogStatsD),
+		WithMaxPacketSize(50),
+	)
+	require.NoError(t, err)
+	defer g.Close()
+	assert.Equal(t, "dogstatsd", g.Name())
+
+	require.NoError(t, g.Write([]aggregate.MetricWithValue{
+		testMets[0],
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_load1"}), Value: 0.25},
+	}))
+
+	buf := make([]byte, 1024)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "sonar_cpu:12.5|g|#host_id:1234,mode:user\n", string(buf[:n]))
+
+	// the second metric does not fit in the same datagram
+	n, _, err = conn.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "sonar_load1:0.25|g\n", string(buf[:n]))
+}
+
+func TestGraphiteReplacement(t *testing.T) {
+	g, err := NewGraphite("tcp", "127.0.0.1:0", newTestCounter(), WithReplacement("-"))
+	require.NoError(t, err)
+
+	line := g.graphiteLine(aggregate.MetricWithValue{
+		Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_cpu", "cpu": "CPU 0/1"}),
+		Value:  1,
+	}, testTime)
+	assert.Equal(t, "sonar_cpu.CPU-0-1 1 1700000000", strings.TrimSpace(line))
+}
+
+func TestGraphiteSanitizesPrefix(t *testing.T) {
+	g, err := NewGraphite("udp", "127.0.0.1:0", newTestCounter(),
+		WithProtocol(ProtocolDogStatsD),
+		WithPrefix("do agent.prod:1"),
+		WithReplacement("-"),
+	)
+	require.NoError(t, err)
+
+	line := g.dogstatsdLine(aggregate.MetricWithValue{
+		Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_load1"}),
+		Value:  1,
+	})
+	assert.Equal(t, "do-agent.prod-1.sonar_load1:1|g", strings.TrimSpace(line))
+}
+
+func TestGraphiteRejectsUnknownNetwork(t *testing.T) {
+	_, err := NewGraphite("unix", "/tmp/graphite.sock", newTestCounter())
+	require.Error(t, err)
+}
@@ -0,0 +1,233 @@
+package writer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/do-agent/internal/log"
+)
+
+// rotatedTimeFormat is appended to the file path when a file is rotated. It
+// sorts lexically in chronological order
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+type rotateOpts struct {
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	retention  time.Duration
+}
+
+// RotateOption is used to configure optional rotation options.
+type RotateOption func(o *rotateOpts)
+
+// WithMaxSize rotates the file once writing to it would exceed size bytes.
+func WithMaxSize(size int64) RotateOption {
+	return func(o *rotateOpts) {
+		o.maxSize = size
+	}
+}
+
+// WithRotateInterval rotates the file once it has been open for d.
+func WithRotateInterval(d time.Duration) RotateOption {
+	return func(o *rotateOpts) {
+		o.interval = d
+	}
+}
+
+// WithMaxBackups keeps at most n rotated files, removing the oldest ones.
+func WithMaxBackups(n int) RotateOption {
+	return func(o *rotateOpts) {
+		o.maxBackups = n
+	}
+}
+
+// WithRetention removes rotated files older than d.
+func WithRetention(d time.Duration) RotateOption {
+	return func(o *rotateOpts) {
+		o.retention = d
+	}
+}
+
+// RotatingFile is an io.WriteCloser which appends to a file and rotates it by
+// size or age. Rotated files are renamed to <path>.<timestamp> and pruned
+// according to the configured retention.
+//
+// Each call to Write is written to a single file, so callers that write whole
+// batches at once never have a batch split across files.
+type RotatingFile struct {
+	path string
+	opts rotateOpts
+	now  func() time.Time
+
+	m      sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingFile opens or creates the file at path for appending
+func NewRotatingFile(path string, opts ...RotateOption) (*RotatingFile, error) {
+	r := &RotatingFile{
+		path: path,
+		now:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(&r.opts)
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Write writes p to the current file, rotating it first if required
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if r.shouldRotate(int64(len(p))) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (r *RotatingFile) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+func (r *RotatingFile) shouldRotate(n int64) bool {
+	if r.size == 0 {
+		// never rotate an empty file, even if a single write exceeds the size
+		return false
+	}
+	if r.opts.maxSize > 0 && r.size+n > r.opts.maxSize {
+		return true
+	}
+	if r.opts.interval > 0 && r.now().Sub(r.opened) >= r.opts.interval {
+		return true
+	}
+	return false
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", r.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat %s: %w", r.path, err)
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.opened = r.now()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		log.Error("failed to close %s before rotating: %v", r.path, err)
+	}
+	r.f = nil
+
+	rotated := fmt.Sprintf("%s.%s", r.path, r.now().UTC().Format(rotatedTimeFormat))
+	if err := os.Rename(r.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", r.path, err)
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+
+	r.prune()
+	return nil
+}
+
+// prune removes rotated files which exceed the configured retention
+func (r *RotatingFile) prune() {
+	if r.opts.maxBackups <= 0 && r.opts.retention <= 0 {
+		return
+	}
+
+	backups, err := r.backups()
+	if err != nil {
+		log.Error("failed to list rotated files for %s: %v", r.path, err)
+		return
+	}
+
+	// backups are sorted newest first
+	for i, b := range backups {
+		expired := r.opts.retention > 0 && r.now().Sub(b.t) > r.opts.retention
+		excess := r.opts.maxBackups > 0 && i >= r.opts.maxBackups
+		if !expired && !excess {
+			continue
+		}
+		if err := os.Remove(b.path); err != nil {
+			log.Error("failed to remove rotated file %s: %v", b.path, err)
+		}
+	}
+}
+
+type backup struct {
+	path string
+	t    time.Time
+}
+
+// backups returns all rotated files for this path sorted newest first
+func (r *RotatingFile) backups() ([]backup, error) {
+	dir, base := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := base + "."
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, err := time.Parse(rotatedTimeFormat, strings.TrimPrefix(name, prefix))
+		if err != nil {
+			// not one of ours
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, name), t: t})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].t.After(backups[j].t) })
+	return backups, nil
+}
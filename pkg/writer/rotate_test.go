@@ -0,0 +1,111 @@
+package writer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	r, err := NewRotatingFile(path, WithMaxSize(10))
+	require.NoError(t, err)
+	defer r.Close()
+
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { now = now.Add(time.Second); return now }
+
+	_, err = r.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	_, err = r.Write([]byte("abc"))
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+
+	backups, err := r.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	b, err = os.ReadFile(backups[0].path)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(b))
+}
+
+func TestRotatingFileRotatesByInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	now := time.Unix(1700000000, 0)
+	r, err := NewRotatingFile(path, WithRotateInterval(time.Minute))
+	require.NoError(t, err)
+	defer r.Close()
+	r.now = func() time.Time { return now }
+	r.opened = now
+
+	_, err = r.Write([]byte("first"))
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = r.Write([]byte("second"))
+	require.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = r.Write([]byte("third"))
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "third", string(b))
+}
+
+func TestRotatingFilePrunesBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	r, err := NewRotatingFile(path, WithMaxSize(1), WithMaxBackups(2))
+	require.NoError(t, err)
+	defer r.Close()
+
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { now = now.Add(time.Second); return now }
+
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		_, err = r.Write([]byte(s))
+		require.NoError(t, err)
+	}
+
+	backups, err := r.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	for i, want := range []string{"d", "c"} {
+		b, err := os.ReadFile(backups[i].path)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(b))
+	}
+}
+
+func TestRotatingFilePrunesExpiredBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.log")
+	r, err := NewRotatingFile(path, WithMaxSize(1), WithRetention(90*time.Minute))
+	require.NoError(t, err)
+	defer r.Close()
+
+	now := time.Unix(1700000000, 0)
+	r.now = func() time.Time { return now }
+
+	for _, s := range []string{"a", "b", "c", "d"} {
+		_, err = r.Write([]byte(s))
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+
+	// backups are named after the time they were rotated, the one rotated
+	// two hours ago is past retention
+	backups, err := r.backups()
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	for i, want := range []string{"c", "b"} {
+		b, err := os.ReadFile(backups[i].path)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(b))
+	}
+}
@@ -21,39 +21,90 @@ var (
 	ErrFlushFailure = fmt.Errorf("flush failure")
 )
 
+type sonarOpts struct {
+	staleMarker *float64
+}
+
+// SonarOption is used to configure optional sonar writer options.
+type SonarOption func(o *sonarOpts)
+
+// WithStaleMarker sends series marked stale with aggregate.StaleNaN with the
+// given value. Without it stale markers are not sent to sonar
+func WithStaleMarker(v float64) SonarOption {
+	return func(o *sonarOpts) {
+		o.staleMarker = &v
+	}
+}
+
 // Sonar writes metrics to DigitalOcean sonar
 type Sonar struct {
 	client         tsclient.Client
 	firstWriteSent bool
 	c              *prometheus.CounterVec
+	opts           sonarOpts
 }
 
 // NewSonar creates a new Sonar writer
-func NewSonar(client tsclient.Client, c *prometheus.CounterVec) *Sonar {
+func NewSonar(client tsclient.Client, c *prometheus.CounterVec, opts ...SonarOption) *Sonar {
+	defOpts := sonarOpts{}
+	for _, opt := range opts {
+		opt(&defOpts)
+	}
+
 	c = c.MustCurryWith(prometheus.Labels{"writer": "sonar"})
 	return &Sonar{
 		client:         client,
 		firstWriteSent: false,
 		c:              c,
+		opts:           defOpts,
+	}
+}
+
+// add adds a metric to the batch of the client, by its label set if the
+// client supports it
+func (s *Sonar) add(ls tsclient.LabelSet, value float64) error {
+	if a, ok := s.client.(tsclient.LabelSetAdder); ok {
+		return a.AddLabelSet(ls, value)
 	}
+	return s.client.AddMetric(tsclient.NewDefinitionFromMap(ls.Map()), value)
+}
+
+// count returns the number of metrics in mets which are sent
+func (s *Sonar) count(mets []aggregate.MetricWithValue) int {
+	if s.opts.staleMarker != nil {
+		return len(mets)
+	}
+	n := 0
+	for _, m := range mets {
+		if !aggregate.IsStaleNaN(m.Value) {
+			n++
+		}
+	}
+	return n
 }
 
 // Write writes the metrics to Sonar and returns the amount of time to wait
 // before the next write
 func (s *Sonar) Write(mets []aggregate.MetricWithValue) error {
-	if len(mets) > s.client.MaxBatchSize() {
+	if n := s.count(mets); n > s.client.MaxBatchSize() {
 		s.c.WithLabelValues("failure", "too many metrics").Inc()
 		return fmt.Errorf("cannot write metrics, current count: %d, max allowed: %d, error: %w",
-			len(mets), s.client.MaxBatchSize(), ErrTooManyMetrics)
+			n, s.client.MaxBatchSize(), ErrTooManyMetrics)
 	}
 
 	for _, m := range mets {
-		lfmEncoded := tsclient.ConvertLFMMapToPrometheusEncodedName(m.LFM)
-		if len(lfmEncoded) > s.client.MaxMetricLength() {
+		value := m.Value
+		if aggregate.IsStaleNaN(value) {
+			if s.opts.staleMarker == nil {
+				continue
+			}
+			value = *s.opts.staleMarker
+		}
+		if m.Labels.EncodedLen() > s.client.MaxMetricLength() {
 			s.c.WithLabelValues("failure", "metric exceeds max length").Inc()
-			return fmt.Errorf("cannot send metric %q: %w", lfmEncoded, ErrMetricTooLong)
+			return fmt.Errorf("cannot send metric %q: %w", m.Labels, ErrMetricTooLong)
 		}
-		err := s.client.AddMetric(tsclient.NewDefinitionFromMap(m.LFM), m.Value)
+		err := s.add(m.Labels, value)
 		if err != nil {
 			s.c.WithLabelValues("failure", "could not add metric to batch").Inc()
 			return err
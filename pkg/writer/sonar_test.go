@@ -0,0 +1,85 @@
+package writer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/digitalocean/do-agent/pkg/aggregate"
+	"github.com/digitalocean/do-agent/pkg/clients/tsclient"
+)
+
+// fakeClient records the values of the label sets added to it
+type fakeClient struct {
+	tsclient.Client
+	added    map[string]float64
+	maxBatch int
+}
+
+func (f *fakeClient) AddLabelSet(ls tsclient.LabelSet, value float64) error {
+	f.added[ls.Name()] = value
+	return nil
+}
+
+func (f *fakeClient) Flush() error                { return nil }
+func (f *fakeClient) WaitDuration() time.Duration { return time.Minute }
+func (f *fakeClient) MaxMetricLength() int        { return 1000 }
+
+func (f *fakeClient) MaxBatchSize() int {
+	if f.maxBatch > 0 {
+		return f.maxBatch
+	}
+	return 100
+}
+
+func staleMets() []aggregate.MetricWithValue {
+	return []aggregate.MetricWithValue{
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_load1"}), Value: 0.25},
+		{Labels: tsclient.LabelSetFromMap(map[string]string{"__name__": "sonar_process_cpu"}), Value: aggregate.StaleNaN},
+	}
+}
+
+func TestSonarSkipsStaleMarkers(t *testing.T) {
+	c := &fakeClient{added: map[string]float64{}}
+	s := NewSonar(c, newTestCounter())
+
+	require.NoError(t, s.Write(staleMets()))
+	assert.Equal(t, map[string]float64{"sonar_load1": 0.25}, c.added)
+}
+
+func TestSonarWithStaleMarker(t *testing.T) {
+	c := &fakeClient{added: map[string]float64{}}
+	s := NewSonar(c, newTestCounter(), WithStaleMarker(-1))
+
+	require.NoError(t, s.Write(staleMets()))
+	assert.Equal(t, map[string]float64{"sonar_load1": 0.25, "sonar_process_cpu": -1}, c.added)
+}
+
+func TestSonarBatchSizeCountsSentMetrics(t *testing.T) {
+	c := &fakeClient{added: map[string]float64{}, maxBatch: 1}
+	require.NoError(t, NewSonar(c, newTestCounter()).Write(staleMets()))
+
+	err := NewSonar(c, newTestCounter(), WithStaleMarker(-1)).Write(staleMets())
+	assert.ErrorIs(t, err, ErrTooManyMetrics)
+}
+
+// definitionClient records the metrics added to it by definition
+type definitionClient struct {
+	fakeClient
+	defs []*tsclient.Definition
+}
+
+func (f *definitionClient) AddMetric(def *tsclient.Definition, value float64, labels ...string) error {
+	f.defs = append(f.defs, def)
+	return nil
+}
+
+func TestSonarAddsByDefinitionWithoutLabelSetSupport(t *testing.T) {
+	c := &definitionClient{}
+	// only the methods of tsclient.Client are visible to the writer
+	s := NewSonar(struct{ tsclient.Client }{c}, newTestCounter())
+	require.NoError(t, s.Write(staleMets()))
+	require.Len(t, c.defs, 1)
+}